@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Журнал запросов (access log): по строке на каждый RPC-запрос клиента.
+//
+// Путь задается -access-log ("-" - stdout, пусто - журнал выключен), формат -
+// -access-log-format:
+//
+// * json - JSON-объект с полями client_ip, conn_id, rpc_id, method, url, upstream,
+//   upstream_host, status, response_bytes, upstream_time, total_time, error_code и др.;
+// * combined - как combined у nginx, с дополнительными полями в конце:
+//
+//     10.0.0.1 - user42 [16/Oct/2026:06:20:13 +0000] "GET http://up.lan/a HTTP/1.1" 200 993 "-" "Mozilla/5.0"
+//         conn=3 rpc_id=9 upstream=up upstream_host=up.lan upstream_time=0.045 request_time=0.046 error=0 cache=-
+//
+// -access-log-sample-rate задает долю записываемых успешных запросов (от 0 до 1);
+// запросы, завершившиеся ошибкой или ответом 5xx, записываются всегда.
+//
+// По SIGUSR1 файл журнала открывается заново (для logrotate).
+
+const (
+	AccessLogFormatJson     = "json"
+	AccessLogFormatCombined = "combined"
+)
+
+type AccessLogSettings struct {
+	Path       string
+	Format     string
+	SampleRate float64
+}
+
+// Проверить настройки журнала
+func (s *AccessLogSettings) Validate() error {
+	switch s.Format {
+	case AccessLogFormatJson, AccessLogFormatCombined:
+	default:
+		return fmt.Errorf("unknown access log format %q, expected json or combined", s.Format)
+	}
+	if s.SampleRate < 0 || s.SampleRate > 1 {
+		return fmt.Errorf("sample rate must be between 0 and 1")
+	}
+	return nil
+}
+
+// Строка журнала
+type AccessLogRecord struct {
+	Time          time.Time   `json:"time"`
+	ClientIp      string      `json:"client_ip"`
+	ConnId        uint64      `json:"conn_id"`
+	RpcId         interface{} `json:"rpc_id"`
+	UserId        string      `json:"user_id,omitempty"`
+	UserAgent     string      `json:"user_agent,omitempty"`
+	Method        string      `json:"method"` // HTTP-метод или имя служебного метода
+	Url           string      `json:"url,omitempty"`
+	Upstream      string      `json:"upstream,omitempty"`
+	UpstreamHost  string      `json:"upstream_host,omitempty"`
+	Status        int         `json:"status,omitempty"`
+	ResponseBytes int         `json:"response_bytes"`
+	UpstreamTime  float64     `json:"upstream_time"`
+	TotalTime     float64     `json:"total_time"`
+	ErrorCode     int         `json:"error_code,omitempty"`
+	Cache         string      `json:"cache,omitempty"`
+}
+
+type AccessLog struct {
+	lock     sync.Mutex
+	settings AccessLogSettings
+	file     *os.File // nil - журнал выключен
+}
+
+var (
+	accessLog = &AccessLog{}
+)
+
+// Применить настройки; файл открывается заново, если сменился путь
+func (al *AccessLog) Configure(settings AccessLogSettings) error {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	if settings.Path != al.settings.Path || al.file == nil && settings.Path != "" {
+		file, err := openAccessLog(settings.Path)
+		if err != nil {
+			return err
+		}
+		al.closeFile()
+		al.file = file
+	}
+	al.settings = settings
+	return nil
+}
+
+func openAccessLog(path string) (*os.File, error) {
+	switch path {
+	case "":
+		return nil, nil
+	case "-":
+		return os.Stdout, nil
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
+
+func (al *AccessLog) closeFile() {
+	if al.file != nil && al.file != os.Stdout {
+		al.file.Close()
+	}
+	al.file = nil
+}
+
+// Открыть файл журнала заново (после переименования logrotate'ом)
+func (al *AccessLog) Reopen() error {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	if al.settings.Path == "" || al.settings.Path == "-" {
+		return nil
+	}
+	file, err := openAccessLog(al.settings.Path)
+	if err != nil {
+		return err
+	}
+	al.closeFile()
+	al.file = file
+	return nil
+}
+
+// Открывать журнал заново по SIGUSR1
+func (al *AccessLog) ReopenOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	for range signals {
+		if err := al.Reopen(); err != nil {
+			logErrorf(nil, "access log: reopen failed: %s", err)
+		} else {
+			logInfof(nil, "access log: reopened")
+		}
+	}
+}
+
+// Записать строку журнала (с учетом выборки)
+func (al *AccessLog) Write(r *AccessLogRecord) {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	if al.file == nil {
+		return
+	}
+	failed := r.ErrorCode != 0 || r.Status >= 500
+	if !failed && al.settings.SampleRate < 1 && rand.Float64() >= al.settings.SampleRate {
+		return
+	}
+	var line []byte
+	if al.settings.Format == AccessLogFormatCombined {
+		line = r.formatCombined()
+	} else {
+		line = append(jsonLogValue(r), '\n')
+	}
+	if _, err := al.file.Write(line); err != nil {
+		logErrorf(nil, "access log: %s", err)
+	}
+}
+
+func (r *AccessLogRecord) formatCombined() []byte {
+	buf := &bytes.Buffer{}
+	status := "-"
+	if r.Status != 0 {
+		status = strconv.Itoa(r.Status)
+	}
+	fmt.Fprintf(buf, "%s - %s [%s] \"%s %s HTTP/1.1\" %s %d \"-\" %s",
+		r.ClientIp, combinedField(r.UserId), r.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		combinedField(r.Method), combinedField(r.Url), status, r.ResponseBytes, strconv.Quote(r.UserAgent))
+	fmt.Fprintf(buf, " conn=%d rpc_id=%s upstream=%s upstream_host=%s upstream_time=%.3f request_time=%.3f error=%d cache=%s\n",
+		r.ConnId, combinedField(string(jsonLogValue(r.RpcId))), combinedField(r.Upstream), combinedField(r.UpstreamHost),
+		r.UpstreamTime, r.TotalTime, r.ErrorCode, combinedField(r.Cache))
+	return buf.Bytes()
+}
+
+// Значение поля combined: "-" вместо пустого, без пробелов и кавычек
+func combinedField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	quoted := strconv.QuoteToASCII(s)
+	return strings.Replace(quoted[1:len(quoted)-1], " ", "%20", -1)
+}
+
+// Записать в журнал завершившийся запрос rq, начатый в момент started
+func (c *ProxyClient) writeAccessLog(rq *JsonRpcRequest, started time.Time) {
+	now := time.Now()
+	info := &rq.logInfo
+	clientIp, _ := c.clientAddress()
+	r := &AccessLogRecord{
+		Time:          started,
+		ClientIp:      clientIp,
+		ConnId:        c.id,
+		RpcId:         rq.Id,
+		UserAgent:     c.originalRequest.UserAgent(),
+		Method:        info.method,
+		Url:           info.url,
+		Upstream:      info.upstream,
+		UpstreamHost:  info.upstreamHost,
+		Status:        info.status,
+		ResponseBytes: info.responseBytes,
+		UpstreamTime:  info.upstreamTime.Seconds(),
+		TotalTime:     now.Sub(started).Seconds(),
+		ErrorCode:     info.errCode,
+		Cache:         info.cache,
+	}
+	if r.Method == "" {
+		r.Method = rq.Method
+	}
+	if c.identity != nil {
+		r.UserId = c.identity.UserId
+	}
+	accessLog.Write(r)
+}
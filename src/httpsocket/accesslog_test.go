@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogCombinedEscaping(t *testing.T) {
+	r := &AccessLogRecord{
+		Time:      time.Unix(1000, 0).UTC(),
+		ClientIp:  "10.0.0.1",
+		RpcId:     1,
+		Method:    "GET\" 200 0 \"-\" \"-\"\n10.6.6.6 - admin [01/Jan/2026:00:00:00 +0000] \"GET",
+		Url:       "http://up.lan/a b",
+		UserAgent: "agent\"\nx",
+	}
+	line := string(r.formatCombined())
+	if strings.Count(line, "\n") != 1 || !strings.HasSuffix(line, "\n") {
+		t.Fatalf("record spans several lines: %q", line)
+	}
+	request := line[strings.Index(line, "] \"")+3:]
+	request = request[:strings.Index(request, " HTTP/1.1\"")]
+	if len(strings.Split(request, " ")) != 2 || strings.Contains(strings.Replace(request, "\\\"", "", -1), "\"") {
+		t.Errorf("request field is not escaped: %q", request)
+	}
+	if !strings.HasPrefix(line, "10.0.0.1 - - [01/Jan/1970:00:16:40 +0000] \"GET\\\"%20200") {
+		t.Errorf("unexpected line: %q", line)
+	}
+}
+
+func TestAccessLogWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	al := &AccessLog{}
+	if err := al.Configure(AccessLogSettings{Path: path, Format: AccessLogFormatJson, SampleRate: 0}); err != nil {
+		t.Fatal(err)
+	}
+	al.Write(&AccessLogRecord{Method: "GET", Status: 200})                   // не попадает в выборку
+	al.Write(&AccessLogRecord{Method: "GET", Status: 502})                   // ошибки пишутся всегда
+	al.Write(&AccessLogRecord{Method: "POST", ErrorCode: ErrCodeBadGateway}) // и отказы прокси тоже
+
+	// после переименования logrotate'ом журнал пишется в новый файл
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := al.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	al.Write(&AccessLogRecord{Method: "PUT", Status: 500})
+
+	bs, err := ioutil.ReadFile(path + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(bs)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 records, got %q", lines)
+	}
+	var record AccessLogRecord
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil || record.Status != 502 {
+		t.Errorf("unexpected record %q: %v", lines[0], err)
+	}
+	if bs, err := ioutil.ReadFile(path); err != nil || !strings.Contains(string(bs), `"method":"PUT"`) {
+		t.Errorf("reopened log: %q, %v", bs, err)
+	}
+
+	if err := (&AccessLogSettings{Format: "xml"}).Validate(); err == nil {
+		t.Error("unknown format accepted")
+	}
+	if err := (&AccessLogSettings{Format: AccessLogFormatJson, SampleRate: 2}).Validate(); err == nil {
+		t.Error("sample rate over 1 accepted")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Служебные обработчики, доступные только на -admin-listen
+
+// Состояние пулов апстримов
+func (p *WsProxy) ServeUpstreamsStatus(w http.ResponseWriter, r *http.Request) {
+	writeJsonResponse(w, p.Params().Routing.Status())
+}
+
+// Состояние автоматических выключателей апстримов
+func serveBreakersStatus(w http.ResponseWriter, r *http.Request) {
+	writeJsonResponse(w, circuitBreakers.Status())
+}
+
+// Отклоненные значения Origin
+func serveRejectedOrigins(w http.ResponseWriter, r *http.Request) {
+	writeJsonResponse(w, rejectedOrigins.Status())
+}
+
+// Отдать v в виде JSON
+func writeJsonResponse(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(MustMarshalJson(v))
+}
+
+// Перечитать настройки (POST)
+func (p *WsProxy) ServeReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	changes, err := p.Reload()
+	if err != nil {
+		logErrorf(nil, "config: reload failed, keeping current settings: %s", err)
+		http.Error(w, "reload failed: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeJsonResponse(w, map[string]interface{}{"changes": changes})
+}
+
+// Текущий уровень лога (GET) или его смена (POST ?level=debug)
+func serveLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		level, err := ParseLogLevel(r.URL.Query().Get("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if old := logger.Level(); old != level {
+			logger.SetLevel(level)
+			logInfof(Fields("setting", "log-level"), "log level changed: %s -> %s", old, level)
+		}
+	}
+	writeJsonResponse(w, map[string]string{"level": logger.Level().String()})
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Аутентификация клиентов при открытии соединения.
+//
+// Клиент передает токен одним из способов:
+//
+// * параметром запроса: /ws?access_token=<токен> (имя параметра - AuthPolicy.QueryParam);
+// * кукой с именем AuthPolicy.CookieName;
+// * в Sec-WebSocket-Protocol: "bearer.<токен>" (префикс - AuthPolicy.ProtocolPrefix). Браузер
+//   требует, чтобы сервер выбрал один из предложенных протоколов, поэтому если клиент не
+//   предложил jsonrpc-2.0, в ответе будет выбран протокол с токеном.
+//
+// Токен проверяется одним из настроенных способов (см. Authenticator):
+//
+// * JWT, подписанный HMAC (HS256, HS384, HS512) общим секретом; обязательны claims sub и exp,
+//   права берутся из scope (строка через пробел) или scopes (массив);
+// * непрозрачный токен, записанный в локальном файле строкой "<токен> <user id> [права,через,запятую]".
+//
+// Соединение с неверным или просроченным токеном отклоняется с 401 до открытия вебсокета.
+// Проверенная личность клиента передается апстриму в доверенных заголовках
+// AuthPolicy.UserIdHeader и AuthPolicy.ScopesHeader; одноименные заголовки, переданные
+// клиентом (в конверте запроса или через httpsocket.setheaders), удаляются.
+
+// Личность клиента, подтвержденная токеном
+type Identity struct {
+	UserId  string     `json:"user_id"`
+	Scopes  []string   `json:"scopes,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// Способ проверки токена
+type Authenticator interface {
+	Authenticate(token string, now time.Time) (*Identity, error)
+}
+
+type AuthPolicy struct {
+	Authenticator  Authenticator // nil - аутентификация выключена
+	Optional       bool          // пускать клиентов без токена (неверный токен все равно отклоняется)
+	QueryParam     string
+	CookieName     string
+	ProtocolPrefix string
+	UserIdHeader   string
+	ScopesHeader   string
+}
+
+// Допустимое расхождение часов с выпустившим токен сервером
+const JwtClockSkew = 30 * time.Second
+
+// Найти токен в запросе на открытие соединения.
+// fromProtocol - элемент Sec-WebSocket-Protocol, в котором был токен.
+func (p *AuthPolicy) FindToken(r *http.Request) (token string, fromProtocol string) {
+	if p.QueryParam != "" {
+		if token := r.URL.Query().Get(p.QueryParam); token != "" {
+			return token, ""
+		}
+	}
+	if p.CookieName != "" {
+		if cookie, err := r.Cookie(p.CookieName); err == nil && cookie.Value != "" {
+			return cookie.Value, ""
+		}
+	}
+	if p.ProtocolPrefix != "" {
+		for _, protocol := range strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",") {
+			protocol = strings.TrimSpace(protocol)
+			if strings.HasPrefix(protocol, p.ProtocolPrefix) && len(protocol) > len(p.ProtocolPrefix) {
+				return protocol[len(p.ProtocolPrefix):], protocol
+			}
+		}
+	}
+	return "", ""
+}
+
+// Аутентифицировать клиента по запросу на открытие соединения.
+// Возвращает nil без ошибки, если аутентификация выключена или клиент анонимен и это разрешено.
+func (p *AuthPolicy) Authenticate(r *http.Request) (*Identity, string, error) {
+	if p.Authenticator == nil {
+		return nil, "", nil
+	}
+	token, fromProtocol := p.FindToken(r)
+	if token == "" {
+		if p.Optional {
+			return nil, "", nil
+		}
+		return nil, "", fmt.Errorf("no token")
+	}
+	identity, err := p.Authenticator.Authenticate(token, time.Now())
+	if err != nil {
+		return nil, "", err
+	}
+	return identity, fromProtocol, nil
+}
+
+// Убрать из запроса заголовки, которые может выставлять только прокси, и выставить их
+// по личности клиента
+func (p *AuthPolicy) ApplyIdentityHeaders(httpRq *http.Request, identity *Identity) {
+	if p.Authenticator == nil {
+		return
+	}
+	if p.UserIdHeader != "" {
+		httpRq.Header.Del(p.UserIdHeader)
+	}
+	if p.ScopesHeader != "" {
+		httpRq.Header.Del(p.ScopesHeader)
+	}
+	if identity == nil {
+		return
+	}
+	if p.UserIdHeader != "" {
+		httpRq.Header.Set(p.UserIdHeader, identity.UserId)
+	}
+	if p.ScopesHeader != "" && len(identity.Scopes) > 0 {
+		httpRq.Header.Set(p.ScopesHeader, strings.Join(identity.Scopes, " "))
+	}
+}
+
+// Несколько способов проверки: токен принимается, если его принял хотя бы один
+type AuthenticatorChain []Authenticator
+
+func (chain AuthenticatorChain) Authenticate(token string, now time.Time) (*Identity, error) {
+	errors := []string{}
+	for _, a := range chain {
+		identity, err := a.Authenticate(token, now)
+		if err == nil {
+			return identity, nil
+		}
+		errors = append(errors, err.Error())
+	}
+	return nil, fmt.Errorf("%s", strings.Join(errors, "; "))
+}
+
+// Проверка JWT, подписанных HMAC
+type JwtAuthenticator struct {
+	Secret   []byte
+	Issuer   string // если не пусто, claim iss должен совпадать
+	Audience string // если не пусто, claim aud должен его содержать
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"` // строка или массив строк
+	Scope     string          `json:"scope"`
+	Scopes    []string        `json:"scopes"`
+}
+
+var jwtHashes = map[string]func() hash.Hash{
+	"HS256": sha256.New,
+	"HS384": sha512.New384,
+	"HS512": sha512.New,
+}
+
+func (a *JwtAuthenticator) Authenticate(token string, now time.Time) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed JWT")
+	}
+	header := jwtHeader{}
+	if err := decodeJwtPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed JWT header: %s", err)
+	}
+	newHash, ok := jwtHashes[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT signature")
+	}
+	mac := hmac.New(newHash, a.Secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, fmt.Errorf("invalid JWT signature")
+	}
+
+	claims := jwtClaims{}
+	if err := decodeJwtPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed JWT claims: %s", err)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("JWT has no sub")
+	}
+	if claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("JWT has no exp")
+	}
+	expires := time.Unix(int64(*claims.ExpiresAt), 0)
+	if !now.Before(expires.Add(JwtClockSkew)) {
+		return nil, fmt.Errorf("JWT expired")
+	}
+	if claims.NotBefore != nil && now.Add(JwtClockSkew).Before(time.Unix(int64(*claims.NotBefore), 0)) {
+		return nil, fmt.Errorf("JWT not valid yet")
+	}
+	if a.Issuer != "" && claims.Issuer != a.Issuer {
+		return nil, fmt.Errorf("unexpected JWT issuer %q", claims.Issuer)
+	}
+	if a.Audience != "" && !jwtAudienceContains(claims.Audience, a.Audience) {
+		return nil, fmt.Errorf("JWT is not intended for %s", a.Audience)
+	}
+
+	scopes := claims.Scopes
+	if len(scopes) == 0 {
+		scopes = strings.Fields(claims.Scope)
+	}
+	return &Identity{UserId: claims.Subject, Scopes: scopes, Expires: &expires}, nil
+}
+
+func decodeJwtPart(part string, v interface{}) error {
+	bs, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bs, v)
+}
+
+func jwtAudienceContains(aud json.RawMessage, audience string) bool {
+	var single string
+	if err := json.Unmarshal(aud, &single); err == nil {
+		return single == audience
+	}
+	var list []string
+	if err := json.Unmarshal(aud, &list); err == nil {
+		for _, a := range list {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Проверка непрозрачных токенов по списку из файла
+type TokenFileAuthenticator struct {
+	identities map[string]*Identity // sha256 токена -> личность
+}
+
+// Загрузить токены из файла: строки "<токен> <user id> [права,через,запятую]", # - комментарий
+func LoadTokenFile(filename string) (*TokenFileAuthenticator, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := &TokenFileAuthenticator{identities: map[string]*Identity{}}
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: expected `<token> <user id> [scopes]`", filename, lineNo)
+		}
+		identity := &Identity{UserId: fields[1]}
+		if len(fields) == 3 {
+			identity.Scopes = SplitCommaList(fields[2])
+		}
+		a.identities[tokenDigest(fields[0])] = identity
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return a, nil
+}
+
+// Токены сравниваются по хешу, чтобы время поиска не зависело от совпадающего префикса
+func tokenDigest(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return string(sum[:])
+}
+
+func (a *TokenFileAuthenticator) Authenticate(token string, now time.Time) (*Identity, error) {
+	identity, ok := a.identities[tokenDigest(token)]
+	if !ok {
+		return nil, fmt.Errorf("unknown token")
+	}
+	return identity, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testJwtSecret = []byte("test-secret")
+
+// Подписать JWT с claims алгоритмом alg (только HS256) секретом secret
+func makeTestJwt(t *testing.T, alg string, secret []byte, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJwtAuthenticator(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	exp := float64(now.Add(time.Hour).Unix())
+	a := &JwtAuthenticator{Secret: testJwtSecret, Issuer: "auth.example.com", Audience: "httpsocket"}
+	valid := map[string]interface{}{"sub": "u1", "exp": exp, "iss": "auth.example.com", "aud": []string{"other", "httpsocket"}, "scope": "read write"}
+	with := func(key string, value interface{}) map[string]interface{} {
+		claims := map[string]interface{}{}
+		for k, v := range valid {
+			claims[k] = v
+		}
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return claims
+	}
+
+	identity, err := a.Authenticate(makeTestJwt(t, "HS256", testJwtSecret, valid), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.UserId != "u1" || strings.Join(identity.Scopes, ",") != "read,write" {
+		t.Fatalf("unexpected identity %+v", identity)
+	}
+
+	rejected := []struct {
+		name  string
+		token string
+	}{
+		{"wrong secret", makeTestJwt(t, "HS256", []byte("other"), valid)},
+		{"alg none", makeTestJwt(t, "none", testJwtSecret, valid)},
+		{"expired", makeTestJwt(t, "HS256", testJwtSecret, with("exp", float64(now.Add(-time.Minute).Unix())))},
+		{"no exp", makeTestJwt(t, "HS256", testJwtSecret, with("exp", nil))},
+		{"no sub", makeTestJwt(t, "HS256", testJwtSecret, with("sub", nil))},
+		{"not yet valid", makeTestJwt(t, "HS256", testJwtSecret, with("nbf", float64(now.Add(time.Minute).Unix())))},
+		{"wrong issuer", makeTestJwt(t, "HS256", testJwtSecret, with("iss", "evil.example.com"))},
+		{"wrong audience", makeTestJwt(t, "HS256", testJwtSecret, with("aud", "other"))},
+		{"malformed", "abc.def"},
+		{"tampered claims", func() string {
+			parts := strings.Split(makeTestJwt(t, "HS256", testJwtSecret, valid), ".")
+			claims, _ := json.Marshal(with("sub", "admin"))
+			return parts[0] + "." + base64.RawURLEncoding.EncodeToString(claims) + "." + parts[2]
+		}()},
+	}
+	for _, c := range rejected {
+		if identity, err := a.Authenticate(c.token, now); err == nil {
+			t.Errorf("%s: token accepted as %+v", c.name, identity)
+		}
+	}
+
+	// в пределах допустимого расхождения часов токен еще действителен
+	skewed := makeTestJwt(t, "HS256", testJwtSecret, with("exp", float64(now.Add(-JwtClockSkew/2).Unix())))
+	if _, err := a.Authenticate(skewed, now); err != nil {
+		t.Errorf("token expired within clock skew rejected: %s", err)
+	}
+}
+
+func TestTokenFileAuthenticator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpsocket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "tokens")
+	ioutil.WriteFile(filename, []byte("# comment\n\ntok1 user1 read,write\ntok2 user2\n"), 0600)
+
+	a, err := LoadTokenFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := a.Authenticate("tok1", time.Now())
+	if err != nil || identity.UserId != "user1" || strings.Join(identity.Scopes, ",") != "read,write" {
+		t.Fatalf("tok1: got %+v, %v", identity, err)
+	}
+	if identity, err := a.Authenticate("tok2", time.Now()); err != nil || identity.UserId != "user2" || len(identity.Scopes) != 0 {
+		t.Fatalf("tok2: got %+v, %v", identity, err)
+	}
+	for _, token := range []string{"tok", "tok1 ", "user1", ""} {
+		if _, err := a.Authenticate(token, time.Now()); err == nil {
+			t.Errorf("token %q accepted", token)
+		}
+	}
+
+	ioutil.WriteFile(filename, []byte("tok1\n"), 0600)
+	if _, err := LoadTokenFile(filename); err == nil {
+		t.Error("line without user id should be rejected")
+	}
+}
+
+func TestAuthPolicy(t *testing.T) {
+	tokens := &TokenFileAuthenticator{identities: map[string]*Identity{tokenDigest("good"): {UserId: "u1", Scopes: []string{"read"}}}}
+	p := &AuthPolicy{
+		Authenticator:  tokens,
+		QueryParam:     "access_token",
+		CookieName:     "token",
+		ProtocolPrefix: "bearer.",
+		UserIdHeader:   "X-User-Id",
+		ScopesHeader:   "X-User-Scopes",
+	}
+	request := func(setup func(r *http.Request)) *http.Request {
+		r, _ := http.NewRequest("GET", "http://proxy/ws", nil)
+		setup(r)
+		return r
+	}
+
+	cases := []struct {
+		name     string
+		r        *http.Request
+		userId   string
+		protocol string
+		ok       bool
+	}{
+		{"query", request(func(r *http.Request) { r.URL.RawQuery = "access_token=good" }), "u1", "", true},
+		{"cookie", request(func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "token", Value: "good"}) }), "u1", "", true},
+		{"protocol", request(func(r *http.Request) { r.Header.Set("Sec-WebSocket-Protocol", "jsonrpc-2.0, bearer.good") }), "u1", "bearer.good", true},
+		{"bad token", request(func(r *http.Request) { r.URL.RawQuery = "access_token=bad" }), "", "", false},
+		{"no token", request(func(r *http.Request) {}), "", "", false},
+	}
+	for _, c := range cases {
+		identity, protocol, err := p.Authenticate(c.r)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+			continue
+		}
+		if c.ok && (identity.UserId != c.userId || protocol != c.protocol) {
+			t.Errorf("%s: got %+v, protocol %q", c.name, identity, protocol)
+		}
+	}
+
+	p.Optional = true
+	if identity, _, err := p.Authenticate(request(func(r *http.Request) {})); identity != nil || err != nil {
+		t.Errorf("optional auth without token: got %+v, %v", identity, err)
+	}
+	if _, _, err := p.Authenticate(request(func(r *http.Request) { r.URL.RawQuery = "access_token=bad" })); err == nil {
+		t.Error("optional auth should still reject a bad token")
+	}
+
+	// заголовки личности, подделанные клиентом, заменяются
+	upstreamRq, _ := http.NewRequest("GET", "http://up/a", nil)
+	upstreamRq.Header.Set("X-User-Id", "admin")
+	upstreamRq.Header.Set("X-User-Scopes", "admin")
+	p.ApplyIdentityHeaders(upstreamRq, &Identity{UserId: "u1", Scopes: []string{"read"}})
+	if upstreamRq.Header.Get("X-User-Id") != "u1" || upstreamRq.Header.Get("X-User-Scopes") != "read" {
+		t.Errorf("identity headers: %v", upstreamRq.Header)
+	}
+	p.ApplyIdentityHeaders(upstreamRq, nil)
+	if upstreamRq.Header.Get("X-User-Id") != "" || upstreamRq.Header.Get("X-User-Scopes") != "" {
+		t.Errorf("anonymous request kept identity headers: %v", upstreamRq.Header)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Автоматические выключатели (circuit breakers) для апстримов.
+//
+// На каждый апстрим (именованный апстрим из таблицы маршрутизации, а для запросов по явному
+// адресу - разрешившее их правило, см. upstream_rules.go) заводится выключатель с тремя состояниями:
+//
+// * closed - запросы идут в апстрим, ведется подсчет неудачных и медленных ответов за окно Window;
+// * open - если за окно набралось не менее MinRequests запросов, и доля неудачных не меньше
+//   ErrorRatePercent (или доля медленных не меньше SlowRatePercent), выключатель размыкается
+//   на OpenDuration: запросы сразу получают ошибку ErrCodeCircuitOpen с подсказкой retry_after_ms;
+// * half-open - по истечении OpenDuration в апстрим пропускается HalfOpenRequests пробных
+//   запросов; если все они успешны, выключатель замыкается, при первой неудаче снова
+//   размыкается. Учитываются только результаты пробных запросов: запросы, разрешенные до
+//   смены состояния, на него уже не влияют.
+//
+// Запросы, отмененные клиентом, не учитываются вовсе.
+//
+// Неудачным считается запрос, завершившийся сетевой ошибкой, таймаутом или ответом 502/503/504.
+
+type BreakerPolicy struct {
+	Window           time.Duration
+	MinRequests      int
+	ErrorRatePercent int // 0 - не размыкать по доле ошибок
+	SlowThreshold    time.Duration
+	SlowRatePercent  int // 0 - не размыкать по доле медленных ответов
+	OpenDuration     time.Duration
+	HalfOpenRequests int
+}
+
+// Включены ли выключатели вообще?
+func (p *BreakerPolicy) Enabled() bool {
+	return p.ErrorRatePercent > 0 || (p.SlowRatePercent > 0 && p.SlowThreshold > 0)
+}
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+type CircuitBreaker struct {
+	name   string
+	policy *BreakerPolicy
+
+	lock              sync.Mutex
+	state             string
+	windowStart       time.Time
+	requests          int
+	failures          int
+	slow              int
+	openUntil         time.Time
+	halfOpenInFlight  int
+	halfOpenSuccesses int
+	generation        uint64 // увеличивается при каждой смене состояния
+	lastChange        time.Time
+}
+
+// Разрешение на запрос, выданное Allow
+type BreakerTicket struct {
+	generation uint64 // в каком состоянии выключателя выдано
+	probe      bool   // пробный запрос в half-open
+}
+
+// Состояние выключателя для админки
+type CircuitBreakerStatus struct {
+	Name        string    `json:"name"`
+	State       string    `json:"state"`
+	Requests    int       `json:"window_requests"`
+	Failures    int       `json:"window_failures"`
+	Slow        int       `json:"window_slow"`
+	RetryAfter  float64   `json:"retry_after_seconds,omitempty"`
+	LastChanged time.Time `json:"last_changed"`
+}
+
+// Реестр выключателей по именам апстримов
+type CircuitBreakers struct {
+	lock     sync.Mutex
+	breakers map[string]*CircuitBreaker
+}
+
+var (
+	circuitBreakers = &CircuitBreakers{breakers: map[string]*CircuitBreaker{}}
+)
+
+// Выключатель для апстрима name (создается при первом обращении)
+func (cbs *CircuitBreakers) Get(name string, policy *BreakerPolicy) *CircuitBreaker {
+	cbs.lock.Lock()
+	defer cbs.lock.Unlock()
+	cb, ok := cbs.breakers[name]
+	if !ok {
+		now := time.Now()
+		cb = &CircuitBreaker{
+			name:        name,
+			policy:      policy,
+			state:       BreakerClosed,
+			windowStart: now,
+			lastChange:  now,
+		}
+		cbs.breakers[name] = cb
+	} else if cb.policy != policy {
+		// настройки перезагружены
+		cb.lock.Lock()
+		cb.policy = policy
+		cb.lock.Unlock()
+	}
+	return cb
+}
+
+// Состояние всех выключателей
+func (cbs *CircuitBreakers) Status() []CircuitBreakerStatus {
+	cbs.lock.Lock()
+	breakers := make([]*CircuitBreaker, 0, len(cbs.breakers))
+	for _, cb := range cbs.breakers {
+		breakers = append(breakers, cb)
+	}
+	cbs.lock.Unlock()
+
+	sort.Slice(breakers, func(i, j int) bool { return breakers[i].name < breakers[j].name })
+	now := time.Now()
+	result := []CircuitBreakerStatus{}
+	for _, cb := range breakers {
+		cb.lock.Lock()
+		st := CircuitBreakerStatus{
+			Name:        cb.name,
+			State:       cb.state,
+			Requests:    cb.requests,
+			Failures:    cb.failures,
+			Slow:        cb.slow,
+			LastChanged: cb.lastChange,
+		}
+		if cb.state == BreakerOpen && cb.openUntil.After(now) {
+			st.RetryAfter = cb.openUntil.Sub(now).Seconds()
+		}
+		cb.lock.Unlock()
+		result = append(result, st)
+	}
+	return result
+}
+
+// Можно ли выполнить запрос к апстриму?
+// Если можно, возвращает разрешение, которое нужно передать в Record или Cancel;
+// если нельзя - nil и время, через которое стоит повторить попытку.
+func (cb *CircuitBreaker) Allow(now time.Time) (*BreakerTicket, time.Duration) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	if cb.state == BreakerOpen {
+		if now.Before(cb.openUntil) {
+			return nil, cb.openUntil.Sub(now)
+		}
+		cb.setState(BreakerHalfOpen, now)
+	}
+	if cb.state == BreakerHalfOpen {
+		if cb.halfOpenInFlight >= cb.halfOpenRequests() {
+			return nil, cb.policy.OpenDuration / 10
+		}
+		cb.halfOpenInFlight++
+		return &BreakerTicket{generation: cb.generation, probe: true}, 0
+	}
+	return &BreakerTicket{generation: cb.generation}, 0
+}
+
+func (cb *CircuitBreaker) halfOpenRequests() int {
+	if cb.policy.HalfOpenRequests < 1 {
+		return 1
+	}
+	return cb.policy.HalfOpenRequests
+}
+
+// Запрос, разрешенный Allow, отменен клиентом: его результат ничего не говорит об апстриме
+func (cb *CircuitBreaker) Cancel(ticket *BreakerTicket) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if ticket.probe && ticket.generation == cb.generation && cb.halfOpenInFlight > 0 {
+		cb.halfOpenInFlight-- // освобождаем место для другого пробного запроса
+	}
+}
+
+// Учесть результат запроса, разрешенного Allow
+func (cb *CircuitBreaker) Record(ticket *BreakerTicket, now time.Time, failed bool, duration time.Duration) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	if ticket.generation != cb.generation {
+		return // запрос разрешен до смены состояния
+	}
+	slow := cb.policy.SlowThreshold > 0 && duration >= cb.policy.SlowThreshold
+
+	if cb.state == BreakerHalfOpen {
+		if !ticket.probe {
+			return
+		}
+		if cb.halfOpenInFlight > 0 {
+			cb.halfOpenInFlight--
+		}
+		if failed || slow {
+			cb.open(now)
+			return
+		}
+		cb.halfOpenSuccesses++
+		if cb.halfOpenSuccesses >= cb.halfOpenRequests() {
+			cb.setState(BreakerClosed, now)
+		}
+		return
+	}
+
+	if now.Sub(cb.windowStart) >= cb.policy.Window {
+		cb.windowStart = now
+		cb.requests, cb.failures, cb.slow = 0, 0, 0
+	}
+	cb.requests++
+	if failed {
+		cb.failures++
+	}
+	if slow {
+		cb.slow++
+	}
+	if cb.requests < cb.policy.MinRequests {
+		return
+	}
+	p := cb.policy
+	if (p.ErrorRatePercent > 0 && cb.failures*100 >= cb.requests*p.ErrorRatePercent) ||
+		(p.SlowRatePercent > 0 && cb.slow*100 >= cb.requests*p.SlowRatePercent) {
+		cb.open(now)
+	}
+}
+
+func (cb *CircuitBreaker) open(now time.Time) {
+	cb.openUntil = now.Add(cb.policy.OpenDuration)
+	cb.setState(BreakerOpen, now)
+}
+
+func (cb *CircuitBreaker) setState(state string, now time.Time) {
+	if cb.state == state {
+		return
+	}
+	if state == BreakerOpen {
+		logWarnf(Fields("upstream", cb.name, "state", state, "requests", cb.requests, "failures", cb.failures, "slow", cb.slow),
+			"circuit breaker %s: %s -> %s (requests: %d, failures: %d, slow: %d)",
+			cb.name, cb.state, state, cb.requests, cb.failures, cb.slow)
+	} else {
+		logInfof(Fields("upstream", cb.name, "state", state), "circuit breaker %s: %s -> %s", cb.name, cb.state, state)
+	}
+	cb.state = state
+	cb.lastChange = now
+	cb.windowStart = now
+	cb.requests, cb.failures, cb.slow = 0, 0, 0
+	cb.halfOpenInFlight, cb.halfOpenSuccesses = 0, 0
+	cb.generation++
+}
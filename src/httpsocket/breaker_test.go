@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestBreaker(halfOpenRequests int) *CircuitBreaker {
+	policy := &BreakerPolicy{
+		Window:           10 * time.Second,
+		MinRequests:      2,
+		ErrorRatePercent: 50,
+		OpenDuration:     time.Second,
+		HalfOpenRequests: halfOpenRequests,
+	}
+	now := time.Unix(1000, 0)
+	return &CircuitBreaker{name: "test", policy: policy, state: BreakerClosed, windowStart: now, lastChange: now}
+}
+
+// Разомкнуть выключатель двумя неудачами и дождаться half-open
+func tripBreaker(t *testing.T, cb *CircuitBreaker, now time.Time) time.Time {
+	for i := 0; i < 2; i++ {
+		ticket, _ := cb.Allow(now)
+		if ticket == nil {
+			t.Fatal("closed breaker refused a request")
+		}
+		cb.Record(ticket, now, true, time.Millisecond)
+	}
+	if cb.state != BreakerOpen {
+		t.Fatalf("expected open, got %s", cb.state)
+	}
+	if ticket, retryAfter := cb.Allow(now); ticket != nil || retryAfter != time.Second {
+		t.Fatalf("open breaker: got ticket %v, retry after %s", ticket, retryAfter)
+	}
+	return now.Add(time.Second)
+}
+
+func TestBreakerIgnoresStaleResults(t *testing.T) {
+	cb := newTestBreaker(1)
+	now := time.Unix(1000, 0)
+	stale, _ := cb.Allow(now) // медленный запрос, начавшийся до размыкания
+	now = tripBreaker(t, cb, now)
+
+	probe, _ := cb.Allow(now)
+	if probe == nil || cb.state != BreakerHalfOpen {
+		t.Fatalf("expected a probe in half-open, got %v in %s", probe, cb.state)
+	}
+	cb.Record(stale, now, false, time.Millisecond)
+	if cb.state != BreakerHalfOpen {
+		t.Fatalf("stale success changed state to %s", cb.state)
+	}
+	cb.Record(probe, now, true, time.Millisecond)
+	if cb.state != BreakerOpen {
+		t.Fatalf("failed probe should open the breaker, got %s", cb.state)
+	}
+}
+
+func TestBreakerNeedsAllProbesToClose(t *testing.T) {
+	cb := newTestBreaker(2)
+	now := tripBreaker(t, cb, time.Unix(1000, 0))
+
+	p1, _ := cb.Allow(now)
+	p2, _ := cb.Allow(now)
+	if p1 == nil || p2 == nil {
+		t.Fatal("expected two probes")
+	}
+	if p3, _ := cb.Allow(now); p3 != nil {
+		t.Fatal("third probe should be refused")
+	}
+	cb.Record(p1, now, false, time.Millisecond)
+	if cb.state != BreakerHalfOpen {
+		t.Fatalf("one success out of two probes closed the breaker: %s", cb.state)
+	}
+	cb.Record(p2, now, false, time.Millisecond)
+	if cb.state != BreakerClosed {
+		t.Fatalf("expected closed, got %s", cb.state)
+	}
+}
+
+func TestBreakerCanceledProbe(t *testing.T) {
+	cb := newTestBreaker(1)
+	now := tripBreaker(t, cb, time.Unix(1000, 0))
+
+	probe, _ := cb.Allow(now)
+	cb.Cancel(probe)
+	if cb.state != BreakerHalfOpen {
+		t.Fatalf("canceled probe changed state to %s", cb.state)
+	}
+	probe, _ = cb.Allow(now)
+	if probe == nil {
+		t.Fatal("canceled probe should free its slot")
+	}
+	cb.Record(probe, now, false, time.Millisecond)
+	if cb.state != BreakerClosed {
+		t.Fatalf("expected closed, got %s", cb.state)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Общий для всех клиентов кеш ответов на GET-запросы.
+//
+// Кеш ограничен по суммарному размеру и вытесняет давно не использовавшиеся ответы (LRU).
+// Срок свежести ответа берется из Cache-Control (s-maxage, max-age) или Expires апстрима;
+// ответы с Cache-Control: no-store / private, с Set-Cookie или с Vary: * не кешируются.
+// Устаревший ответ с ETag или Last-Modified перепроверяется условным запросом к апстриму
+// (If-None-Match / If-Modified-Since); на 304 клиент получает сохраненный ответ.
+//
+// Запросы с заголовками Authorization или Cookie, а также условные запросы клиента
+// идут мимо кеша.
+//
+// Поле cache ответа: hit - ответ из кеша без обращения к апстриму, revalidated - ответ из кеша,
+// подтвержденный апстримом, miss - ответ апстрима.
+
+const (
+	CacheHit         = "hit"
+	CacheMiss        = "miss"
+	CacheRevalidated = "revalidated"
+)
+
+// Сохраненный ответ
+type cacheEntry struct {
+	key     string
+	baseKey string // ключ без учета Vary
+	resp    *UpstreamResponse
+	expires time.Time // до какого момента ответ свеж
+	size    int64
+}
+
+type ResponseCache struct {
+	maxBytes      int64
+	maxEntryBytes int64
+
+	lock    sync.Mutex
+	size    int64
+	lru     *list.List               // элементы - *cacheEntry, в начале - недавно использованные
+	entries map[string]*list.Element // ключ с учетом Vary -> элемент lru
+	varies  map[string]*cacheVary    // ключ без учета Vary -> Vary его ответов
+}
+
+// Vary ответов на запросы с одним ключом без учета Vary
+type cacheVary struct {
+	names   []string // имена заголовков из Vary последнего сохраненного ответа
+	entries int      // сколько вариантов ответа сохранено; при 0 запись удаляется
+}
+
+// Создать кеш; возвращает nil, если maxBytes <= 0 (кеш выключен)
+func NewResponseCache(maxBytes int64, maxEntryBytes int64) *ResponseCache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	return &ResponseCache{
+		maxBytes:      maxBytes,
+		maxEntryBytes: maxEntryBytes,
+		lru:           list.New(),
+		entries:       map[string]*list.Element{},
+		varies:        map[string]*cacheVary{},
+	}
+}
+
+// Можно ли обслужить запрос из кеша?
+func IsCacheableRequest(httpRq *http.Request) bool {
+	if httpRq.Method != "GET" {
+		return false
+	}
+	h := httpRq.Header
+	if h.Get("Authorization") != "" || h.Get("Cookie") != "" {
+		return false
+	}
+	if h.Get("If-None-Match") != "" || h.Get("If-Modified-Since") != "" {
+		return false // клиент сам управляет перепроверкой
+	}
+	cc := parseCacheControl(h.Get("Cache-Control"))
+	if _, ok := cc["no-cache"]; ok {
+		return false
+	}
+	if _, ok := cc["no-store"]; ok {
+		return false
+	}
+	return true
+}
+
+// Ключ с учетом заголовков запроса, перечисленных в varyNames
+func cacheVariantKey(baseKey string, varyNames []string, h http.Header) string {
+	if len(varyNames) == 0 {
+		return baseKey
+	}
+	parts := []string{baseKey}
+	for _, name := range varyNames {
+		parts = append(parts, name+": "+strings.Join(h[name], ","))
+	}
+	return strings.Join(parts, "\n")
+}
+
+// Найти сохраненный ответ для запроса; fresh - можно ли отдать его без перепроверки
+func (rc *ResponseCache) Get(baseKey string, h http.Header, now time.Time) (resp *UpstreamResponse, fresh bool) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	vary, ok := rc.varies[baseKey]
+	if !ok {
+		return nil, false
+	}
+	el, ok := rc.entries[cacheVariantKey(baseKey, vary.names, h)]
+	if !ok {
+		return nil, false
+	}
+	rc.lru.MoveToFront(el)
+	entry := el.Value.(*cacheEntry)
+	return entry.resp, now.Before(entry.expires)
+}
+
+// Сохранить ответ на запрос с заголовками h, если ответ можно кешировать
+func (rc *ResponseCache) Put(baseKey string, h http.Header, resp *UpstreamResponse, now time.Time) {
+	ttl, ok := cacheFreshness(resp, now)
+	if !ok {
+		return
+	}
+	varyNames := parseVary(resp.Header)
+	for _, name := range varyNames {
+		if name == "*" {
+			return
+		}
+	}
+	entry := &cacheEntry{
+		baseKey: baseKey,
+		resp:    resp,
+		expires: now.Add(ttl),
+		size:    resp.Size(),
+	}
+	if entry.size > rc.maxEntryBytes {
+		return
+	}
+
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	entry.key = cacheVariantKey(baseKey, varyNames, h)
+	if el, ok := rc.entries[entry.key]; ok {
+		rc.remove(el)
+	}
+	vary, ok := rc.varies[baseKey]
+	if !ok {
+		vary = &cacheVary{}
+		rc.varies[baseKey] = vary
+	}
+	vary.names = varyNames
+	vary.entries++
+	rc.entries[entry.key] = rc.lru.PushFront(entry)
+	rc.size += entry.size
+	for rc.size > rc.maxBytes {
+		rc.remove(rc.lru.Back())
+	}
+}
+
+func (rc *ResponseCache) remove(el *list.Element) {
+	entry := rc.lru.Remove(el).(*cacheEntry)
+	delete(rc.entries, entry.key)
+	rc.size -= entry.size
+	if vary := rc.varies[entry.baseKey]; vary != nil {
+		vary.entries--
+		if vary.entries <= 0 {
+			delete(rc.varies, entry.baseKey)
+		}
+	}
+}
+
+// Обновить сохраненный ответ по ответу 304 Not Modified
+func (rc *ResponseCache) Revalidate(baseKey string, h http.Header, stored *UpstreamResponse, notModified *UpstreamResponse, now time.Time) *UpstreamResponse {
+	updated := &UpstreamResponse{
+		StatusCode: stored.StatusCode,
+		Header:     stored.Header.Clone(),
+		Body:       stored.Body,
+	}
+	// RFC 7234, 4.3.4: заголовки из 304 заменяют сохраненные
+	for name, values := range notModified.Header {
+		if name == "Content-Length" {
+			continue
+		}
+		updated.Header[name] = values
+	}
+	rc.Put(baseKey, h, updated, now)
+	return updated
+}
+
+// Срок свежести ответа; ok = false, если ответ нельзя сохранять
+func cacheFreshness(resp *UpstreamResponse, now time.Time) (time.Duration, bool) {
+	switch resp.StatusCode {
+	case 200, 203, 300, 301, 404, 410:
+	default:
+		return 0, false
+	}
+	if len(resp.Header["Set-Cookie"]) > 0 {
+		return 0, false
+	}
+	cc := parseCacheControl(resp.Header.Get("Cache-Control"))
+	if _, ok := cc["no-store"]; ok {
+		return 0, false
+	}
+	if _, ok := cc["private"]; ok {
+		return 0, false
+	}
+	validatable := resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+	if _, ok := cc["no-cache"]; ok {
+		return 0, validatable
+	}
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[directive]; ok {
+			seconds, err := strconv.Atoi(v)
+			if err != nil || seconds < 0 {
+				return 0, validatable
+			}
+			return time.Duration(seconds) * time.Second, seconds > 0 || validatable
+		}
+	}
+	if expires := resp.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0, validatable // некорректный Expires означает "уже устарел"
+		}
+		date := now
+		if d, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+			date = d
+		}
+		if ttl := t.Sub(date); ttl > 0 {
+			return ttl, true
+		}
+		return 0, validatable
+	}
+	// срок свежести не указан: храним только для перепроверки
+	return 0, validatable
+}
+
+// Разобрать Cache-Control в словарь директива -> значение
+func parseCacheControl(value string) map[string]string {
+	result := map[string]string{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		name := strings.ToLower(strings.TrimSpace(kv[0]))
+		if len(kv) == 2 {
+			result[name] = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+		} else {
+			result[name] = ""
+		}
+	}
+	return result
+}
+
+// Имена заголовков из Vary в каноническом виде
+func parseVary(h http.Header) []string {
+	names := []string{}
+	for _, value := range h["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return []string{"*"}
+			}
+			if name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Добавить к запросу заголовки для перепроверки сохраненного ответа.
+// Возвращает false, если перепроверить ответ нельзя.
+func addValidators(httpRq *http.Request, stored *UpstreamResponse) bool {
+	etag := stored.Header.Get("ETag")
+	lastModified := stored.Header.Get("Last-Modified")
+	if etag != "" {
+		httpRq.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		httpRq.Header.Set("If-Modified-Since", lastModified)
+	}
+	return etag != "" || lastModified != ""
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func cacheableResponse(body string, vary string) *UpstreamResponse {
+	h := http.Header{}
+	h.Set("Cache-Control", "max-age=60")
+	if vary != "" {
+		h.Set("Vary", vary)
+	}
+	return &UpstreamResponse{StatusCode: 200, Header: h, Body: []byte(body)}
+}
+
+func TestResponseCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	now := time.Unix(1000, 0)
+	entrySize := cacheableResponse("0123456789", "").Size()
+	rc := NewResponseCache(3*entrySize, entrySize)
+
+	for i := 0; i < 3; i++ {
+		rc.Put(fmt.Sprintf("/%d", i), http.Header{}, cacheableResponse("0123456789", ""), now)
+	}
+	if resp, _ := rc.Get("/0", http.Header{}, now); resp == nil {
+		t.Fatal("/0 should be cached")
+	}
+	rc.Put("/3", http.Header{}, cacheableResponse("0123456789", ""), now)
+
+	if resp, _ := rc.Get("/1", http.Header{}, now); resp != nil {
+		t.Error("/1 was used least recently and should have been evicted")
+	}
+	for _, key := range []string{"/0", "/2", "/3"} {
+		if resp, fresh := rc.Get(key, http.Header{}, now); resp == nil || !fresh {
+			t.Errorf("%s should be cached and fresh", key)
+		}
+	}
+	if rc.size > rc.maxBytes {
+		t.Errorf("cache size %d exceeds limit %d", rc.size, rc.maxBytes)
+	}
+	if resp, fresh := rc.Get("/0", http.Header{}, now.Add(time.Minute)); resp == nil || fresh {
+		t.Error("/0 should be stale after max-age")
+	}
+}
+
+func TestResponseCacheRejectsLargeEntries(t *testing.T) {
+	rc := NewResponseCache(1000, 10)
+	rc.Put("/big", http.Header{}, cacheableResponse("0123456789abcdef", ""), time.Unix(1000, 0))
+	if len(rc.entries) != 0 || len(rc.varies) != 0 {
+		t.Fatal("entry larger than maxEntryBytes should not be stored")
+	}
+}
+
+func TestResponseCacheVary(t *testing.T) {
+	now := time.Unix(1000, 0)
+	rc := NewResponseCache(10000, 1000)
+	en := http.Header{"Accept-Language": {"en"}}
+	ru := http.Header{"Accept-Language": {"ru"}}
+
+	rc.Put("/page", en, cacheableResponse("hello", "Accept-Language"), now)
+	rc.Put("/page", ru, cacheableResponse("привет", "Accept-Language"), now)
+
+	if resp, _ := rc.Get("/page", en, now); resp == nil || string(resp.Body) != "hello" {
+		t.Errorf("en variant: got %v", resp)
+	}
+	if resp, _ := rc.Get("/page", ru, now); resp == nil || string(resp.Body) != "привет" {
+		t.Errorf("ru variant: got %v", resp)
+	}
+	if resp, _ := rc.Get("/page", http.Header{"Accept-Language": {"de"}}, now); resp != nil {
+		t.Errorf("de variant should not be cached, got %q", resp.Body)
+	}
+
+	rc.Put("/star", en, cacheableResponse("x", "*"), now)
+	if resp, _ := rc.Get("/star", en, now); resp != nil {
+		t.Error("responses with Vary: * should not be cached")
+	}
+}
+
+func TestResponseCacheVaryIsBounded(t *testing.T) {
+	now := time.Unix(1000, 0)
+	entrySize := cacheableResponse("0123456789", "Accept").Size()
+	rc := NewResponseCache(8*entrySize, entrySize)
+
+	for i := 0; i < 1000; i++ {
+		rc.Put(fmt.Sprintf("/%d", i), http.Header{}, cacheableResponse("0123456789", "Accept"), now)
+	}
+	if len(rc.entries) != 8 {
+		t.Fatalf("expected 8 entries, got %d", len(rc.entries))
+	}
+	if len(rc.varies) != len(rc.entries) {
+		t.Fatalf("varies should only cover cached keys: %d varies for %d entries", len(rc.varies), len(rc.entries))
+	}
+
+	// второй вариант того же ключа держит запись varies, пока вытеснен только первый
+	rc = NewResponseCache(2*entrySize, entrySize)
+	rc.Put("/a", http.Header{"Accept": {"x"}}, cacheableResponse("0123456789", "Accept"), now)
+	rc.Put("/a", http.Header{"Accept": {"y"}}, cacheableResponse("0123456789", "Accept"), now)
+	rc.Put("/b", http.Header{}, cacheableResponse("0123456789", "Accept"), now)
+	if resp, _ := rc.Get("/a", http.Header{"Accept": {"y"}}, now); resp == nil {
+		t.Fatal("second variant of /a should still be cached")
+	}
+	rc.Put("/c", http.Header{}, cacheableResponse("0123456789", "Accept"), now)
+	rc.Put("/d", http.Header{}, cacheableResponse("0123456789", "Accept"), now)
+	if _, ok := rc.varies["/a"]; ok {
+		t.Error("varies entry of /a should be deleted with its last variant")
+	}
+}
+
+func TestCacheFreshness(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cases := []struct {
+		status  int
+		headers map[string]string
+		ttl     time.Duration
+		ok      bool
+	}{
+		{200, map[string]string{"Cache-Control": "max-age=30"}, 30 * time.Second, true},
+		{200, map[string]string{"Cache-Control": "max-age=30, s-maxage=10"}, 10 * time.Second, true},
+		{200, map[string]string{"Cache-Control": "private, max-age=30"}, 0, false},
+		{200, map[string]string{"Cache-Control": "no-store"}, 0, false},
+		{200, map[string]string{"Cache-Control": "max-age=30", "Set-Cookie": "a=b"}, 0, false},
+		{200, map[string]string{"Cache-Control": "no-cache", "ETag": `"x"`}, 0, true},
+		{200, map[string]string{}, 0, false},
+		{200, map[string]string{"Last-Modified": "Mon, 02 Jan 2006 15:04:05 GMT"}, 0, true},
+		{500, map[string]string{"Cache-Control": "max-age=30"}, 0, false},
+	}
+	for i, c := range cases {
+		h := http.Header{}
+		for name, value := range c.headers {
+			h.Set(name, value)
+		}
+		ttl, ok := cacheFreshness(&UpstreamResponse{StatusCode: c.status, Header: h}, now)
+		if ttl != c.ttl || ok != c.ok {
+			t.Errorf("case %d: got %s, %v; expected %s, %v", i, ttl, ok, c.ttl, c.ok)
+		}
+	}
+}
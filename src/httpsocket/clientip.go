@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Определение настоящего адреса клиента за доверенными прокси (например, nginx).
+//
+// Если соединение пришло с адреса из ProxyParams.TrustedProxies, адрес клиента берется из
+// заголовка Forwarded (RFC 7239), X-Forwarded-For или X-Real-IP (в таком порядке): цепочка
+// адресов просматривается справа налево, и адресом клиента считается первый адрес не из
+// доверенных сетей. Цепочка обрывается на первом (справа) элементе, который не является
+// IP-адресом: он и все левее него отбрасываются. Протокол берется из Forwarded (proto=)
+// или X-Forwarded-Proto.
+// Если соединение пришло не от доверенного прокси, эти заголовки игнорируются.
+//
+// Апстрим получает X-Real-IP с адресом клиента, X-Forwarded-For с цепочкой адресов,
+// дополненной адресом, с которого пришло соединение, и X-Forwarded-Proto.
+//
+// Менять адрес клиента методом httpsocket.setxrealip могут только аутентифицированные
+// клиенты (см. auth.go) и клиенты, подключившиеся с доверенных адресов.
+
+// Адрес клиента, определенный по запросу на открытие соединения
+type ClientAddress struct {
+	Ip           string // адрес клиента
+	ForwardedFor string // значение X-Forwarded-For для апстрима
+	Proto        string // http или https, протокол, по которому клиент обратился к нам или к прокси
+	Trusted      bool   // соединение пришло от доверенного прокси
+}
+
+// Разобрать список сетей через запятую; отдельный адрес означает сеть из одного адреса
+func ParseCidrList(s string) ([]*net.IPNet, error) {
+	result := []*net.IPNet{}
+	for _, item := range SplitCommaList(s) {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("malformed IP address %q", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("malformed network %q", item)
+		}
+		result = append(result, network)
+	}
+	return result, nil
+}
+
+// Входит ли адрес ip в доверенные сети?
+func (p *ProxyParams) IsTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range p.TrustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Определить адрес клиента по запросу r
+func (p *ProxyParams) ResolveClientAddress(r *http.Request) ClientAddress {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	addr := ClientAddress{Ip: peer, ForwardedFor: peer, Proto: "http"}
+	if r.TLS != nil {
+		addr.Proto = "https"
+	}
+	if !p.IsTrustedProxy(peer) {
+		return addr
+	}
+	addr.Trusted = true
+
+	chain, proto := parseForwarded(r.Header.Values("Forwarded"))
+	if len(chain) == 0 {
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			chain = append(chain, SplitCommaList(value)...)
+		}
+	}
+	if len(chain) == 0 {
+		if realIp := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIp != "" {
+			chain = []string{realIp}
+		}
+	}
+	if proto == "" {
+		proto = strings.ToLower(strings.TrimSpace(r.Header.Get("X-Forwarded-Proto")))
+	}
+	if proto == "http" || proto == "https" {
+		addr.Proto = proto
+	}
+	chain = validForwardedChain(chain)
+	if len(chain) == 0 {
+		return addr
+	}
+
+	// справа налево: первый адрес не из доверенных сетей и есть клиент
+	addr.Ip = chain[0]
+	for i := len(chain) - 1; i >= 0; i-- {
+		if !p.IsTrustedProxy(chain[i]) {
+			addr.Ip = chain[i]
+			break
+		}
+	}
+	addr.ForwardedFor = strings.Join(append(chain, peer), ", ")
+	return addr
+}
+
+// Правая часть цепочки адресов до первого (справа) элемента, не являющегося IP-адресом;
+// адреса приводятся к каноническому виду
+func validForwardedChain(chain []string) []string {
+	valid := []string{}
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := net.ParseIP(chain[i])
+		if ip == nil {
+			break
+		}
+		valid = append([]string{ip.String()}, valid...)
+	}
+	return valid
+}
+
+// Разобрать заголовки Forwarded: адреса из for= и протокол из первого proto=
+func parseForwarded(values []string) (chain []string, proto string) {
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 {
+					continue
+				}
+				v := strings.Trim(strings.TrimSpace(kv[1]), `"`)
+				switch strings.ToLower(kv[0]) {
+				case "for":
+					chain = append(chain, forwardedNodeIp(v))
+				case "proto":
+					if proto == "" {
+						proto = strings.ToLower(v)
+					}
+				}
+			}
+		}
+	}
+	return chain, proto
+}
+
+// Адрес из элемента for= заголовка Forwarded: "192.0.2.1", "192.0.2.1:4711", "[2001:db8::1]:4711"
+func forwardedNodeIp(node string) string {
+	if strings.HasPrefix(node, "[") {
+		if i := strings.Index(node, "]"); i > 0 {
+			return node[1:i]
+		}
+		return node
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return node
+}
+
+// Адрес клиента и цепочка X-Forwarded-For для запросов к апстриму
+func (c *ProxyClient) clientAddress() (string, string) {
+	c.sessionLock.Lock()
+	defer c.sessionLock.Unlock()
+	return c.xRealIp, c.forwardedFor
+}
+
+// Может ли клиент менять свой адрес (httpsocket.setxrealip)?
+func (c *ProxyClient) mayChangeClientIp() bool {
+	return c.identity != nil || c.address.Trusted
+}
+
+// Сменить адрес клиента
+func (c *ProxyClient) setClientIp(ip string) {
+	c.sessionLock.Lock()
+	defer c.sessionLock.Unlock()
+	c.xRealIp = ip
+	c.forwardedFor = ip + ", " + c.address.ForwardedFor
+}
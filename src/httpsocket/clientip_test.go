@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseCidrList(t *testing.T) {
+	networks, err := ParseCidrList("10.0.0.0/8, 192.168.1.1, ::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &ProxyParams{TrustedProxies: networks}
+	for ip, trusted := range map[string]bool{
+		"10.1.2.3":    true,
+		"192.168.1.1": true,
+		"192.168.1.2": false,
+		"::1":         true,
+		"11.0.0.1":    false,
+		"junk":        false,
+	} {
+		if p.IsTrustedProxy(ip) != trusted {
+			t.Errorf("IsTrustedProxy(%s) != %v", ip, trusted)
+		}
+	}
+	for _, bad := range []string{"10.0.0.0/33", "example.com", "1.2.3"} {
+		if _, err := ParseCidrList(bad); err == nil {
+			t.Errorf("%q should not parse", bad)
+		}
+	}
+}
+
+func TestResolveClientAddress(t *testing.T) {
+	networks, _ := ParseCidrList("10.0.0.0/8")
+	p := &ProxyParams{TrustedProxies: networks}
+
+	cases := []struct {
+		name         string
+		remoteAddr   string
+		headers      map[string]string
+		ip           string
+		forwardedFor string
+		proto        string
+	}{
+		{"untrusted peer", "1.2.3.4:5000", map[string]string{"X-Forwarded-For": "5.6.7.8"}, "1.2.3.4", "1.2.3.4", "http"},
+		{"x-forwarded-for", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "5.6.7.8, 10.0.0.2", "X-Forwarded-Proto": "https"}, "5.6.7.8", "5.6.7.8, 10.0.0.2, 10.0.0.1", "https"},
+		{"spoofed left part", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "9.9.9.9, 5.6.7.8"}, "5.6.7.8", "9.9.9.9, 5.6.7.8, 10.0.0.1", "http"},
+		{"forwarded", "10.0.0.1:5000", map[string]string{"Forwarded": `for="[2001:db8::1]:4711";proto=https, for=10.0.0.3`}, "2001:db8::1", "2001:db8::1, 10.0.0.3, 10.0.0.1", "https"},
+		{"x-real-ip", "10.0.0.1:5000", map[string]string{"X-Real-IP": "5.6.7.8"}, "5.6.7.8", "5.6.7.8, 10.0.0.1", "http"},
+		{"junk hop", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "5.6.7.8, <script>, 10.0.0.2"}, "10.0.0.2", "10.0.0.2, 10.0.0.1", "http"},
+		{"junk only", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "evil\"value"}, "10.0.0.1", "10.0.0.1", "http"},
+		{"junk real ip", "10.0.0.1:5000", map[string]string{"X-Real-IP": "not-an-ip"}, "10.0.0.1", "10.0.0.1", "http"},
+	}
+	for _, c := range cases {
+		r, _ := http.NewRequest("GET", "http://proxy/ws", nil)
+		r.RemoteAddr = c.remoteAddr
+		for name, value := range c.headers {
+			r.Header.Set(name, value)
+		}
+		addr := p.ResolveClientAddress(r)
+		if addr.Ip != c.ip || addr.ForwardedFor != c.forwardedFor || addr.Proto != c.proto {
+			t.Errorf("%s: got %+v", c.name, addr)
+		}
+	}
+}
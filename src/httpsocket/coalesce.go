@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Объединение одинаковых одновременных GET-запросов (single-flight).
+//
+// Когда множество клиентов одновременно запрашивают один и тот же адрес (например, после
+// push-уведомления), в апстрим уходит только один запрос, а его ответ получают все
+// дождавшиеся клиенты (каждый - со своим id). Одинаковыми считаются GET-запросы к одному
+// апстриму и пути с одинаковыми значимыми заголовками (все, кроме X-Request-ID, который
+// у каждого запроса свой).
+//
+// По умолчанию адрес клиента (X-Real-IP, X-Forwarded-For) тоже входит в ключ, так что
+// объединяются только запросы с одного адреса: апстрим может отвечать по-разному в
+// зависимости от IP (геолокация, ограничения на адрес). Если ответы апстрима от адреса не
+// зависят, в маршруте можно указать "coalesce_across_ips": true - тогда запросы разных
+// клиентов объединяются, и все они получают ответ, полученный для адреса первого из них.
+//
+// Общий запрос выполняется с таймаутом первого клиента и не зависит от его соединения:
+// если первый клиент ушел, остальные продолжают ждать ответа. Запрос отменяется, только
+// если не осталось ни одного ожидающего клиента.
+//
+// Объединение включается глобально флагом -coalesce-get-requests и может быть включено
+// или выключено для отдельного маршрута полем "coalesce".
+
+// Заголовки запроса, не влияющие на ответ апстрима
+var coalesceIgnoredHeaders = map[string]bool{
+	"X-Request-Id": true,
+}
+
+// Заголовки с адресом клиента, не входящие в ключ при "coalesce_across_ips"
+var coalesceClientIpHeaders = map[string]bool{
+	"X-Forwarded-For": true,
+	"X-Real-Ip":       true,
+}
+
+// Выполняющийся общий запрос
+type coalescedCall struct {
+	done    chan struct{}
+	result  *upstreamResult
+	waiters int
+	cancel  context.CancelFunc
+}
+
+type RequestCoalescer struct {
+	lock  sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+var (
+	coalescedRequests = &RequestCoalescer{calls: map[string]*coalescedCall{}}
+)
+
+// Нужно ли объединять GET-запросы, пришедшие по маршруту route (nil - запрос с указанием хоста)?
+func (p *ProxyParams) ShouldCoalesce(route *Route) bool {
+	if route != nil && route.Upstream.CookieJar {
+		return false // у каждого клиента свои куки
+	}
+	if route != nil && route.Coalesce != nil {
+		return *route.Coalesce
+	}
+	return p.CoalesceGetRequests
+}
+
+// Объединять ли запросы клиентов с разными адресами, пришедшие по маршруту route?
+func coalesceAcrossIps(route *Route) bool {
+	return route != nil && route.CoalesceAcrossIps
+}
+
+// Ключ для объединения запросов; acrossIps - не учитывать адрес клиента
+func coalesceKey(baseKey string, httpRq *http.Request, acrossIps bool) string {
+	names := make([]string, 0, len(httpRq.Header))
+	for name := range httpRq.Header {
+		if !coalesceIgnoredHeaders[name] && !(acrossIps && coalesceClientIpHeaders[name]) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	parts := []string{httpRq.Method + " " + baseKey}
+	for _, name := range names {
+		parts = append(parts, name+": "+strings.Join(httpRq.Header[name], ","))
+	}
+	return strings.Join(parts, "\n")
+}
+
+// Выполнить fetch или присоединиться к уже выполняющемуся запросу с тем же ключом.
+// shared = true, если запрос присоединился к чужому.
+func (rc *RequestCoalescer) Do(ctx context.Context, key string, timeout time.Duration, fetch func(context.Context) *upstreamResult) (result *upstreamResult, shared bool) {
+	rc.lock.Lock()
+	call, shared := rc.calls[key]
+	if !shared {
+		callCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		call = &coalescedCall{done: make(chan struct{}), cancel: cancel}
+		rc.calls[key] = call
+		go rc.run(callCtx, key, call, fetch)
+	}
+	call.waiters++
+	rc.lock.Unlock()
+
+	select {
+	case <-call.done:
+		return call.result, shared
+	case <-ctx.Done():
+		rc.lock.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			// ответа больше никто не ждет
+			call.cancel()
+			if rc.calls[key] == call {
+				delete(rc.calls, key)
+			}
+		}
+		rc.lock.Unlock()
+		errCode, errMessage := upstreamError(ctx, ctx.Err())
+		return &upstreamResult{errCode: errCode, errMessage: errMessage}, shared
+	}
+}
+
+func (rc *RequestCoalescer) run(ctx context.Context, key string, call *coalescedCall, fetch func(context.Context) *upstreamResult) {
+	defer func() {
+		if x := recover(); x != nil {
+			logPanic(x)
+			call.result = &upstreamResult{errCode: ErrCodeInternalError, errMessage: "internal error"}
+		}
+		rc.lock.Lock()
+		if rc.calls[key] == call {
+			delete(rc.calls, key)
+		}
+		rc.lock.Unlock()
+		call.cancel()
+		close(call.done)
+	}()
+	call.result = fetch(ctx)
+}
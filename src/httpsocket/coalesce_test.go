@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalesceKey(t *testing.T) {
+	makeRq := func(ip string, requestId string, accept string) *http.Request {
+		rq, _ := http.NewRequest("GET", "http://up.lan/a", nil)
+		rq.Header.Set("X-Real-IP", ip)
+		rq.Header.Set("X-Forwarded-For", ip)
+		rq.Header.Set("X-Request-ID", requestId)
+		rq.Header.Set("Accept", accept)
+		return rq
+	}
+	a := makeRq("10.0.0.1", "1", "application/json")
+	sameIp := makeRq("10.0.0.1", "2", "application/json")
+	otherIp := makeRq("10.0.0.2", "3", "application/json")
+	otherAccept := makeRq("10.0.0.1", "4", "text/html")
+
+	key := func(rq *http.Request, acrossIps bool) string { return coalesceKey("up.lan/a", rq, acrossIps) }
+	if key(a, false) != key(sameIp, false) {
+		t.Error("requests differing only in X-Request-ID should share a key")
+	}
+	if key(a, false) == key(otherIp, false) {
+		t.Error("requests from different IPs should not share a key by default")
+	}
+	if key(a, true) != key(otherIp, true) {
+		t.Error("requests from different IPs should share a key with coalesce_across_ips")
+	}
+	if key(a, true) == key(otherAccept, true) {
+		t.Error("requests with different headers should not share a key")
+	}
+}
+
+func TestRequestCoalescerSharesOneFetch(t *testing.T) {
+	rc := &RequestCoalescer{calls: map[string]*coalescedCall{}}
+	var fetches int32
+	release := make(chan struct{})
+	fetch := func(ctx context.Context) *upstreamResult {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		return &upstreamResult{resp: &UpstreamResponse{StatusCode: 200}}
+	}
+
+	var wg sync.WaitGroup
+	var sharedCount int32
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, shared := rc.Do(context.Background(), "k", time.Second, fetch)
+			if result.resp == nil || result.resp.StatusCode != 200 {
+				t.Errorf("unexpected result %+v", result)
+			}
+			if shared {
+				atomic.AddInt32(&sharedCount, 1)
+			}
+		}()
+	}
+	// ждем, пока все присоединятся к первому запросу
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		rc.lock.Lock()
+		call := rc.calls["k"]
+		joined := call != nil && call.waiters == 5
+		rc.lock.Unlock()
+		if joined {
+			break
+		}
+	}
+	close(release)
+	wg.Wait()
+	if fetches != 1 || sharedCount != 4 {
+		t.Fatalf("expected 1 fetch shared by 4 requests, got %d fetches, %d shared", fetches, sharedCount)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Файл настроек и перезагрузка настроек на лету.
+//
+// Любой флаг можно задать в JSON-файле, указанном в -config; ключи - имена флагов:
+//
+//     {
+//         "throttle-rps": 1000,
+//         "retry-put-delete": true,
+//         "origin-whitelist": ["example.com", "*.example.com"],
+//         "routes": {"upstreams": [...], "routes": [...]},
+//         "upstream-rules": [{"name": "public-api", "hosts": ["*.example.com"]}]
+//     }
+//
+// Списки через запятую можно записывать массивами строк. Таблицу маршрутизации (routes) и
+// правила апстримов (upstream-rules) можно указать путем к файлу или прямо в файле настроек.
+//
+// Каждую настройку можно переопределить переменной окружения HTTPSOCKET_<ИМЯ_ФЛАГА>, где
+// дефисы заменены подчеркиваниями (например HTTPSOCKET_THROTTLE_RPS=1000). Приоритет:
+// значения по умолчанию < файл настроек < переменные окружения < флаги командной строки.
+//
+// По SIGHUP или запросу POST /admin/reload настройки перечитываются вместе с файлами, на
+// которые они ссылаются (маршруты, правила, секрет JWT, токены), и проверяются; если
+// ошибок нет, прокси атомарно переключается на новые параметры. Открытые соединения не
+// закрываются, их следующие запросы обрабатываются уже с новыми настройками. Изменения
+// записываются в лог. Настройки из restartOnlySettings применяются только при перезапуске.
+
+// Префикс переменных окружения, переопределяющих настройки
+const SettingsEnvPrefix = "HTTPSOCKET_"
+
+// Настройки, которые нельзя сменить без перезапуска
+var restartOnlySettings = map[string]bool{
+	"listen":             true,
+	"admin-listen":       true,
+	"config":             true,
+	"cache-size-mb":      true,
+	"cache-max-entry-kb": true,
+}
+
+// Значения всех настроек по именам флагов
+type Settings map[string]string
+
+// Собрать настройки из значений по умолчанию, файла configFile (если указан),
+// переменных окружения и флагов командной строки
+func LoadSettings(configFile string) (Settings, error) {
+	s := Settings{}
+	flag.VisitAll(func(f *flag.Flag) {
+		s[f.Name] = f.DefValue
+	})
+	if configFile != "" {
+		if err := s.loadFile(configFile); err != nil {
+			return nil, err
+		}
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if value, ok := os.LookupEnv(settingEnvName(f.Name)); ok {
+			s[f.Name] = value
+		}
+	})
+	flag.Visit(func(f *flag.Flag) {
+		s[f.Name] = f.Value.String()
+	})
+	return s, nil
+}
+
+// Имя переменной окружения для настройки name
+func settingEnvName(name string) string {
+	return SettingsEnvPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+func (s Settings) loadFile(filename string) error {
+	bs, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	values := map[string]json.RawMessage{}
+	if err := json.Unmarshal(bs, &values); err != nil {
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+	for name, raw := range values {
+		if _, ok := s[name]; !ok || name == "config" {
+			return fmt.Errorf("%s: unknown setting %s", filename, name)
+		}
+		value, err := settingFromJson(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %s", filename, name, err)
+		}
+		s[name] = value
+	}
+	return nil
+}
+
+// Значение настройки из JSON: строки, числа и true/false - как есть, массив строк - через
+// запятую, объекты и массивы объектов - JSON-текстом (см. isInlineJson)
+func settingFromJson(raw json.RawMessage) (string, error) {
+	raw = bytes.TrimSpace(raw)
+	switch {
+	case len(raw) == 0 || string(raw) == "null":
+		return "", fmt.Errorf("value is required")
+	case raw[0] == '"':
+		var s string
+		err := json.Unmarshal(raw, &s)
+		return s, err
+	case raw[0] == '[':
+		var list []string
+		if err := json.Unmarshal(raw, &list); err == nil {
+			return strings.Join(list, ","), nil
+		}
+		fallthrough
+	case raw[0] == '{':
+		buf := &bytes.Buffer{}
+		if err := json.Compact(buf, raw); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+	return string(raw), nil
+}
+
+// Задан ли JSON прямо в значении настройки (а не путем к файлу)?
+func isInlineJson(value string) bool {
+	value = strings.TrimSpace(value)
+	return strings.HasPrefix(value, "{") || strings.HasPrefix(value, "[")
+}
+
+// Отличия от настроек s в настройках other, по одной строке "имя: старое -> новое"
+func (s Settings) Diff(other Settings) []string {
+	names := []string{}
+	for name := range other {
+		if s[name] != other[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	changes := make([]string, len(names))
+	for i, name := range names {
+		changes[i] = fmt.Sprintf("%s: %q -> %q", name, s[name], other[name])
+	}
+	return changes
+}
+
+// Чтение типизированных значений; запоминает первую ошибку
+type settingsReader struct {
+	s   Settings
+	err error
+}
+
+func (r *settingsReader) fail(name string, err error) {
+	if r.err == nil {
+		r.err = fmt.Errorf("-%s: %s", name, err)
+	}
+}
+
+func (r *settingsReader) String(name string) string {
+	return r.s[name]
+}
+
+func (r *settingsReader) Int(name string) int {
+	value, err := strconv.Atoi(strings.TrimSpace(r.s[name]))
+	if err != nil {
+		r.fail(name, fmt.Errorf("expected an integer, got %q", r.s[name]))
+	}
+	return value
+}
+
+func (r *settingsReader) Float(name string) float64 {
+	value, err := strconv.ParseFloat(strings.TrimSpace(r.s[name]), 64)
+	if err != nil {
+		r.fail(name, fmt.Errorf("expected a number, got %q", r.s[name]))
+	}
+	return value
+}
+
+func (r *settingsReader) Bool(name string) bool {
+	value, err := strconv.ParseBool(strings.TrimSpace(r.s[name]))
+	if err != nil {
+		r.fail(name, fmt.Errorf("expected true or false, got %q", r.s[name]))
+	}
+	return value
+}
+
+// Перечитать настройки и, если они корректны, переключиться на них.
+// Возвращает список изменений.
+func (p *WsProxy) Reload() ([]string, error) {
+	p.reloadLock.Lock()
+	defer p.reloadLock.Unlock()
+
+	settings, err := LoadSettings(p.configFile)
+	if err != nil {
+		return nil, err
+	}
+	params, err := NewProxyParams(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := accessLog.Configure(params.AccessLog); err != nil {
+		return nil, fmt.Errorf("-access-log: %s", err)
+	}
+
+	old := p.Params()
+	changes := p.settings.Diff(settings)
+	if sameJson(old.Routing, params.Routing) {
+		// сохраняем состояние пулов и проверок здоровья
+		params.Routing = old.Routing
+	} else {
+		changes = append(changes, "routing table changed")
+		params.Routing.StartHealthChecks()
+	}
+	if !sameJson(old.UpstreamRules, params.UpstreamRules) {
+		changes = append(changes, "upstream rules changed")
+	}
+
+	p.lock.Lock()
+	p.params = params
+	p.settings = settings
+	p.lock.Unlock()
+	logger.SetLevel(params.LogLevel)
+	logger.SetFormat(params.LogFormat)
+	setDialTimeout(params.Timeouts.Default)
+
+	if params.Routing != old.Routing {
+		old.Routing.StopHealthChecks()
+	}
+	for _, change := range changes {
+		name := strings.SplitN(change, ":", 2)[0]
+		if restartOnlySettings[name] {
+			logWarnf(Fields("setting", name), "config: %s (requires restart)", change)
+		} else {
+			logInfof(Fields("setting", name), "config: %s", change)
+		}
+	}
+	if len(changes) == 0 {
+		logInfof(nil, "config: reloaded, nothing changed")
+	}
+	return changes, nil
+}
+
+// Одинаковы ли a и b в JSON-представлении?
+func sameJson(a, b interface{}) bool {
+	return bytes.Equal(MustMarshalJson(a), MustMarshalJson(b))
+}
+
+// Перезагружать настройки по SIGHUP
+func (p *WsProxy) ReloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		logInfof(nil, "config: got SIGHUP, reloading")
+		if _, err := p.Reload(); err != nil {
+			logErrorf(nil, "config: reload failed, keeping current settings: %s", err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newReloadTestProxy(t *testing.T, config string) (*WsProxy, string) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	settings, err := LoadSettings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err := NewProxyParams(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	initHttpClient(params.Timeouts.Default)
+	return &WsProxy{params: params, settings: settings, configFile: path, limiters: NewLimiters(systemClock{})}, path
+}
+
+func TestReload(t *testing.T) {
+	p, path := newReloadTestProxy(t, `{"timeout-seconds": 60}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	err := ioutil.WriteFile(path, []byte(`{
+		"timeout-seconds": 5,
+		"throttle-rps": 100,
+		"origin-whitelist": ["example.com", "*.example.com"],
+		"cache-size-mb": 1
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := p.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]bool{
+		`cache-size-mb: "0" -> "1"`:                           true,
+		`origin-whitelist: "" -> "example.com,*.example.com"`: true,
+		`throttle-rps: "0" -> "100"`:                          true,
+		`timeout-seconds: "60" -> "5"`:                        true,
+	}
+	for _, change := range changes {
+		if !expected[change] {
+			t.Errorf("unexpected change %q", change)
+		}
+		delete(expected, change)
+	}
+	for change := range expected {
+		t.Errorf("missing change %q", change)
+	}
+
+	params := p.Params()
+	if params.Throttle.Global.Rps != 100 || len(params.Origins.Rules) != 2 {
+		t.Errorf("new settings not applied: %+v, %+v", params.Throttle.Global, params.Origins.Rules)
+	}
+	if params.Timeouts.Default != 5*time.Second || time.Duration(atomic.LoadInt64(&dialTimeout)) != 5*time.Second {
+		t.Errorf("timeout-seconds not applied: request timeout %s, dial timeout %s", params.Timeouts.Default, time.Duration(atomic.LoadInt64(&dialTimeout)))
+	}
+
+	// ошибочные настройки не применяются
+	if err := ioutil.WriteFile(path, []byte(`{"throttle-policy": "bogus"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Reload(); err == nil {
+		t.Error("invalid settings accepted")
+	}
+	if p.Params() != params {
+		t.Error("invalid settings replaced the parameters")
+	}
+}
+
+func TestLoadSettingsPriority(t *testing.T) {
+	_, path := newReloadTestProxy(t, `{"throttle-rps": 10, "throttle-burst": 20}`)
+	defer os.RemoveAll(filepath.Dir(path))
+	os.Setenv(settingEnvName("throttle-burst"), "30")
+	defer os.Unsetenv(settingEnvName("throttle-burst"))
+
+	settings, err := LoadSettings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings["throttle-rps"] != "10" || settings["throttle-burst"] != "30" || settings["throttle-policy"] != ThrottleBlock {
+		t.Errorf("unexpected settings: rps %q, burst %q, policy %q",
+			settings["throttle-rps"], settings["throttle-burst"], settings["throttle-policy"])
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"no-such-setting": 1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadSettings(path); err == nil {
+		t.Error("unknown setting accepted")
+	}
+}
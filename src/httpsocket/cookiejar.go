@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Хранилище кук соединения.
+//
+// Для апстримов с "cookie_jar": true в таблице маршрутизации прокси хранит куки, которые
+// апстрим выставил через Set-Cookie, и отправляет их в последующих запросах этого соединения
+// к тому же апстриму. Куки хранятся по имени апстрима, а не по хосту: экземпляры апстрима
+// взаимозаменяемы. Атрибут Domain игнорируется, Path, Expires / Max-Age и Secure учитываются.
+//
+// При первом обращении к апстриму хранилище заполняется куками из запроса на открытие
+// вебсокета, имена которых перечислены в ProxyParams.CookieJarSeedCookies.
+//
+// Служебные методы:
+//
+//     {"method": "httpsocket.getcookies", "id": 1}               // куки по апстримам
+//     {"method": "httpsocket.clearcookies", "params": "auth", "id": 2}  // забыть куки апстрима
+//     {"method": "httpsocket.clearcookies", "id": 3}             // забыть все куки
+//
+// Значения HttpOnly-кук клиенту не показываются.
+//
+// Запросы к апстримам с хранилищем кук не объединяются (см. coalesce.go): иначе клиенты
+// получили бы чужие куки.
+
+const (
+	MaxCookiesPerUpstream = 50
+	MaxCookieSize         = 4096
+)
+
+// Кука в хранилище
+type storedCookie struct {
+	cookie  *http.Cookie
+	expires time.Time // нулевое значение - до закрытия соединения
+}
+
+// Кука для httpsocket.getcookies
+type CookieInfo struct {
+	Name     string     `json:"name"`
+	Value    string     `json:"value,omitempty"`
+	Path     string     `json:"path"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	Secure   bool       `json:"secure,omitempty"`
+	HttpOnly bool       `json:"http_only,omitempty"`
+}
+
+// Куки соединения по именам апстримов
+type cookieJar struct {
+	lock       sync.Mutex
+	byUpstream map[string]map[string]*storedCookie // апстрим -> путь + имя -> кука
+	noSeed     bool                                // клиент очистил хранилище, куки из handshake больше не нужны
+}
+
+// Ключ куки внутри апстрима: куки с одним именем и разными путями различаются
+func cookieKey(c *http.Cookie) string {
+	return c.Path + "\x00" + c.Name
+}
+
+// Подходит ли имя куки под один из шаблонов (`*` в конце задает префикс; регистр учитывается)
+func cookieNameMatchesAny(name string, patterns []string) bool {
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "*") {
+			if strings.HasPrefix(name, p[:len(p)-1]) {
+				return true
+			}
+		} else if name == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Куки апстрима u; при первом обращении хранилище заполняется разрешенными куками из
+// запроса на открытие соединения. Вызывать под jar.lock.
+func (c *ProxyClient) upstreamCookies(u *Upstream) map[string]*storedCookie {
+	jar := &c.cookies
+	if jar.byUpstream == nil {
+		jar.byUpstream = map[string]map[string]*storedCookie{}
+	}
+	cookies, ok := jar.byUpstream[u.Name]
+	if !ok {
+		cookies = map[string]*storedCookie{}
+		if c.originalRequest != nil && !jar.noSeed {
+			for _, cookie := range c.originalRequest.Cookies() {
+				if cookieNameMatchesAny(cookie.Name, c.params().CookieJarSeedCookies) {
+					seeded := &http.Cookie{Name: cookie.Name, Value: cookie.Value, Path: "/"}
+					cookies[cookieKey(seeded)] = &storedCookie{cookie: seeded}
+				}
+			}
+		}
+		jar.byUpstream[u.Name] = cookies
+	}
+	return cookies
+}
+
+// Добавить к запросу апстриму u куки из хранилища
+func (c *ProxyClient) addJarCookies(u *Upstream, httpRq *http.Request) {
+	c.cookies.lock.Lock()
+	defer c.cookies.lock.Unlock()
+
+	now := time.Now()
+	cookies := c.upstreamCookies(u)
+	matching := []*http.Cookie{}
+	for key, sc := range cookies {
+		if !sc.expires.IsZero() && !now.Before(sc.expires) {
+			delete(cookies, key)
+			continue
+		}
+		if sc.cookie.Secure && httpRq.URL.Scheme != "https" {
+			continue
+		}
+		if !cookiePathMatches(sc.cookie.Path, httpRq.URL.Path) {
+			continue
+		}
+		matching = append(matching, sc.cookie)
+	}
+	if len(matching) == 0 {
+		return
+	}
+	// RFC 6265, 5.4: куки с более длинным путем идут первыми
+	sort.Slice(matching, func(i, j int) bool {
+		if len(matching[i].Path) != len(matching[j].Path) {
+			return len(matching[i].Path) > len(matching[j].Path)
+		}
+		return matching[i].Name < matching[j].Name
+	})
+	parts := make([]string, len(matching))
+	for i, cookie := range matching {
+		parts[i] = cookie.Name + "=" + cookie.Value
+	}
+	httpRq.Header.Set("Cookie", strings.Join(parts, "; "))
+}
+
+// Сохранить куки из Set-Cookie ответа апстрима u на запрос к пути requestPath
+func (c *ProxyClient) storeJarCookies(u *Upstream, requestPath string, h http.Header) {
+	if len(h["Set-Cookie"]) == 0 {
+		return
+	}
+	received := (&http.Response{Header: h}).Cookies()
+
+	c.cookies.lock.Lock()
+	defer c.cookies.lock.Unlock()
+
+	now := time.Now()
+	cookies := c.upstreamCookies(u)
+	for _, cookie := range received {
+		if len(cookie.Name)+len(cookie.Value) > MaxCookieSize {
+			continue
+		}
+		if cookie.Path == "" || cookie.Path[0] != '/' {
+			cookie.Path = defaultCookiePath(requestPath)
+		}
+		sc := &storedCookie{cookie: cookie}
+		switch {
+		case cookie.MaxAge < 0:
+			sc.expires = now // удалить
+		case cookie.MaxAge > 0:
+			sc.expires = now.Add(time.Duration(cookie.MaxAge) * time.Second)
+		case !cookie.Expires.IsZero():
+			sc.expires = cookie.Expires
+		}
+		key := cookieKey(cookie)
+		if !sc.expires.IsZero() && !now.Before(sc.expires) {
+			delete(cookies, key)
+			continue
+		}
+		if _, ok := cookies[key]; !ok && len(cookies) >= MaxCookiesPerUpstream {
+			c.LogWarnf("Cookie jar for upstream %s is full, dropping cookie %s", u.Name, cookie.Name)
+			continue
+		}
+		cookies[key] = sc
+	}
+}
+
+// Забыть куки апстрима с именем upstreamName (всех апстримов, если пусто)
+func (c *ProxyClient) clearJarCookies(upstreamName string) {
+	c.cookies.lock.Lock()
+	defer c.cookies.lock.Unlock()
+	if upstreamName == "" {
+		c.cookies.byUpstream = map[string]map[string]*storedCookie{}
+		c.cookies.noSeed = true
+		return
+	}
+	if c.cookies.byUpstream == nil {
+		c.cookies.byUpstream = map[string]map[string]*storedCookie{}
+	}
+	// пустое хранилище, а не отсутствующее: иначе оно снова заполнится куками из handshake
+	c.cookies.byUpstream[upstreamName] = map[string]*storedCookie{}
+}
+
+// Разобрать params метода httpsocket.clearcookies: имя апстрима или ничего
+func parseClearCookiesParams(params json.RawMessage) (string, error) {
+	if len(params) == 0 || string(params) == "null" {
+		return "", nil
+	}
+	var name string
+	if err := json.Unmarshal(params, &name); err != nil {
+		return "", fmt.Errorf("params must be an upstream name")
+	}
+	return name, nil
+}
+
+// Содержимое хранилища для httpsocket.getcookies
+func (c *ProxyClient) jarCookiesInfo() map[string][]CookieInfo {
+	c.cookies.lock.Lock()
+	defer c.cookies.lock.Unlock()
+
+	now := time.Now()
+	result := map[string][]CookieInfo{}
+	for upstreamName, cookies := range c.cookies.byUpstream {
+		infos := []CookieInfo{}
+		for _, sc := range cookies {
+			if !sc.expires.IsZero() && !now.Before(sc.expires) {
+				continue
+			}
+			info := CookieInfo{
+				Name:     sc.cookie.Name,
+				Path:     sc.cookie.Path,
+				Secure:   sc.cookie.Secure,
+				HttpOnly: sc.cookie.HttpOnly,
+			}
+			if !sc.cookie.HttpOnly {
+				info.Value = sc.cookie.Value
+			}
+			if !sc.expires.IsZero() {
+				expires := sc.expires
+				info.Expires = &expires
+			}
+			infos = append(infos, info)
+		}
+		sort.Slice(infos, func(i, j int) bool {
+			if infos[i].Path != infos[j].Path {
+				return infos[i].Path < infos[j].Path
+			}
+			return infos[i].Name < infos[j].Name
+		})
+		result[upstreamName] = infos
+	}
+	return result
+}
+
+// Путь куки по умолчанию (RFC 6265, 5.1.4)
+func defaultCookiePath(requestPath string) string {
+	i := strings.LastIndex(requestPath, "/")
+	if i <= 0 {
+		return "/"
+	}
+	return requestPath[:i]
+}
+
+// Подходит ли путь запроса requestPath под путь куки cookiePath (RFC 6265, 5.1.4)
+func cookiePathMatches(cookiePath, requestPath string) bool {
+	if requestPath == "" {
+		requestPath = "/"
+	}
+	if !strings.HasPrefix(requestPath, cookiePath) {
+		return false
+	}
+	return len(requestPath) == len(cookiePath) ||
+		strings.HasSuffix(cookiePath, "/") ||
+		requestPath[len(cookiePath)] == '/'
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestCookiePaths(t *testing.T) {
+	cases := []struct {
+		cookiePath, requestPath string
+		matches                 bool
+	}{
+		{"/", "/", true},
+		{"/", "", true},
+		{"/", "/a/b", true},
+		{"/a", "/a", true},
+		{"/a", "/a/b", true},
+		{"/a", "/ab", false},
+		{"/a/", "/a/b", true},
+		{"/a/b", "/a", false},
+	}
+	for _, c := range cases {
+		if matches := cookiePathMatches(c.cookiePath, c.requestPath); matches != c.matches {
+			t.Errorf("cookie path %q, request path %q: got %v", c.cookiePath, c.requestPath, matches)
+		}
+	}
+	for requestPath, expected := range map[string]string{"": "/", "/": "/", "/login": "/", "/a/b/login": "/a/b"} {
+		if path := defaultCookiePath(requestPath); path != expected {
+			t.Errorf("default path for %q: got %q, expected %q", requestPath, path, expected)
+		}
+	}
+}
+
+// Параметр тестового апстрима, выставляющий куку setCookie
+func setCookieQuery(setCookie string) string {
+	return "h_set-cookie=" + url.QueryEscape(setCookie)
+}
+
+func TestCookieJar(t *testing.T) {
+	upstream := newTestUpstream(t)
+	defer upstream.Close()
+	p := newTestProxy(t, func(params *ProxyParams) {
+		params.Routing = testRoutingTable(t, upstream, `{
+			"upstreams": [
+				{"name": "auth", "host": "UPSTREAM", "cookie_jar": true},
+				{"name": "other", "host": "UPSTREAM"}
+			],
+			"routes": [
+				{"prefix": "/auth/", "upstream": "auth"},
+				{"prefix": "/other/", "upstream": "other"}
+			]
+		}`)
+		params.CookieJarSeedCookies = []string{"sso_*"}
+	})
+	conn := dialTestProxyWithHeader(t, p, "", http.Header{"Cookie": {"sso_token=s; tracking=1"}})
+	call := func(path string) map[string]interface{} {
+		wsSend(t, conn, `{"id": 1, "method": "GET `+path+`"}`)
+		return wsReceive(t, conn)
+	}
+
+	if resp := call("/auth/me"); wsUpstreamHeader(t, resp, "Cookie") != "sso_token=s" {
+		t.Errorf("jar not seeded from the handshake: %v", resp["result"])
+	}
+	resp := call("/auth/login?" + setCookieQuery("sid=1; Path=/; HttpOnly") + "&" + setCookieQuery("pref=2"))
+	if headers, _ := resp["http_headers"].(map[string]interface{}); headers["Set-Cookie"] != nil {
+		t.Errorf("Set-Cookie returned to the client: %v", headers)
+	}
+	call("/auth/a/b?" + setCookieQuery("deep=3"))
+	if resp := call("/auth/a/c"); wsUpstreamHeader(t, resp, "Cookie") != "deep=3; pref=2; sid=1; sso_token=s" {
+		t.Errorf("jar cookies not sent: %q", wsUpstreamHeader(t, resp, "Cookie"))
+	}
+	if resp := call("/other/a"); wsUpstreamHeader(t, resp, "Cookie") != "" {
+		t.Errorf("jar cookies sent to an upstream without cookie_jar: %v", resp["result"])
+	}
+
+	call("/auth/logout?" + setCookieQuery("pref=; Max-Age=0"))
+	wsSend(t, conn, `{"id": 2, "method": "httpsocket.getcookies"}`)
+	cookies, _ := wsReceive(t, conn)["result"].(map[string]interface{})
+	auth, _ := cookies["auth"].([]interface{})
+	values := map[string]interface{}{}
+	for _, c := range auth {
+		cookie := c.(map[string]interface{})
+		values[cookie["name"].(string)] = cookie["value"]
+	}
+	if len(values) != 3 || values["sid"] != nil || values["deep"] != "3" || values["sso_token"] != "s" {
+		t.Errorf("getcookies: got %v", cookies)
+	}
+
+	wsSend(t, conn, `{"id": 3, "method": "httpsocket.clearcookies", "params": 5}`)
+	if resp := wsReceive(t, conn); strictErrorCode(resp) != ErrCodeGenericBadRequest {
+		t.Errorf("clearcookies with malformed params: got %v", resp)
+	}
+	wsSend(t, conn, `{"id": 4, "method": "httpsocket.clearcookies"}`)
+	wsReceive(t, conn)
+	// куки из handshake после очистки не возвращаются
+	if resp := call("/auth/me"); wsUpstreamHeader(t, resp, "Cookie") != "" {
+		t.Errorf("cookies sent after clearcookies: %q", wsUpstreamHeader(t, resp, "Cookie"))
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	urlmodule "net/url"
+)
+
+// Развернутая форма params.
+//
+// Если params - JSON-объект с единственным ключом "httpsocket.request", его значение
+// описывает HTTP-запрос явно:
+//
+//	{"httpsocket.request": {
+//	    "headers": {"Accept-Language": "ru"},
+//	    "query": {"page": "2", "id": ["1", "2"]},
+//	    "body": "...",
+//	    "content_type": "text/plain",
+//	    "body_encoding": "base64"
+//	}}
+//
+// Все поля необязательны.
+//
+//   - headers: дополнительные заголовки запроса (фильтруются по ProxyParams.ClientHeaderPolicy)
+//   - query: параметры, добавляемые в конец querystring (исходная querystring не меняется);
+//     значение - строка или список строк
+//   - body: тело запроса. JSON-строка передается как есть (или декодируется из base64,
+//     если body_encoding = "base64"), любой другой JSON передается как application/json
+//   - content_type: Content-Type запроса, заменяет выбранный по умолчанию
+//   - body_encoding: "" или "base64"
+type RequestEnvelope struct {
+	Headers      map[string]string          `json:"headers"`
+	Query        map[string]json.RawMessage `json:"query"`
+	Body         json.RawMessage            `json:"body"`
+	ContentType  string                     `json:"content_type"`
+	BodyEncoding string                     `json:"body_encoding"`
+}
+
+const (
+	EnvelopeKey = "httpsocket.request"
+)
+
+// Извлечь развернутую форму из params, если она там есть.
+//
+// Возвращает nil, nil, если params имеют одну из старых форм.
+func ParseRequestEnvelope(params json.RawMessage) (*RequestEnvelope, error) {
+	params = bytes.TrimSpace(params)
+	if len(params) == 0 || params[0] != '{' {
+		return nil, nil
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(params, &obj); err != nil {
+		return nil, nil
+	}
+	raw, ok := obj[EnvelopeKey]
+	if !ok || len(obj) != 1 {
+		return nil, nil
+	}
+	env := &RequestEnvelope{}
+	if err := json.Unmarshal(raw, env); err != nil {
+		return nil, fmt.Errorf("malformed %s: %s", EnvelopeKey, err)
+	}
+	switch env.BodyEncoding {
+	case "", "base64":
+	default:
+		return nil, fmt.Errorf("unknown body_encoding %s", env.BodyEncoding)
+	}
+	return env, nil
+}
+
+// Есть ли в конверте тело запроса?
+func (env *RequestEnvelope) HasBody() bool {
+	b := bytes.TrimSpace(env.Body)
+	return len(b) > 0 && !bytes.Equal(b, []byte("null"))
+}
+
+// Тело запроса и Content-Type по умолчанию для него
+func (env *RequestEnvelope) MakeBody() (io.Reader, string, error) {
+	if !env.HasBody() {
+		return nil, env.ContentType, nil
+	}
+	contentType := ""
+	var bs []byte
+	if env.Body[0] == '"' {
+		var s string
+		if err := json.Unmarshal(env.Body, &s); err != nil {
+			return nil, "", err
+		}
+		if env.BodyEncoding == "base64" {
+			decoded, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return nil, "", fmt.Errorf("body: %s", err)
+			}
+			bs = decoded
+			contentType = "application/octet-stream"
+		} else {
+			bs = []byte(s)
+			contentType = "application/x-www-form-urlencoded"
+		}
+	} else {
+		if env.BodyEncoding == "base64" {
+			return nil, "", fmt.Errorf("body must be a string when body_encoding is base64")
+		}
+		bs = []byte(env.Body)
+		contentType = "application/json"
+	}
+	if env.ContentType != "" {
+		contentType = env.ContentType
+	}
+	return bytes.NewBuffer(bs), contentType, nil
+}
+
+// Дописать параметры из конверта к querystring адреса url. Исходная querystring остается
+// как есть: апстрим может зависеть от порядка параметров и их кодирования.
+func (env *RequestEnvelope) ApplyQuery(url string) (string, error) {
+	if len(env.Query) == 0 {
+		return url, nil
+	}
+	u, err := urlmodule.Parse(url)
+	if err != nil {
+		return "", err
+	}
+	q := urlmodule.Values{}
+	for k, raw := range env.Query {
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			q.Add(k, s)
+			continue
+		}
+		var ss []string
+		if err := json.Unmarshal(raw, &ss); err != nil {
+			return "", fmt.Errorf("query parameter %s must be a string or a list of strings", k)
+		}
+		for _, s := range ss {
+			q.Add(k, s)
+		}
+	}
+	if u.RawQuery != "" {
+		u.RawQuery += "&"
+	}
+	u.RawQuery += q.Encode()
+	return u.String(), nil
+}
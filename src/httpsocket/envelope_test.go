@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+)
+
+func TestParseRequestEnvelope(t *testing.T) {
+	for _, params := range []string{``, `"a=1"`, `{"a": 1}`, `{"httpsocket.request": {}, "a": 1}`, `[1]`} {
+		if env, err := ParseRequestEnvelope(json.RawMessage(params)); env != nil || err != nil {
+			t.Errorf("%s: old-style params parsed as envelope %+v, %v", params, env, err)
+		}
+	}
+	for _, params := range []string{`{"httpsocket.request": {"headers": 1}}`, `{"httpsocket.request": {"body_encoding": "gzip"}}`} {
+		if _, err := ParseRequestEnvelope(json.RawMessage(params)); err == nil {
+			t.Errorf("%s: malformed envelope accepted", params)
+		}
+	}
+}
+
+func TestEnvelopeBody(t *testing.T) {
+	cases := []struct {
+		envelope    string
+		body        string
+		contentType string
+	}{
+		{`{"body": "a=1&b=2"}`, "a=1&b=2", "application/x-www-form-urlencoded"},
+		{`{"body": {"x": [1, 2]}}`, `{"x": [1, 2]}`, "application/json"},
+		{`{"body": "aGVsbG8=", "body_encoding": "base64"}`, "hello", "application/octet-stream"},
+		{`{"body": "<a/>", "content_type": "text/xml"}`, "<a/>", "text/xml"},
+		{`{"content_type": "text/plain"}`, "", "text/plain"},
+	}
+	for _, c := range cases {
+		env, err := ParseRequestEnvelope(json.RawMessage(`{"httpsocket.request": ` + c.envelope + `}`))
+		if err != nil {
+			t.Fatalf("%s: %s", c.envelope, err)
+		}
+		r, contentType, err := env.MakeBody()
+		if err != nil {
+			t.Fatalf("%s: %s", c.envelope, err)
+		}
+		body := ""
+		if r != nil {
+			bs, _ := ioutil.ReadAll(r)
+			body = string(bs)
+		}
+		if body != c.body || contentType != c.contentType {
+			t.Errorf("%s: got %q of type %q", c.envelope, body, contentType)
+		}
+	}
+
+	env := &RequestEnvelope{Body: json.RawMessage(`{"x": 1}`), BodyEncoding: "base64"}
+	if _, _, err := env.MakeBody(); err == nil {
+		t.Error("base64 encoding of a JSON object accepted")
+	}
+}
+
+func TestEnvelopeQuery(t *testing.T) {
+	cases := []struct {
+		url      string
+		query    string
+		expected string
+	}{
+		{"/a", `{"page": "2"}`, "/a?page=2"},
+		{"/a?z=1&a=%7e&b=x+y", `{"page": "2"}`, "/a?z=1&a=%7e&b=x+y&page=2"},
+		{"/a?z=1", `{"id": ["1", "2"], "q": "a b&c"}`, "/a?z=1&id=1&id=2&q=a+b%26c"},
+		{"http://up.lan/a%2Fb?x", `{"y": ""}`, "http://up.lan/a%2Fb?x&y="},
+		{"/a?z=1", `{}`, "/a?z=1"},
+	}
+	for _, c := range cases {
+		env := &RequestEnvelope{}
+		if err := json.Unmarshal([]byte(`{"query": `+c.query+`}`), env); err != nil {
+			t.Fatal(err)
+		}
+		url, err := env.ApplyQuery(c.url)
+		if err != nil {
+			t.Errorf("%s + %s: %s", c.url, c.query, err)
+		} else if url != c.expected {
+			t.Errorf("%s + %s: got %s, expected %s", c.url, c.query, url, c.expected)
+		}
+	}
+
+	env := &RequestEnvelope{Query: map[string]json.RawMessage{"n": json.RawMessage(`1`)}}
+	if _, err := env.ApplyQuery("/a"); err == nil {
+		t.Error("numeric query parameter accepted")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Фильтрация HTTP-заголовков, которыми прокси обменивается с клиентом и апстримом
+
+// Hop-by-hop заголовки, которые не передаются дальше ни в одну сторону
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-*",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Заголовки, которые клиент не может передать ни при каких настройках:
+// hop-by-hop заголовки и заголовки, которые проставляет сам прокси.
+var forbiddenClientHeaders = append([]string{
+	"Content-Length",
+	"Host",
+	"X-Forwarded-*",
+	"X-Real-IP",
+	"X-Request-ID",
+}, hopByHopHeaders...)
+
+// Заголовки ответа апстрима, которые не отдаются клиенту ни при каких настройках
+var forbiddenResponseHeaders = append([]string{
+	"Content-Length",
+}, hopByHopHeaders...)
+
+// Политика пропуска заголовков.
+//
+// Элементы списков сравниваются без учета регистра; элемент, оканчивающийся на `*`,
+// задает префикс (например `X-App-*`).
+type HeaderPolicy struct {
+	Whitelist []string // если не пуст, пропускаются только заголовки из этого списка
+	Blacklist []string // заголовки из этого списка не пропускаются никогда
+	forbidden []string // заголовки, которые не пропускаются независимо от настроек
+}
+
+// Политика для заголовков, которые клиент передает апстриму
+func NewClientHeaderPolicy(whitelist, blacklist []string) HeaderPolicy {
+	return HeaderPolicy{
+		Whitelist: whitelist,
+		Blacklist: blacklist,
+		forbidden: forbiddenClientHeaders,
+	}
+}
+
+// Политика для заголовков ответа апстрима, которые отдаются клиенту
+func NewResponseHeaderPolicy(whitelist, blacklist []string) HeaderPolicy {
+	return HeaderPolicy{
+		Whitelist: whitelist,
+		Blacklist: blacklist,
+		forbidden: forbiddenResponseHeaders,
+	}
+}
+
+// Разрешено ли пропустить заголовок name?
+func (p *HeaderPolicy) Allows(name string) bool {
+	if headerMatchesAny(name, p.forbidden) {
+		return false
+	}
+	if headerMatchesAny(name, p.Blacklist) {
+		return false
+	}
+	if len(p.Whitelist) == 0 {
+		return true
+	}
+	return headerMatchesAny(name, p.Whitelist)
+}
+
+// Оставить от заголовков h только разрешенные политикой.
+// Возвращает nil, если не осталось ни одного.
+func (p *HeaderPolicy) Filter(h http.Header) http.Header {
+	var result http.Header
+	for name, values := range h {
+		if !p.Allows(name) {
+			continue
+		}
+		if result == nil {
+			result = http.Header{}
+		}
+		result[name] = values
+	}
+	return result
+}
+
+// Подходит ли заголовок name под один из шаблонов patterns?
+func headerMatchesAny(name string, patterns []string) bool {
+	name = http.CanonicalHeaderKey(name)
+	for _, p := range patterns {
+		if p == "" {
+			continue
+		}
+		if strings.HasSuffix(p, "*") {
+			prefix := http.CanonicalHeaderKey(strings.TrimSuffix(p, "*"))
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if http.CanonicalHeaderKey(p) == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientHeaderPolicy(t *testing.T) {
+	p := NewClientHeaderPolicy([]string{"Accept-Language", "x-app-*", "Host"}, []string{"X-App-Secret"})
+	cases := map[string]bool{
+		"Accept-Language": true,
+		"accept-language": true,
+		"X-App-Version":   true,
+		"X-App-Secret":    false, // в черном списке
+		"Accept":          false, // не в белом списке
+		"Host":            false, // прокси проставляет сам
+		"X-Forwarded-For": false,
+		"Connection":      false,
+	}
+	for name, allowed := range cases {
+		if p.Allows(name) != allowed {
+			t.Errorf("%s: allowed = %v", name, !allowed)
+		}
+	}
+
+	open := NewClientHeaderPolicy(nil, []string{"Cookie"})
+	if !open.Allows("X-Anything") || open.Allows("Cookie") || open.Allows("X-Real-IP") {
+		t.Error("empty whitelist should allow any header except blacklisted and forbidden ones")
+	}
+}
+
+func TestResponseHeaderPolicy(t *testing.T) {
+	p := NewResponseHeaderPolicy([]string{"ETag", "Cache-Control", "Content-Length"}, []string{"Set-Cookie"})
+	h := http.Header{
+		"Etag":           {`"v1"`},
+		"Cache-Control":  {"no-cache", "private"},
+		"Content-Length": {"10"},
+		"Set-Cookie":     {"a=1"},
+		"Server":         {"nginx"},
+	}
+	filtered := p.Filter(h)
+	if len(filtered) != 2 || filtered.Get("ETag") != `"v1"` || len(filtered["Cache-Control"]) != 2 {
+		t.Errorf("unexpected filtered headers %v", filtered)
+	}
+	if p.Filter(http.Header{"Server": {"nginx"}}) != nil {
+		t.Error("expected nil when no header is allowed")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+// Учет выполняющихся запросов клиента и их отмена.
+//
+// Каждый проксируемый запрос выполняется в контексте, производном от контекста соединения:
+// при закрытии соединения отменяются все его запросы. Отдельный запрос можно отменить
+// служебным методом httpsocket.cancel, передав в params его id.
+
+// Выполняющийся запрос
+type inFlightRequest struct {
+	cancel context.CancelFunc
+}
+
+// Выполняющиеся запросы клиента по ключу id
+type inFlightRequests struct {
+	lock     sync.Mutex
+	requests map[string]*inFlightRequest
+}
+
+// Ключ для поиска запроса по id. Числовой и строковый id различаются.
+func inFlightKey(id interface{}) string {
+	return string(MustMarshalJson(id))
+}
+
+// Зарегистрировать запрос rq; возвращает контекст, в котором его следует выполнять,
+// и функцию, которую нужно вызвать по завершении запроса.
+func (c *ProxyClient) startRequest(rq *JsonRpcRequest) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(c.ctx)
+	if rq.Id == nil {
+		return ctx, cancel // запрос без id отменить нельзя
+	}
+	key := inFlightKey(rq.Id)
+	ifr := &inFlightRequest{cancel: cancel}
+
+	c.inFlight.lock.Lock()
+	if c.inFlight.requests == nil {
+		c.inFlight.requests = map[string]*inFlightRequest{}
+	}
+	c.inFlight.requests[key] = ifr
+	c.inFlight.lock.Unlock()
+
+	return ctx, func() {
+		cancel()
+		c.inFlight.lock.Lock()
+		// запрос мог быть вытеснен более поздним запросом с тем же id
+		if c.inFlight.requests[key] == ifr {
+			delete(c.inFlight.requests, key)
+		}
+		c.inFlight.lock.Unlock()
+	}
+}
+
+// Отменить выполняющийся запрос с указанным id.
+// Возвращает false, если такого запроса нет.
+func (c *ProxyClient) cancelRequest(id json.RawMessage) bool {
+	var v interface{}
+	if err := json.Unmarshal(id, &v); err != nil || v == nil {
+		return false
+	}
+	key := inFlightKey(v)
+
+	c.inFlight.lock.Lock()
+	ifr, ok := c.inFlight.requests[key]
+	c.inFlight.lock.Unlock()
+
+	if !ok {
+		return false
+	}
+	ifr.cancel()
+	return true
+}
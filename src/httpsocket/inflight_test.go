@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Апстрим, который не отвечает, пока запрос не отменят; о начале запроса сообщает в
+// started, об отмене - в canceled
+func newHangingUpstream(t *testing.T) (*httptest.Server, <-chan string, <-chan string) {
+	started := make(chan string, 10)
+	canceled := make(chan string, 10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- r.URL.Path
+		select {
+		case <-r.Context().Done():
+			canceled <- r.URL.Path
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	return upstream, started, canceled
+}
+
+func expectCanceled(t *testing.T, canceled <-chan string, path string) {
+	select {
+	case p := <-canceled:
+		if p != path {
+			t.Errorf("expected %s to be canceled, got %s", path, p)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("upstream request %s was not canceled", path)
+	}
+}
+
+func TestCancelRequest(t *testing.T) {
+	upstream, started, canceled := newHangingUpstream(t)
+	defer upstream.Close()
+	p := newTestProxy(t, nil)
+	conn := dialTestProxy(t, p, "")
+
+	wsSend(t, conn, `{"id": "a", "method": "GET `+upstream.URL+`/a"}`)
+	wsSend(t, conn, `{"id": 1, "method": "GET `+upstream.URL+`/b"}`)
+	<-started
+	<-started
+
+	// числовой и строковый id различаются
+	wsSend(t, conn, `{"id": "c1", "method": "httpsocket.cancel", "params": "1"}`)
+	if resp := wsReceive(t, conn); resp["id"] != "c1" || strictErrorCode(resp) != ErrCodeGenericBadRequest {
+		t.Errorf("cancel of an unknown id: got %v", resp)
+	}
+
+	wsSend(t, conn, `{"id": "c2", "method": "httpsocket.cancel", "params": "a"}`)
+	responses := wsReceiveById(t, conn, 2)
+	if resp := responses["c2"]; resp == nil || resp["result"] != "ok" {
+		t.Errorf("cancel: got %v", resp)
+	}
+	if resp := responses["a"]; resp == nil || strictErrorCode(resp) != ErrCodeCanceled {
+		t.Errorf("canceled request: got %v", resp)
+	}
+	expectCanceled(t, canceled, "/a")
+
+	// при закрытии соединения отменяются все его запросы
+	conn.Close()
+	expectCanceled(t, canceled, "/b")
+}
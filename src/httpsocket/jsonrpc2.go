@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+)
+
+// Строгий режим JSON-RPC 2.0.
+//
+// Включается для соединения целиком: подпротоколом вебсокета `jsonrpc-2.0`
+// или параметром `?jsonrpc=2.0` в адресе. В строгом режиме:
+//
+// * каждый ответ содержит "jsonrpc": "2.0" и ровно одно из полей result / error;
+// * error всегда является объектом {"code", "message", "data"};
+// * уведомлением считается запрос без поля id (а не с пустым id), ответ на него не высылается
+//   даже в случае ошибки;
+// * принимаются пакеты (JSON-массивы запросов). Запросы из пакета проксируются параллельно,
+//   ответы на них возвращаются одним массивом.
+//
+// Поля http_status, http_content_type и т.п. добавляются к ответу и в строгом режиме.
+
+const (
+	JsonRpcVersion     = "2.0"
+	JsonRpcSubprotocol = "jsonrpc-2.0"
+)
+
+// Запрошен ли строгий режим JSON-RPC 2.0 в параметрах адреса?
+func wantsStrictJsonRpc(query string) bool {
+	return query == JsonRpcVersion
+}
+
+// Является ли сообщение пакетом запросов?
+func IsJsonRpcBatch(bs []byte) bool {
+	bs = bytes.TrimSpace(bs)
+	return len(bs) > 0 && bs[0] == '['
+}
+
+// Ответы на запросы одного пакета, собираемые по мере готовности
+type rpcBatch struct {
+	lock      sync.Mutex
+	wg        sync.WaitGroup
+	responses []*JsonRpcResponse
+	empty     bool // пустой пакет: ответ на него - одиночная ошибка, а не массив
+}
+
+func (b *rpcBatch) add(resp *JsonRpcResponse) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.responses = append(b.responses, resp)
+}
+
+// Разобрать пакет запросов.
+//
+// Возвращает запросы, привязанные к пакету; запросы, не прошедшие разбор,
+// сразу получают в пакете ответ с ошибкой.
+func (c *ProxyClient) parseBatch(bs []byte) (*rpcBatch, []*JsonRpcRequest, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(bs, &items); err != nil {
+		return nil, nil, err
+	}
+	batch := &rpcBatch{}
+	if len(items) == 0 {
+		batch.empty = true
+		batch.add(c.makeStrictResponse(MakeErrorResponse(nil, ErrCodeInvalidRequest, "empty batch", 0.0)))
+		return batch, nil, nil
+	}
+	requests := []*JsonRpcRequest{}
+	for _, item := range items {
+		rq := &JsonRpcRequest{}
+		if err := json.Unmarshal(item, rq); err != nil {
+			batch.add(c.makeStrictResponse(MakeMalformedMessageResponse(item, err)))
+			continue
+		}
+		rq.batch = batch
+		requests = append(requests, rq)
+	}
+	return batch, requests, nil
+}
+
+// Обработать пакет запросов и отправить клиенту ответы на них одним сообщением
+func (c *ProxyClient) HandleRpcBatch(batch *rpcBatch, requests []*JsonRpcRequest) {
+	c.startRpcBatch(batch, requests)
+	c.finishRpcBatch(batch)
+}
+
+// Запустить запросы пакета (с учетом -throttle-max-pending-per-client, см. goHandleRpcRequest)
+func (c *ProxyClient) startRpcBatch(batch *rpcBatch, requests []*JsonRpcRequest) {
+	for _, rq := range requests {
+		batch.wg.Add(1)
+		if !c.goHandleRpcRequest(rq, batch.wg.Done) {
+			batch.wg.Done()
+			break // соединение закрыто, отвечать некому
+		}
+	}
+}
+
+// Дождаться запросов пакета и отправить клиенту ответы на них одним сообщением
+func (c *ProxyClient) finishRpcBatch(batch *rpcBatch) {
+	defer simpleRecover()
+	batch.wg.Wait()
+	if len(batch.responses) == 0 {
+		return // пакет состоял из одних уведомлений
+	}
+	if batch.empty {
+		c.write(batch.responses[0])
+		return
+	}
+	c.write(batch.responses)
+}
+
+// Проверить, что запрос соответствует спецификации JSON-RPC 2.0
+func (rq *JsonRpcRequest) validateStrict() string {
+	if rq.JsonRpc != JsonRpcVersion {
+		return `"jsonrpc" must be exactly "2.0"`
+	}
+	if rq.Method == "" {
+		return `"method" must be a non-empty string`
+	}
+	switch rq.Id.(type) {
+	case nil, string, float64:
+	default:
+		return `"id" must be a string, a number or null`
+	}
+	return ""
+}
+
+// Привести ответ к виду, требуемому JSON-RPC 2.0
+func (c *ProxyClient) makeStrictResponse(resp *JsonRpcResponse) *JsonRpcResponse {
+	resp.JsonRpc = JsonRpcVersion
+	if len(resp.Error) > 0 && !bytes.Equal(resp.Error, []byte("null")) {
+		resp.Result = nil
+		if !isStrictErrorObject(resp.Error) {
+			// апстрим вернул ошибку в произвольной форме - завернем ее в data
+			resp.Error = json.RawMessage(MustMarshalJson(&JsonRpcError{
+				Code:    ErrCodeUpstreamError,
+				Message: "upstream error",
+				Data:    resp.Error,
+			}))
+		}
+	} else {
+		resp.Error = nil
+		if len(resp.Result) == 0 {
+			resp.Result = json.RawMessage("null")
+		}
+	}
+	return resp
+}
+
+// Является ли error объектом с числовым code и строковым message?
+func isStrictErrorObject(raw json.RawMessage) bool {
+	var obj struct {
+		Code    *int    `json:"code"`
+		Message *string `json:"message"`
+	}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return false
+	}
+	return obj.Code != nil && obj.Message != nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+)
+
+// Ответы строгого режима в виде словарей, упорядоченные по id
+func strictResponses(t *testing.T, out string) []map[string]interface{} {
+	var responses []map[string]interface{}
+	if err := json.Unmarshal([]byte(out), &responses); err != nil {
+		t.Fatalf("expected an array of responses, got %q: %s", out, err)
+	}
+	sort.Slice(responses, func(i, j int) bool {
+		a, _ := responses[i]["id"].(float64)
+		b, _ := responses[j]["id"].(float64)
+		return a < b
+	})
+	for _, resp := range responses {
+		_, hasResult := resp["result"]
+		_, hasError := resp["error"]
+		if resp["jsonrpc"] != JsonRpcVersion || hasResult == hasError {
+			t.Errorf("not a strict JSON-RPC 2.0 response: %v", resp)
+		}
+	}
+	return responses
+}
+
+func strictErrorCode(resp map[string]interface{}) int {
+	e, _ := resp["error"].(map[string]interface{})
+	code, _ := e["code"].(float64)
+	return int(code)
+}
+
+func TestStrictBatch(t *testing.T) {
+	upstream := newTestUpstream(t)
+	defer upstream.Close()
+	p := newTestProxy(t, nil)
+	out := callProxyRaw(t, p, "/http", `[
+		{"jsonrpc": "2.0", "id": 1, "method": "GET `+upstream.URL+`/a"},
+		{"jsonrpc": "2.0", "method": "GET `+upstream.URL+`/notification"},
+		{"jsonrpc": "2.0", "id": 2, "method": "GET `+upstream.URL+`/slow"},
+		{"jsonrpc": "1.0", "id": 3, "method": "GET `+upstream.URL+`/a"},
+		{"jsonrpc": "2.0", "id": 4, "method": 5},
+		{"jsonrpc": "2.0", "id": 5, "method": "BREW `+upstream.URL+`/"}
+	]`, nil)
+	responses := strictResponses(t, out)
+	if len(responses) != 5 {
+		t.Fatalf("expected 5 responses (none for the notification), got %d: %s", len(responses), out)
+	}
+	expectedCodes := []int{0, 0, ErrCodeInvalidRequest, ErrCodeInvalidRequest, ErrCodeInvalidMethod}
+	for i, resp := range responses {
+		if code := strictErrorCode(resp); code != expectedCodes[i] || resp["id"] != float64(i+1) {
+			t.Errorf("response %v: expected id %d and error code %d", resp, i+1, expectedCodes[i])
+		}
+	}
+
+	out = callProxyRaw(t, p, "/http", `[]`, nil)
+	resp := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(out), &resp); err != nil || strictErrorCode(resp) != ErrCodeInvalidRequest {
+		t.Errorf("empty batch: got %q", out)
+	}
+
+	if out := callProxyRaw(t, p, "/http", `[{"jsonrpc": "2.0", "method": "GET `+upstream.URL+`/a"}]`, nil); out != "" {
+		t.Errorf("batch of notifications: expected no response, got %q", out)
+	}
+}
+
+func TestStrictUpstreamErrors(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/strict":
+			w.Write([]byte(`{"error": {"code": 42, "message": "no such item"}}`))
+		case "/loose":
+			w.Write([]byte(`{"error": "boom"}`))
+		case "/result":
+			w.Write([]byte(`{"result": [1, 2]}`))
+		}
+	}))
+	defer upstream.Close()
+	p := newTestProxy(t, nil)
+
+	out := callProxyRaw(t, p, "/http?jsonrpc=2.0", `{"jsonrpc": "2.0", "id": 1, "method": "GET `+upstream.URL+`/strict"}`, nil)
+	resp := strictResponses(t, "["+out+"]")[0]
+	if strictErrorCode(resp) != 42 {
+		t.Errorf("upstream error object not passed as is: %s", out)
+	}
+
+	out = callProxyRaw(t, p, "/http?jsonrpc=2.0", `{"jsonrpc": "2.0", "id": 1, "method": "GET `+upstream.URL+`/loose"}`, nil)
+	resp = strictResponses(t, "["+out+"]")[0]
+	if strictErrorCode(resp) != ErrCodeUpstreamError || resp["error"].(map[string]interface{})["data"] != "boom" {
+		t.Errorf("loose upstream error not wrapped: %s", out)
+	}
+
+	out = callProxyRaw(t, p, "/http?jsonrpc=2.0", `{"jsonrpc": "2.0", "id": 1, "method": "GET `+upstream.URL+`/result"}`, nil)
+	resp = strictResponses(t, "["+out+"]")[0]
+	if result, _ := resp["result"].([]interface{}); len(result) != 2 || resp["http_status"] != 200.0 {
+		t.Errorf("unexpected result: %s", out)
+	}
+
+	// HTTP-обработчик включает строгий режим и для одиночного запроса с "jsonrpc": "2.0"
+	out = callProxyRaw(t, p, "/http", `{"jsonrpc": "2.0", "id": 1, "method": "GET `+upstream.URL+`/result"}`, nil)
+	if err := json.Unmarshal([]byte(out), &resp); err != nil || resp["jsonrpc"] != JsonRpcVersion {
+		t.Errorf("request with jsonrpc 2.0 should switch the HTTP handler to strict mode: %s", out)
+	}
+}
@@ -2,15 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
 	urlmodule "net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,14 +24,20 @@ import (
 // * Запрос
 //
 //     * method: "<HTTP_METHOD> <path+querystring>" (например "GET /mobileapi/catalogue/v5/")
-//     * params: строка-тело POST-запроса
+//     * params: строка-тело POST-запроса, произвольный JSON (отправляется как application/json)
+//       или развернутая форма с заголовками, query-параметрами и телом (см. RequestEnvelope)
 //     * id: строка (GUID)
+//     * timeout_ms: необязательный таймаут запроса в миллисекундах (ограничен сверху настройками сервера)
 //
 // * Ответ
 //
 //     * id: поле id из соответствующего запроса. Если оно было пусто в запросе, ответ не высылается.
 //     * http_status: код HTTP-ответа. Отсутствует, если не удалось сделать запрос (тогда будет заполнен error).
 //     * http_content_type: Content-Type HTTP-ответа.
+//     * upstream_attempts: сколько попыток запроса к апстриму было сделано (см. RetryPolicy).
+//     * cache: hit, revalidated или miss, если запрос мог быть обслужен из кеша (см. cache.go).
+//     * http_headers: заголовки HTTP-ответа, разрешенные ProxyParams.ResponseHeaderPolicy
+//       (словарь имя -> список значений).
 //     * result, error: смотри ниже.
 //
 //  Заполнение полей ответа зависит от вида HTTP-ответа апстрима.
@@ -45,20 +54,48 @@ import (
 //     4. Не удалось получить HTTP-ответ (или даже выполнить HTTP-запрос)
 //        * result: отсутствует.
 //        * error: словарь {"code": code, "message": message}.
+//
+// Соединение может работать в строгом режиме JSON-RPC 2.0 с поддержкой пакетов запросов,
+// см. jsonrpc2.go.
 
 // Общие настройки проксирования
 type ProxyParams struct {
-	DefaultHost              string   // какой хост подставлять в проксируемые запросы, если клиент не указал хост
-	WhitelistedUpstreamHosts []string // хосты, к которым разрешено проксировать запросы
-	WhitelistedOrigins       []string // хосты, с которых разрешен доступ к вебсокету
+	Routing              *RoutingTable    // куда проксировать запросы, в которых клиент не указал хост
+	UpstreamRules        *UpstreamRuleSet // к каким апстримам разрешено проксировать запросы с указанием хоста
+	Origins              OriginPolicy     // с каких источников разрешен доступ к вебсокету
+	TrustedProxies       []*net.IPNet     // прокси, которым можно верить в X-Forwarded-For и т.п.
+	ClientHeaderPolicy   HeaderPolicy     // какие заголовки клиент может передать апстриму
+	SessionHeaderPolicy  HeaderPolicy     // какие заголовки клиент может сохранить в сессии
+	ResponseHeaderPolicy HeaderPolicy     // какие заголовки ответа апстрима отдаются клиенту
+	Timeouts             TimeoutPolicy
+	Retries              RetryPolicy
+	Breakers             BreakerPolicy
+	CoalesceGetRequests  bool     // объединять одинаковые одновременные GET-запросы (если не задано в маршруте)
+	CookieJarSeedCookies []string // какие куки из запроса на открытие соединения класть в хранилище кук
+	Auth                 AuthPolicy
+	Throttle             ThrottlePolicy
+	FakeUpstreamResponse time.Duration // если больше 0, вместо запроса к апстриму ждать столько и отвечать 502
+	LogConnections       bool
+	LogClientIoErrors    bool
+	LogLevel             LogLevel
+	LogFormat            string
+	AccessLog            AccessLogSettings
 }
 
 // Стандартные и не очень коды ошибок JSON-RPC
 const (
+	ErrCodeParseError        = -32700
+	ErrCodeInvalidRequest    = -32600
 	ErrCodeInvalidMethod     = -32601
 	ErrCodeInternalError     = -32603
-	ErrCodeBadGateway        = -502 // не смогли спроксировать запрос
+	ErrCodeUpstreamError     = -32000 // апстрим вернул ошибку не в формате JSON-RPC 2.0 (только в строгом режиме)
+	ErrCodeBadGateway        = -502   // не смогли спроксировать запрос
+	ErrCodeCanceled          = -499   // запрос отменен клиентом (httpsocket.cancel или закрытие соединения)
+	ErrCodeGatewayTimeout    = -504   // апстрим не ответил за отведенное время
+	ErrCodeCircuitOpen       = -503   // апстрим считается недоступным, запрос не отправлялся (см. breaker.go)
+	ErrCodeThrottled         = -429   // запрос отклонен ограничителями частоты (см. ratelimit.go)
 	ErrCodeGenericBadRequest = 400
+	ErrCodeForbidden         = 403 // клиенту не разрешено это действие
 )
 
 type JsonWriter interface {
@@ -67,35 +104,104 @@ type JsonWriter interface {
 
 // Клиент прокси-сервера
 type ProxyClient struct {
-	params          *ProxyParams
-	originalRequest *http.Request // исходный HTTP-запрос от клиента
-	xRealIp         string        // какой заголовок X-Real-IP проставлять в проксируемых запросах
-	conn            JsonWriter    // куда следует писать JSON-ответ
-	writeLock       sync.Mutex    // блокировка на запись в conn
-	gotWriteError   bool          // поймали хотя бы одну ошибку при записи в conn?
-	statCounter     *StatCounter
+	proxy              *WsProxy
+	id                 uint64 // номер соединения
+	connectedAt        time.Time
+	originalRequest    *http.Request // исходный HTTP-запрос от клиента
+	address            ClientAddress // адрес клиента, определенный при открытии соединения (см. clientip.go)
+	xRealIp            string        // какой заголовок X-Real-IP проставлять в проксируемых запросах
+	forwardedFor       string        // какой заголовок X-Forwarded-For проставлять в проксируемых запросах
+	conn               JsonWriter    // куда следует писать JSON-ответ
+	writeLock          sync.Mutex    // блокировка на запись в conn
+	gotWriteError      bool          // поймали хотя бы одну ошибку при записи в conn?
+	closedByProxy      int32         // atomic; соединение закрыто прокси (см. closeConnection)
+	strictJsonRpc      bool          // соединение работает в строгом режиме JSON-RPC 2.0
+	statCounter        *StatCounter
+	rateLimiter        *TokenBucket       // ограничитель частоты запросов соединения (см. ratelimit.go)
+	concurrencyLimiter ConcurrencyLimiter // ограничитель числа одновременных запросов соединения
+	throttleRejects    throttleRejects    // сколько запросов соединения недавно отклонено ограничителями
+	pendingRequests    ConcurrencyLimiter // незавершенные запросы соединения (см. -throttle-max-pending-per-client)
+	ctx                context.Context    // контекст соединения, отменяется при его закрытии
+	inFlight           inFlightRequests   // выполняющиеся запросы, которые можно отменить
+	sessionLock        sync.Mutex
+	sessionHeaders     http.Header // заголовки, добавляемые ко всем запросам (см. session.go)
+	cookies            cookieJar   // куки апстримов (см. cookiejar.go)
+	identity           *Identity   // личность клиента, подтвержденная при открытии соединения (см. auth.go)
 }
 
 // Форматы запросов-ответов JSON-RPC
 
 type JsonRpcRequest struct {
-	Method string          `json:"method"`
-	Params json.RawMessage `json:"params"`
-	Id     interface{}     `json:"id"`
+	JsonRpc string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	Id      interface{}     `json:"id"`
+
+	TimeoutMs int `json:"timeout_ms,omitempty"` // желаемый таймаут запроса, см. TimeoutPolicy
+
+	hasId   bool           // присутствует ли поле id в запросе (хотя бы и пустое)
+	batch   *rpcBatch      // пакет, в составе которого пришел запрос
+	logInfo requestLogInfo // сведения для лога
+}
+
+func (rq *JsonRpcRequest) UnmarshalJSON(bs []byte) error {
+	type plainRequest JsonRpcRequest
+	if err := json.Unmarshal(bs, (*plainRequest)(rq)); err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(bs, &fields); err != nil {
+		return err
+	}
+	_, rq.hasId = fields["id"]
+	return nil
 }
 
 type JsonRpcResponse struct {
+	JsonRpc              string          `json:"jsonrpc,omitempty"`
 	Result               json.RawMessage `json:"result,omitempty"`
 	Error                json.RawMessage `json:"error,omitempty"`
 	HttpStatus           int             `json:"http_status,omitempty"`
 	HttpContentType      string          `json:"http_content_type,omitempty"`
+	HttpHeaders          http.Header     `json:"http_headers,omitempty"`
 	UpstreamResponseTime float64         `json:"upstream_response_time_seconds,omitempty"`
+	UpstreamAttempts     int             `json:"upstream_attempts,omitempty"`
+	Cache                string          `json:"cache,omitempty"`
 	Id                   interface{}     `json:"id"`
 }
 
 type JsonRpcError struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// Ответ апстрима, прочитанный целиком
+type UpstreamResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// Примерный объем памяти, занимаемый ответом
+func (r *UpstreamResponse) Size() int64 {
+	size := int64(len(r.Body))
+	for name, values := range r.Header {
+		size += int64(len(name))
+		for _, v := range values {
+			size += int64(len(v))
+		}
+	}
+	return size
+}
+
+// Данные ошибки: через сколько имеет смысл повторить запрос
+type RetryHint struct {
+	RetryAfterMs int64 `json:"retry_after_ms"`
+}
+
+func MakeRetryHint(retryAfter time.Duration) *RetryHint {
+	return &RetryHint{RetryAfterMs: int64(retryAfter / time.Millisecond)}
 }
 
 // Ответ апстрима, отдаленно напоминающий JSON-RPC
@@ -113,6 +219,51 @@ func (rq *JsonRpcRequest) MakeSimpleResponse(x interface{}) *JsonRpcResponse {
 	}
 }
 
+// Сформировать ответ с ошибкой
+func MakeErrorResponse(id interface{}, errCode int, errMessage string, respTime float64) *JsonRpcResponse {
+	return MakeErrorResponseWithData(id, errCode, errMessage, nil, respTime)
+}
+
+// Сформировать ответ с ошибкой и дополнительными данными о ней
+func MakeErrorResponseWithData(id interface{}, errCode int, errMessage string, data interface{}, respTime float64) *JsonRpcResponse {
+	jerr := MustMarshalJson(&JsonRpcError{
+		Code:    errCode,
+		Message: errMessage,
+		Data:    data,
+	})
+	return &JsonRpcResponse{
+		Error:                json.RawMessage(jerr),
+		Id:                   id,
+		UpstreamResponseTime: respTime,
+	}
+}
+
+// Сформировать ответ на сообщение, которое не удалось разобрать как запрос JSON-RPC:
+// Parse error для невалидного JSON, Invalid Request для JSON неподходящей структуры.
+func MakeMalformedMessageResponse(bs []byte, err error) *JsonRpcResponse {
+	if !json.Valid(bs) {
+		return MakeErrorResponse(nil, ErrCodeParseError, "parse error: "+err.Error(), 0.0)
+	}
+	fields := struct {
+		Id interface{} `json:"id"`
+	}{}
+	json.Unmarshal(bs, &fields) // если id удастся достать, ответим на запрос с этим id
+	return MakeErrorResponse(fields.Id, ErrCodeInvalidRequest, "invalid request: "+err.Error(), 0.0)
+}
+
+// Текущие параметры прокси (могут смениться при перезагрузке настроек, см. config.go)
+func (c *ProxyClient) params() *ProxyParams {
+	return c.proxy.Params()
+}
+
+// Является ли запрос уведомлением, не требующим ответа?
+func (c *ProxyClient) IsNotification(rq *JsonRpcRequest) bool {
+	if c.strictJsonRpc {
+		return !rq.hasId
+	}
+	return rq.Id == nil
+}
+
 var (
 	FakeUpstreamResponse = fmt.Errorf("Fake upstream response")
 )
@@ -120,11 +271,26 @@ var (
 // Обработать один HTTP-запрос
 func (c *ProxyClient) HandleRpcRequest(rq *JsonRpcRequest) {
 	defer c.statCounter.RequestFinished()
-	defer simpleRecover()
+	defer c.writeAccessLog(rq, time.Now())
+	defer func() {
+		if x := recover(); x != nil {
+			logPanic(x)
+			c.SendError(rq, ErrCodeInternalError, "internal error")
+		}
+	}()
+	if c.strictJsonRpc {
+		if msg := rq.validateStrict(); msg != "" {
+			c.SendError(rq, ErrCodeInvalidRequest, msg)
+			return
+		}
+	}
 	if c.handleSpecialMethod(rq) {
 		return
 	}
 
+	ctx, done := c.startRequest(rq)
+	defer done()
+
 	methodAndUrl := strings.SplitN(rq.Method, " ", 2)
 	if len(methodAndUrl) != 2 {
 		c.SendError(rq, ErrCodeInvalidMethod, "malformed method")
@@ -133,6 +299,7 @@ func (c *ProxyClient) HandleRpcRequest(rq *JsonRpcRequest) {
 
 	method := methodAndUrl[0]
 	url := methodAndUrl[1]
+	path := requestPath(url) // до переписывания маршрутом
 
 	switch method {
 	case "GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS":
@@ -141,39 +308,83 @@ func (c *ProxyClient) HandleRpcRequest(rq *JsonRpcRequest) {
 		return
 	}
 
-	c.LogDebugf("Request: %s %s", method, url)
+	rq.logInfo.method = method
+	rq.logInfo.url = url
+	c.logRequestf(LevelDebug, rq, "Request: %s %s", method, url)
 
+	var route *Route
+	var instance *UpstreamInstance
+	upstreamName := DirectUpstreamName // для выключателей и метрик (см. upstream_rules.go)
 	if strings.HasPrefix(url, "/") {
-		if c.params.DefaultHost == "" {
+		route = c.params().Routing.Match(method, url)
+		if route == nil {
 			c.SendError(rq, ErrCodeInvalidMethod, "must specify protocol://host")
 			return
 		}
-		url = "http://" + c.params.DefaultHost + "/" + url
-	} else {
-		if len(c.params.WhitelistedUpstreamHosts) > 0 {
-			whitelisted := false
-			u, err := urlmodule.Parse(url)
-			if err != nil {
-				c.SendError(rq, ErrCodeInvalidMethod, err.Error())
-				return
-			}
-			for _, h := range c.params.WhitelistedUpstreamHosts {
-				if h == u.Host {
-					whitelisted = true
-					break
-				}
-			}
-			if !whitelisted {
-				c.SendError(rq, ErrCodeInvalidMethod, "specified host not in whitelist")
-				return
-			}
+		clientIp, _ := c.clientAddress()
+		instance = route.Upstream.Pick(clientIp)
+		if instance == nil {
+			c.SendError(rq, ErrCodeBadGateway, "no available instances of upstream "+route.Upstream.Name)
+			return
+		}
+		url = route.MakeUrl(instance.Host, url)
+		rq.logInfo.upstream = route.Upstream.Name
+		upstreamName = route.Upstream.Name
+	} else if c.params().UpstreamRules.Enabled() {
+		u, err := urlmodule.Parse(url)
+		if err != nil {
+			c.SendError(rq, ErrCodeInvalidMethod, err.Error())
+			return
 		}
+		rule, err := c.params().UpstreamRules.Match(method, u)
+		if err != nil {
+			c.SendError(rq, ErrCodeInvalidMethod, err.Error())
+			return
+		}
+		upstreamName = rule.UpstreamName()
 	}
 
+	release, err := c.admit(ctx, route)
+	if throttled, ok := err.(*ThrottledError); ok {
+		c.rejectThrottled(rq, throttled)
+		return
+	} else if err != nil {
+		c.SendError(rq, ErrCodeCanceled, "request canceled")
+		return
+	}
+	defer release()
+
 	var rqBody io.Reader
 	rqContentType := ""
 
-	if method != "GET" && method != "HEAD" && len(rq.Params) > 0 {
+	envelope, err := ParseRequestEnvelope(rq.Params)
+	if err != nil {
+		c.SendError(rq, ErrCodeGenericBadRequest, err.Error())
+		return
+	}
+
+	if envelope != nil {
+		if (method == "GET" || method == "HEAD") && envelope.HasBody() {
+			c.SendError(rq, ErrCodeGenericBadRequest, "body is not allowed for "+method)
+			return
+		}
+		for name := range envelope.Headers {
+			if !c.params().ClientHeaderPolicy.Allows(name) {
+				c.SendError(rq, ErrCodeGenericBadRequest, "header not allowed: "+name)
+				return
+			}
+		}
+		url, err = envelope.ApplyQuery(url)
+		if err != nil {
+			c.SendError(rq, ErrCodeGenericBadRequest, err.Error())
+			return
+		}
+		rqBody, rqContentType, err = envelope.MakeBody()
+		if err != nil {
+			c.SendError(rq, ErrCodeGenericBadRequest, err.Error())
+			return
+		}
+	} else if method != "GET" && method != "HEAD" && len(rq.Params) > 0 {
 		if rq.Params[0] == '"' { // JSON-строка
 			rqContentType = "application/x-www-form-urlencoded"
 			b := []byte(rq.Params)[1 : len(rq.Params)-1]
@@ -184,55 +395,223 @@ func (c *ProxyClient) HandleRpcRequest(rq *JsonRpcRequest) {
 		}
 	}
 
-	httpRq, err := http.NewRequest(method, url, rqBody)
+	httpRq, err := http.NewRequestWithContext(ctx, method, url, rqBody)
 	if err != nil {
 		c.SendError(rq, ErrCodeInternalError, err.Error())
 		return
 	}
-	httpRq.Header.Add("X-Real-IP", c.xRealIp)
-	httpRq.Header.Add("X-Request-ID", c.makeXRequestId(url))
-	if rqContentType != "" {
-		httpRq.Header.Add("Content-Type", rqContentType)
+	var upstreamTimeout time.Duration
+	if route != nil {
+		upstreamTimeout = time.Duration(route.Upstream.Timeout)
+	}
+	timeout := c.params().Timeouts.For(method, path, upstreamTimeout, rq.TimeoutMs)
+	ctx, cancelTimeout := context.WithTimeout(ctx, timeout)
+	defer cancelTimeout()
+	httpRq = httpRq.WithContext(ctx)
+	c.applySessionHeaders(httpRq)
+	if envelope != nil {
+		for name, value := range envelope.Headers {
+			httpRq.Header.Set(name, value)
+		}
+	}
+	if route != nil && route.Upstream.CookieJar {
+		c.addJarCookies(route.Upstream, httpRq)
+	}
+	c.params().Auth.ApplyIdentityHeaders(httpRq, c.identity)
+	clientIp, forwardedFor := c.clientAddress()
+	httpRq.Header.Set("X-Real-IP", clientIp)
+	httpRq.Header.Set("X-Forwarded-For", forwardedFor)
+	httpRq.Header.Set("X-Forwarded-Proto", c.address.Proto)
+	httpRq.Header.Set("X-Request-ID", c.makeXRequestId(url))
+	rq.logInfo.url = httpRq.URL.String()
+	rq.logInfo.requestId = httpRq.Header.Get("X-Request-ID")
+	rq.logInfo.upstreamHost = httpRq.URL.Host
+	if route == nil {
+		rq.logInfo.upstream = httpRq.URL.Host
+	}
+	if rqContentType != "" && (envelope == nil || envelope.ContentType != "" || httpRq.Header.Get("Content-Type") == "") {
+		httpRq.Header.Set("Content-Type", rqContentType)
 	}
 
-	t0 := time.Now()
-	var httpResp *http.Response
+	upstreamKey := httpRq.URL.String()
+	if route != nil {
+		// экземпляры апстрима взаимозаменяемы, поэтому в ключе - имя апстрима, а не хост
+		upstreamKey = route.Upstream.Name + " " + httpRq.URL.RequestURI()
+	}
 
-	if *fakeUpstreamResponseTimeMs > 0 {
-		time.Sleep(time.Duration(*fakeUpstreamResponseTimeMs) * time.Millisecond)
-		err = FakeUpstreamResponse
-	} else {
-		httpResp, err = httpClient.Do(httpRq)
+	// кеш ответов
+	cacheKey := ""
+	var cached *UpstreamResponse
+	if responseCache != nil && IsCacheableRequest(httpRq) && !c.IsNotification(rq) {
+		cacheKey = upstreamKey
+		if c.identity != nil {
+			// ответ может зависеть от пользователя, которого апстрим видит в доверенных заголовках
+			cacheKey += " user:" + c.identity.UserId
+		}
+		var fresh bool
+		cached, fresh = responseCache.Get(cacheKey, httpRq.Header, time.Now())
+		if cached != nil && fresh {
+			c.statCounter.CacheHit()
+			resp := c.makeResponse(rq, cached)
+			resp.Cache = CacheHit
+			rq.logInfo.status, rq.logInfo.responseBytes, rq.logInfo.cache = cached.StatusCode, len(cached.Body), CacheHit
+			c.Send(rq, resp)
+			return
+		}
+		if cached != nil && !addValidators(httpRq, cached) {
+			cached = nil
+		}
 	}
 
-	dt := time.Since(t0)
+	fetch := func(ctx context.Context) *upstreamResult {
+		return c.fetchUpstream(ctx, httpRq, upstreamName, route, instance)
+	}
+	var result *upstreamResult
+	if method == "GET" && c.params().ShouldCoalesce(route) && !c.IsNotification(rq) {
+		var shared bool
+		result, shared = coalescedRequests.Do(ctx, coalesceKey(upstreamKey, httpRq, coalesceAcrossIps(route)), timeout, fetch)
+		if shared {
+			c.statCounter.RequestCoalesced()
+		}
+	} else {
+		result = fetch(ctx)
+	}
 
-	if err != nil {
-		c.SendErrorWithTime(rq, ErrCodeBadGateway, err.Error(), dt.Seconds())
+	rq.logInfo.upstreamTime = result.duration
+	if result.resp != nil {
+		rq.logInfo.status, rq.logInfo.responseBytes = result.resp.StatusCode, len(result.resp.Body)
+	}
+	if result.errCode != 0 {
+		c.logError(rq, result.errCode, result.errMessage)
+		var data interface{}
+		if result.errCode == ErrCodeCircuitOpen {
+			c.statCounter.RequestCircuitBroken()
+			data = MakeRetryHint(result.retryAfter)
+		}
+		resp := MakeErrorResponseWithData(rq.Id, result.errCode, result.errMessage, data, result.duration.Seconds())
+		resp.UpstreamAttempts = result.attempts
+		c.Send(rq, resp)
 		return
 	}
-	defer httpResp.Body.Close()
 
+	if route != nil && route.Upstream.CookieJar {
+		c.storeJarCookies(route.Upstream, httpRq.URL.Path, result.resp.Header)
+	}
 
-	if rq.Id == nil { // запрос не требует ответа
+	if c.IsNotification(rq) { // запрос не требует ответа
 		return
 	}
 
-	respContentType := httpResp.Header.Get("Content-Type")
+	upstreamResp := result.resp
+	cacheStatus := ""
+	if cacheKey != "" {
+		if cached != nil && upstreamResp.StatusCode == http.StatusNotModified {
+			c.statCounter.CacheRevalidated()
+			upstreamResp = responseCache.Revalidate(cacheKey, httpRq.Header, cached, upstreamResp, time.Now())
+			cacheStatus = CacheRevalidated
+			rq.logInfo.status, rq.logInfo.responseBytes = upstreamResp.StatusCode, len(upstreamResp.Body)
+		} else {
+			c.statCounter.CacheMiss()
+			responseCache.Put(cacheKey, httpRq.Header, upstreamResp, time.Now())
+			cacheStatus = CacheMiss
+		}
+	}
+
+	resp := c.makeResponse(rq, upstreamResp)
+	resp.UpstreamResponseTime = result.duration.Seconds()
+	resp.UpstreamAttempts = result.attempts
+	resp.Cache = cacheStatus
+	rq.logInfo.cache = cacheStatus
+	c.Send(rq, resp)
+}
+
+// Результат обращения к апстриму: прочитанный ответ или код ошибки
+type upstreamResult struct {
+	resp       *UpstreamResponse
+	attempts   int
+	duration   time.Duration
+	errCode    int           // 0, если ответ получен
+	errMessage string        //
+	retryAfter time.Duration // для ErrCodeCircuitOpen
+}
 
-	resp := &JsonRpcResponse{
-		Id:                   rq.Id,
-		HttpStatus:           httpResp.StatusCode,
-		HttpContentType:      respContentType,
-		UpstreamResponseTime: dt.Seconds(),
+// Выполнить запрос к апстриму (с учетом выключателя, повторов и экземпляров пула) и прочитать ответ.
+// upstreamName - апстрим маршрута route или правило, разрешившее запрос по явному адресу.
+func (c *ProxyClient) fetchUpstream(ctx context.Context, httpRq *http.Request, upstreamName string, route *Route, instance *UpstreamInstance) *upstreamResult {
+	httpRq = httpRq.WithContext(ctx)
+
+	var breaker *CircuitBreaker
+	var breakerTicket *BreakerTicket
+	if c.params().Breakers.Enabled() {
+		breaker = circuitBreakers.Get(upstreamName, &c.params().Breakers)
+		var retryAfter time.Duration
+		if breakerTicket, retryAfter = breaker.Allow(time.Now()); breakerTicket == nil {
+			return &upstreamResult{
+				errCode:    ErrCodeCircuitOpen,
+				errMessage: "upstream " + upstreamName + " is unavailable",
+				retryAfter: retryAfter,
+			}
+		}
+	}
+
+	t0 := time.Now()
+	if instance != nil {
+		instance.Acquire()
+	}
+	httpResp, attempts, err := c.doWithRetries(ctx, httpRq)
+	var bs []byte
+	if err == nil {
+		bs, err = ioutil.ReadAll(httpResp.Body)
+		httpResp.Body.Close()
+		if err != nil {
+			err = fmt.Errorf("reading response: %s", err)
+		}
+	}
+	dt := time.Since(t0)
+	failed := isUpstreamFailure(ctx, err, httpResp)
+	if instance != nil {
+		instance.Release(route.Upstream, failed)
+	}
+	if breaker != nil {
+		if ctx.Err() == context.Canceled {
+			breaker.Cancel(breakerTicket)
+		} else {
+			breaker.Record(breakerTicket, time.Now(), failed, dt)
+		}
 	}
 
-	bs, err := ioutil.ReadAll(httpResp.Body)
+	requestBytes := int(httpRq.ContentLength)
+	if requestBytes < 0 {
+		requestBytes = 0
+	}
+	result := &upstreamResult{attempts: attempts, duration: dt}
 	if err != nil {
-		c.SendError(rq, ErrCodeBadGateway, "reading response: "+err.Error())
-		return
+		result.errCode, result.errMessage = upstreamError(ctx, err)
+		upstreamMetrics.Observe(httpRq.Method, upstreamName, upstreamErrorCodeLabel(result.errCode), dt, requestBytes, 0)
+		return result
+	}
+	upstreamMetrics.Observe(httpRq.Method, upstreamName, strconv.Itoa(httpResp.StatusCode), dt, requestBytes, len(bs))
+	result.resp = &UpstreamResponse{
+		StatusCode: httpResp.StatusCode,
+		Header:     httpResp.Header,
+		Body:       bs,
+	}
+	return result
+}
+
+// Сформировать ответ клиенту по ответу апстрима
+func (c *ProxyClient) makeResponse(rq *JsonRpcRequest, upstreamResp *UpstreamResponse) *JsonRpcResponse {
+	respContentType := upstreamResp.Header.Get("Content-Type")
+
+	resp := &JsonRpcResponse{
+		Id:              rq.Id,
+		HttpStatus:      upstreamResp.StatusCode,
+		HttpContentType: respContentType,
+		HttpHeaders:     c.params().ResponseHeaderPolicy.Filter(upstreamResp.Header),
 	}
 
+	bs := upstreamResp.Body
+
 	// возможно, ответ апстрима напоминает JSON-RPC по структуре
 	if IsJsonContentType(respContentType) {
 		maybeRpcResponse := JsonRpcLikeResponse{}
@@ -257,7 +636,39 @@ func (c *ProxyClient) HandleRpcRequest(rq *JsonRpcRequest) {
 		s := string(bs)
 		resp.Result = json.RawMessage(MustMarshalJson(s))
 	}
-	c.Send(rq, resp)
+	return resp
+}
+
+// Выполнить одну попытку запроса к апстриму
+func (c *ProxyClient) roundTrip(ctx context.Context, httpRq *http.Request) (*http.Response, error) {
+	if fake := c.params().FakeUpstreamResponse; fake > 0 {
+		select {
+		case <-time.After(fake):
+			return nil, FakeUpstreamResponse
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return httpClient.Do(httpRq)
+}
+
+// Является ли результат запроса неудачей по вине апстрима (а не клиента)?
+func isUpstreamFailure(ctx context.Context, err error, httpResp *http.Response) bool {
+	if err != nil {
+		return err != FakeUpstreamResponse && ctx.Err() != context.Canceled
+	}
+	return IsUpstreamFailureStatus(httpResp.StatusCode)
+}
+
+// Код и текст ошибки для неудачного обращения к апстриму
+func upstreamError(ctx context.Context, err error) (int, string) {
+	switch ctx.Err() {
+	case context.Canceled:
+		return ErrCodeCanceled, "request canceled"
+	case context.DeadlineExceeded:
+		return ErrCodeGatewayTimeout, "upstream timeout"
+	}
+	return ErrCodeBadGateway, err.Error()
 }
 
 // Обработать вызов встроенного служебного метода RPC, если такой указан в запросе.
@@ -272,7 +683,45 @@ func (c *ProxyClient) handleSpecialMethod(rq *JsonRpcRequest) bool {
 			c.SendError(rq, ErrCodeGenericBadRequest, "params must be a string")
 			return true
 		}
-		c.xRealIp = ip
+		if net.ParseIP(ip) == nil {
+			c.SendError(rq, ErrCodeGenericBadRequest, "malformed IP address")
+			return true
+		}
+		if !c.mayChangeClientIp() {
+			c.SendError(rq, ErrCodeForbidden, "only authenticated or trusted clients may set X-Real-IP")
+			return true
+		}
+		c.setClientIp(ip)
+		c.Send(rq, rq.MakeSimpleResponse("ok"))
+	case "httpsocket.cancel":
+		if !c.cancelRequest(rq.Params) {
+			c.SendError(rq, ErrCodeGenericBadRequest, "no such request in flight")
+			return true
+		}
+		c.Send(rq, rq.MakeSimpleResponse("ok"))
+	case "httpsocket.setheaders":
+		if err := c.setSessionHeaders(rq.Params); err != nil {
+			c.SendError(rq, ErrCodeGenericBadRequest, err.Error())
+			return true
+		}
+		c.Send(rq, rq.MakeSimpleResponse("ok"))
+	case "httpsocket.unsetheaders":
+		if err := c.unsetSessionHeaders(rq.Params); err != nil {
+			c.SendError(rq, ErrCodeGenericBadRequest, err.Error())
+			return true
+		}
+		c.Send(rq, rq.MakeSimpleResponse("ok"))
+	case "httpsocket.getsession":
+		c.Send(rq, rq.MakeSimpleResponse(c.sessionInfo()))
+	case "httpsocket.getcookies":
+		c.Send(rq, rq.MakeSimpleResponse(c.jarCookiesInfo()))
+	case "httpsocket.clearcookies":
+		upstreamName, err := parseClearCookiesParams(rq.Params)
+		if err != nil {
+			c.SendError(rq, ErrCodeGenericBadRequest, err.Error())
+			return true
+		}
+		c.clearJarCookies(upstreamName)
 		c.Send(rq, rq.MakeSimpleResponse("ok"))
 	default:
 		return false
@@ -282,33 +731,63 @@ func (c *ProxyClient) handleSpecialMethod(rq *JsonRpcRequest) bool {
 
 // Отправить клиенту сообщение об ошибке
 func (c *ProxyClient) SendErrorWithTime(rq *JsonRpcRequest, errCode int, errMessage string, respTime float64) {
-	if errMessage != FakeUpstreamResponse.Error() {
-		c.LogWarnf("SendError(%s, %d, %s)", rq.Method, errCode, errMessage)
+	c.logError(rq, errCode, errMessage)
+	// id может быть пустым, но ошибку все равно нужно отправить
+	c.Send(rq, MakeErrorResponse(rq.Id, errCode, errMessage, respTime))
+}
+
+// Залогировать ошибку, отправляемую клиенту
+func (c *ProxyClient) logError(rq *JsonRpcRequest, errCode int, errMessage string) {
+	rq.logInfo.errCode = errCode
+	if errMessage != FakeUpstreamResponse.Error() && errCode != ErrCodeCanceled && errCode != ErrCodeThrottled {
+		c.logRequestf(LevelWarn, rq, "SendError(%s, %d, %s)", rq.Method, errCode, errMessage)
 	}
-	jerr := MustMarshalJson(&JsonRpcError{
-		Code:    errCode,
-		Message: errMessage,
-	})
-	c.Send(rq, &JsonRpcResponse{
-		Error:                json.RawMessage(jerr),
-		Id:                   rq.Id, // может быть пустым, но ошибку все равно нужно отправить
-		UpstreamResponseTime: respTime,
-	})
 }
 
 func (c *ProxyClient) SendError(rq *JsonRpcRequest, errCode int, errMessage string) {
 	c.SendErrorWithTime(rq, errCode, errMessage, 0.0)
 }
 
-// Отправить сообщение клиенту
+// Отправить клиенту сообщение об ошибке с дополнительными данными
+func (c *ProxyClient) SendErrorWithData(rq *JsonRpcRequest, errCode int, errMessage string, data interface{}) {
+	c.logError(rq, errCode, errMessage)
+	c.Send(rq, MakeErrorResponseWithData(rq.Id, errCode, errMessage, data, 0.0))
+}
+
+// Ответить клиенту на сообщение, которое не удалось разобрать
+func (c *ProxyClient) SendMalformedMessageError(bs []byte, err error) {
+	c.LogDebugf("Malformed message: %s", err)
+	resp := MakeMalformedMessageResponse(bs, err)
+	if c.strictJsonRpc {
+		resp = c.makeStrictResponse(resp)
+	}
+	c.write(resp)
+}
+
+// Отправить клиенту ответ на запрос rq
 func (c *ProxyClient) Send(rq *JsonRpcRequest, x *JsonRpcResponse) {
+	if c.strictJsonRpc {
+		if !rq.hasId {
+			return // на уведомления в JSON-RPC 2.0 не отвечают даже ошибками
+		}
+		x = c.makeStrictResponse(x)
+	}
+	if rq.batch != nil {
+		rq.batch.add(x)
+		return
+	}
+	c.write(x)
+}
+
+// Записать сообщение в соединение с клиентом
+func (c *ProxyClient) write(x interface{}) {
 	c.writeLock.Lock()
 	defer c.writeLock.Unlock()
 
 	err := c.conn.WriteJSON(x)
 	if err != nil {
 		c.gotWriteError = true
-		if *logClientIoErrors {
+		if c.params().LogClientIoErrors {
 			c.LogErrorf("Write: %s", err)
 		}
 	}
@@ -316,48 +795,59 @@ func (c *ProxyClient) Send(rq *JsonRpcRequest, x *JsonRpcResponse) {
 
 // Логирование ошибок при работе с этим клиентом
 func (c *ProxyClient) LogErrorf(fmt string, params ...interface{}) {
-	fmt = "ERROR [%s]: " + fmt
-	params = append([]interface{}{c.originalRequest.RemoteAddr}, params...)
-	log.Printf(fmt, params...)
+	logger.Log(LevelError, c.logFields(), fmt, params...)
 }
 
 // Логирование предупреждений при работе с этим клиентом
 func (c *ProxyClient) LogWarnf(fmt string, params ...interface{}) {
-	fmt = "WARN [%s]: " + fmt
-	params = append([]interface{}{c.originalRequest.RemoteAddr}, params...)
-	log.Printf(fmt, params...)
+	logger.Log(LevelWarn, c.logFields(), fmt, params...)
 }
 
 // Логирование информационных сообщений при работе с этим клиентом
 func (c *ProxyClient) LogInfof(fmt string, params ...interface{}) {
-	fmt = "INFO [%s]: " + fmt
-	params = append([]interface{}{c.originalRequest.RemoteAddr}, params...)
-	log.Printf(fmt, params...)
+	logger.Log(LevelInfo, c.logFields(), fmt, params...)
 }
 
 // Логирование отладочных сообщений при работе с этим клиентом
 func (c *ProxyClient) LogDebugf(fmt string, params ...interface{}) {
-	if !*debug {
+	if !logger.Enabled(LevelDebug) {
 		return
 	}
-	fmt = "DEBUG [%s]: " + fmt
-	params = append([]interface{}{c.originalRequest.RemoteAddr}, params...)
-	log.Printf(fmt, params...)
+	logger.Log(LevelDebug, c.logFields(), fmt, params...)
 }
 
 // Сформировать значение X-Request-ID для идентификации запроса
 func (c *ProxyClient) makeXRequestId(url string) string {
 	t := time.Now().Unix()
 	url = strings.Split(url, "?")[0]
-	return fmt.Sprintf("%d:%s::%s:ws-proxy", t, c.xRealIp, url)
+	clientIp, _ := c.clientAddress()
+	return fmt.Sprintf("%d:%s::%s:ws-proxy", t, clientIp, url)
+}
+
+// Общий для всех HTTP-клиент, через который идут проксируемые запросы.
+// Таймауты отдельных запросов задаются ProxyParams.Timeouts, таймаут подключения -
+// -timeout-seconds (меняется при перезагрузке настроек без пересоздания клиента).
+var (
+	httpClient  *http.Client
+	dialTimeout int64 // atomic; таймаут подключения в наносекундах
+)
+
+func initHttpClient(timeout time.Duration) {
+	setDialTimeout(timeout)
+	httpClient = MakeTimeoutingHttpClient(func() time.Duration {
+		return time.Duration(atomic.LoadInt64(&dialTimeout))
+	})
+}
+
+func setDialTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&dialTimeout, int64(timeout))
 }
 
-// Общий для всех HTTP-клиент, через который идут проксируемые запросы
-// TODO: отдельные таймауты на GET и на другие запросы
+// Общий для всех кеш ответов апстримов; nil, если кеш выключен
 var (
-	httpClient *http.Client
+	responseCache *ResponseCache
 )
 
-func initHttpClient(timeoutSeconds int) {
-	httpClient = MakeTimeoutingHttpClient(time.Duration(timeoutSeconds) * time.Second)
+func initResponseCache(sizeMb int, maxEntryKb int) {
+	responseCache = NewResponseCache(int64(sizeMb)*1024*1024, int64(maxEntryKb)*1024)
 }
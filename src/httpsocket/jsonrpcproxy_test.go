@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Запрос, который увидел тестовый апстрим
+type seenRequest struct {
+	Method   string      `json:"method"`
+	Path     string      `json:"path"`
+	RawQuery string      `json:"raw_query"`
+	Header   http.Header `json:"header"`
+	Body     string      `json:"body"`
+}
+
+// Тестовый апстрим: отвечает JSON-описанием запроса (seenRequest); пути со "slow"
+// отвечают через 200ms, параметры h_<Имя>=значение становятся заголовками ответа
+func newTestUpstream(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "slow") {
+			select {
+			case <-time.After(200 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		for name, values := range r.URL.Query() {
+			if strings.HasPrefix(name, "h_") {
+				w.Header()[http.CanonicalHeaderKey(name[2:])] = values
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(seenRequest{r.Method, r.URL.Path, r.URL.RawQuery, r.Header, string(body)})
+	}))
+}
+
+// Прокси с настройками по умолчанию, измененными configure (если не nil)
+func newTestProxy(t *testing.T, configure func(params *ProxyParams)) *WsProxy {
+	settings, err := LoadSettings("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err := NewProxyParams(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configure != nil {
+		configure(params)
+	}
+	if httpClient == nil {
+		initHttpClient(params.Timeouts.Default)
+	}
+	return &WsProxy{params: params, settings: settings, limiters: NewLimiters(systemClock{})}
+}
+
+// Таблица маршрутизации из JSON, в котором UPSTREAM заменен адресом апстрима
+func testRoutingTable(t *testing.T, upstream *httptest.Server, routes string) *RoutingTable {
+	host := strings.TrimPrefix(upstream.URL, "http://")
+	table, err := ParseRoutingTable([]byte(strings.Replace(routes, "UPSTREAM", host, -1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table
+}
+
+// Отправить тело body в HTTP-обработчик прокси по адресу target; возвращает текст ответа
+func callProxyRaw(t *testing.T, p *WsProxy, target string, body string, header http.Header) string {
+	r := httptest.NewRequest("POST", target, strings.NewReader(body))
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	p.ServeHttp(w, r)
+	return w.Body.String()
+}
+
+// Отправить запрос в HTTP-обработчик прокси и разобрать ответ
+func callProxy(t *testing.T, p *WsProxy, body string) *JsonRpcResponse {
+	out := callProxyRaw(t, p, "/http", body, nil)
+	resp := &JsonRpcResponse{}
+	if err := json.Unmarshal([]byte(out), resp); err != nil {
+		t.Fatalf("malformed response %q: %s", out, err)
+	}
+	return resp
+}
+
+// Запрос, который увидел тестовый апстрим, из ответа прокси
+func upstreamSaw(t *testing.T, resp *JsonRpcResponse) *seenRequest {
+	if resp.Error != nil {
+		t.Fatalf("unexpected error %s", resp.Error)
+	}
+	seen := &seenRequest{}
+	if err := json.Unmarshal(resp.Result, seen); err != nil {
+		t.Fatalf("unexpected result %s: %s", resp.Result, err)
+	}
+	return seen
+}
+
+// Код ошибки из ответа прокси (0 - ответ без ошибки)
+func errorCode(t *testing.T, resp *JsonRpcResponse) int {
+	if resp.Error == nil {
+		return 0
+	}
+	e := &JsonRpcError{}
+	if err := json.Unmarshal(resp.Error, e); err != nil {
+		t.Fatalf("malformed error %s: %s", resp.Error, err)
+	}
+	return e.Code
+}
+
+func TestProxyRoutedRequest(t *testing.T) {
+	upstream := newTestUpstream(t)
+	defer upstream.Close()
+	p := newTestProxy(t, func(params *ProxyParams) {
+		params.Routing = testRoutingTable(t, upstream, `{
+			"upstreams": [{"name": "api", "host": "UPSTREAM", "base_path": "/base"}],
+			"routes": [{"prefix": "/mobileapi/", "upstream": "api", "rewrite_prefix": "/v2/"}]
+		}`)
+	})
+	resp := callProxy(t, p, `{"id": 1, "method": "POST /mobileapi/items?b=2&a=1", "params": {"x": 1}}`)
+	seen := upstreamSaw(t, resp)
+	if seen.Method != "POST" || seen.Path != "/base/v2/items" || seen.RawQuery != "b=2&a=1" {
+		t.Errorf("upstream saw %s %s?%s", seen.Method, seen.Path, seen.RawQuery)
+	}
+	if seen.Body != `{"x": 1}` || seen.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("upstream saw body %q of type %q", seen.Body, seen.Header.Get("Content-Type"))
+	}
+	if resp.HttpStatus != 200 || resp.Id != 1.0 || resp.UpstreamAttempts != 1 {
+		t.Errorf("unexpected response %+v", resp)
+	}
+
+	resp = callProxy(t, p, `{"id": 2, "method": "GET /unknown/"}`)
+	if code := errorCode(t, resp); code != ErrCodeInvalidMethod {
+		t.Errorf("request without route: got error code %d", code)
+	}
+	resp = callProxy(t, p, `{"id": 3, "method": "BREW /mobileapi/"}`)
+	if code := errorCode(t, resp); code != ErrCodeInvalidMethod {
+		t.Errorf("unknown HTTP method: got error code %d", code)
+	}
+}
+
+// -path-timeouts сравниваются с путем клиента, а не с путем, переписанным маршрутом
+func TestProxyPathTimeoutOnRewrittenRoute(t *testing.T) {
+	upstream := newTestUpstream(t)
+	defer upstream.Close()
+	p := newTestProxy(t, func(params *ProxyParams) {
+		params.Routing = testRoutingTable(t, upstream, `{
+			"upstreams": [{"name": "api", "host": "UPSTREAM"}],
+			"routes": [
+				{"prefix": "/mobileapi/", "upstream": "api", "rewrite_prefix": "/v2/"},
+				{"prefix": "/catalogue/", "upstream": "api", "strip_prefix": true}
+			]
+		}`)
+		params.Timeouts.ByPathPrefix = []KeyedTimeout{
+			{"/mobileapi/slow", 50 * time.Millisecond},
+			{"/catalogue/", 50 * time.Millisecond},
+			{"/v2/", time.Minute},
+			{"/slow", time.Minute},
+		}
+	})
+	for _, method := range []string{"GET /mobileapi/slow/report", "GET /catalogue/slow?page=2"} {
+		resp := callProxy(t, p, `{"id": 1, "method": "`+method+`"}`)
+		if code := errorCode(t, resp); code != ErrCodeGatewayTimeout {
+			t.Errorf("%s: expected timeout, got %s %s", method, resp.Result, resp.Error)
+		}
+	}
+}
+
+func TestProxyEnvelope(t *testing.T) {
+	upstream := newTestUpstream(t)
+	defer upstream.Close()
+	p := newTestProxy(t, nil)
+	resp := callProxy(t, p, `{"id": 1, "method": "PUT `+upstream.URL+`/a?z=1&a=%7e", "params": {"httpsocket.request": {
+		"headers": {"Accept-Language": "ru", "X-App-Version": "5"},
+		"query": {"page": "2"},
+		"body": "aGVsbG8=",
+		"body_encoding": "base64"
+	}}}`)
+	seen := upstreamSaw(t, resp)
+	if seen.RawQuery != "z=1&a=%7e&page=2" {
+		t.Errorf("upstream saw query %q", seen.RawQuery)
+	}
+	if seen.Header.Get("Accept-Language") != "ru" || seen.Header.Get("X-App-Version") != "5" {
+		t.Errorf("envelope headers not passed: %v", seen.Header)
+	}
+	if seen.Body != "hello" || seen.Header.Get("Content-Type") != "application/octet-stream" {
+		t.Errorf("upstream saw body %q of type %q", seen.Body, seen.Header.Get("Content-Type"))
+	}
+
+	for _, params := range []string{
+		`{"httpsocket.request": {"headers": {"Cookie": "a=1"}}}`,
+		`{"httpsocket.request": {"headers": {"X-Real-IP": "10.0.0.1"}}}`,
+		`{"httpsocket.request": {"body_encoding": "gzip"}}`,
+	} {
+		resp := callProxy(t, p, `{"id": 2, "method": "POST `+upstream.URL+`/a", "params": `+params+`}`)
+		if code := errorCode(t, resp); code != ErrCodeGenericBadRequest {
+			t.Errorf("%s: got error code %d", params, code)
+		}
+	}
+	resp = callProxy(t, p, `{"id": 3, "method": "GET `+upstream.URL+`/a", "params": {"httpsocket.request": {"body": "x"}}}`)
+	if code := errorCode(t, resp); code != ErrCodeGenericBadRequest {
+		t.Errorf("GET with body: got error code %d", code)
+	}
+}
+
+func TestProxyResponseHeaders(t *testing.T) {
+	upstream := newTestUpstream(t)
+	defer upstream.Close()
+	p := newTestProxy(t, nil)
+	resp := callProxy(t, p, `{"id": 1, "method": "GET `+upstream.URL+`/a?h_etag=v1&h_set-cookie=a%3D1&h_server=up&h_x-custom=1"}`)
+	if resp.HttpHeaders.Get("ETag") != "v1" {
+		t.Errorf("whitelisted header not returned: %v", resp.HttpHeaders)
+	}
+	for _, name := range []string{"Set-Cookie", "Server", "X-Custom", "Content-Length"} {
+		if _, ok := resp.HttpHeaders[name]; ok {
+			t.Errorf("%s returned to the client", name)
+		}
+	}
+	if resp.HttpContentType != "application/json" {
+		t.Errorf("unexpected content type %q", resp.HttpContentType)
+	}
+}
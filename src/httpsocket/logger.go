@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Структурированный лог с уровнями.
+//
+// Формат задается -log-format:
+//
+// * text (по умолчанию) - строки "LEVEL [адрес клиента]: сообщение", как раньше;
+// * json - по JSON-объекту на строку: {"time": ..., "level": "warn", "msg": ..., поля...};
+// * logfmt - строки вида time=... level=warn msg="..." поле=значение.
+//
+// Уровень (-log-level: debug, info, warn, error) можно менять без перезапуска - через
+// файл настроек (см. config.go) или запросом POST /admin/loglevel?level=debug.
+//
+// Сообщения о клиенте содержат поля remote_addr, real_ip, conn_id (и user_id для
+// аутентифицированных клиентов), сообщения об RPC-запросе - еще rpc_id, request_id,
+// method, url и upstream.
+
+type LogLevel int32
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if l < LevelDebug || l > LevelError {
+		return strconv.Itoa(int(l))
+	}
+	return logLevelNames[l]
+}
+
+// Разобрать имя уровня
+func ParseLogLevel(s string) (LogLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q, expected one of %s", s, strings.Join(logLevelNames, ", "))
+}
+
+const (
+	LogFormatText   = "text"
+	LogFormatJson   = "json"
+	LogFormatLogfmt = "logfmt"
+)
+
+// Разобрать имя формата
+func ParseLogFormat(s string) (string, error) {
+	switch s {
+	case LogFormatText, LogFormatJson, LogFormatLogfmt:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown log format %q, expected text, json or logfmt", s)
+}
+
+// Поле структурированного сообщения
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+// Собрать поля из пар ключ, значение
+func Fields(kv ...interface{}) []LogField {
+	fields := make([]LogField, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		fields = append(fields, LogField{Key: fmt.Sprint(kv[i]), Value: kv[i+1]})
+	}
+	return fields
+}
+
+type Logger struct {
+	level int32 // atomic
+
+	lock   sync.Mutex
+	format string
+}
+
+var (
+	logger = &Logger{level: int32(LevelInfo), format: LogFormatText}
+)
+
+func (l *Logger) Level() LogLevel {
+	return LogLevel(atomic.LoadInt32(&l.level))
+}
+
+func (l *Logger) SetLevel(level LogLevel) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+func (l *Logger) Format() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.format
+}
+
+func (l *Logger) SetFormat(format string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.format = format
+}
+
+// Будут ли записаны сообщения уровня level?
+func (l *Logger) Enabled(level LogLevel) bool {
+	return level >= l.Level()
+}
+
+// Записать сообщение
+func (l *Logger) Log(level LogLevel, fields []LogField, format string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	switch l.format {
+	case LogFormatJson:
+		os.Stderr.Write(formatJsonLogLine(time.Now(), level, msg, fields))
+	case LogFormatLogfmt:
+		os.Stderr.Write(formatLogfmtLine(time.Now(), level, msg, fields))
+	default:
+		prefix := strings.ToUpper(level.String())
+		for _, f := range fields {
+			if f.Key == "remote_addr" {
+				prefix += fmt.Sprintf(" [%v]", f.Value)
+			}
+		}
+		log.Printf("%s: %s", prefix, msg)
+	}
+}
+
+func formatJsonLogLine(t time.Time, level LogLevel, msg string, fields []LogField) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, `{"time":%q,"level":%q,"msg":%s`, t.Format(time.RFC3339Nano), level, jsonLogValue(msg))
+	for _, f := range fields {
+		fmt.Fprintf(buf, `,%s:%s`, jsonLogValue(f.Key), jsonLogValue(f.Value))
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+// JSON без экранирования <, > и & (лог не встраивается в HTML)
+func jsonLogValue(v interface{}) []byte {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return jsonLogValue(fmt.Sprint(v))
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n")
+}
+
+func formatLogfmtLine(t time.Time, level LogLevel, msg string, fields []LogField) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "time=%s level=%s msg=%s", t.Format(time.RFC3339Nano), level, logfmtValue(msg))
+	for _, f := range fields {
+		fmt.Fprintf(buf, " %s=%s", f.Key, logfmtValue(fmt.Sprint(f.Value)))
+	}
+	buf.WriteString("\n")
+	return buf.Bytes()
+}
+
+// Значение logfmt: в кавычках, если в нем есть пробелы, кавычки или знак равенства
+func logfmtValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\\\t\r\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// Сообщения без привязки к клиенту
+func logErrorf(fields []LogField, format string, args ...interface{}) {
+	logger.Log(LevelError, fields, format, args...)
+}
+
+func logWarnf(fields []LogField, format string, args ...interface{}) {
+	logger.Log(LevelWarn, fields, format, args...)
+}
+
+func logInfof(fields []LogField, format string, args ...interface{}) {
+	logger.Log(LevelInfo, fields, format, args...)
+}
+
+// Поля, описывающие клиента
+func (c *ProxyClient) logFields() []LogField {
+	realIp, _ := c.clientAddress()
+	fields := Fields("remote_addr", c.originalRequest.RemoteAddr, "real_ip", realIp, "conn_id", c.id)
+	if c.identity != nil {
+		fields = append(fields, LogField{"user_id", c.identity.UserId})
+	}
+	return fields
+}
+
+// Поля, описывающие клиента и его запрос rq
+func (c *ProxyClient) requestLogFields(rq *JsonRpcRequest) []LogField {
+	fields := c.logFields()
+	if rq == nil {
+		return fields
+	}
+	if rq.Id != nil {
+		fields = append(fields, LogField{"rpc_id", rq.Id})
+	}
+	info := &rq.logInfo
+	for _, f := range []LogField{{"request_id", info.requestId}, {"method", info.method}, {"url", info.url}, {"upstream", info.upstream}} {
+		if f.Value != "" {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// Сведения о запросе для лога, заполняются по мере обработки
+type requestLogInfo struct {
+	requestId     string // X-Request-ID запроса к апстриму
+	method        string
+	url           string
+	upstream      string
+	upstreamHost  string // экземпляр апстрима, в который ушел запрос
+	status        int    // статус ответа апстрима
+	responseBytes int
+	upstreamTime  time.Duration
+	errCode       int // код ошибки, отправленной клиенту
+	cache         string
+}
+
+// Залогировать сообщение о запросе rq
+func (c *ProxyClient) logRequestf(level LogLevel, rq *JsonRpcRequest, format string, args ...interface{}) {
+	if logger.Enabled(level) {
+		logger.Log(level, c.requestLogFields(rq), format, args...)
+	}
+}
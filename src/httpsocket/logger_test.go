@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogLevels(t *testing.T) {
+	for _, s := range []string{"debug", "INFO", "Warn", "error"} {
+		level, err := ParseLogLevel(s)
+		if err != nil || level.String() != strings.ToLower(s) {
+			t.Errorf("%s: got %s, %v", s, level, err)
+		}
+	}
+	if _, err := ParseLogLevel("trace"); err == nil {
+		t.Error("unknown level accepted")
+	}
+	if _, err := ParseLogFormat("xml"); err == nil {
+		t.Error("unknown format accepted")
+	}
+
+	l := &Logger{}
+	l.SetLevel(LevelWarn)
+	if l.Enabled(LevelInfo) || !l.Enabled(LevelWarn) || !l.Enabled(LevelError) {
+		t.Error("warn level: wrong levels enabled")
+	}
+}
+
+func TestLogFormats(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fields := Fields("remote_addr", "192.0.2.1:5000", "conn_id", 7, "url", "/a?b=<c>&d", "odd")
+
+	line := formatJsonLogLine(now, LevelWarn, `upstream "api" failed`, fields)
+	if !strings.HasSuffix(string(line), "}\n") || strings.Count(string(line), "\n") != 1 {
+		t.Errorf("json: not a single line: %q", line)
+	}
+	parsed := map[string]interface{}{}
+	if err := json.Unmarshal(line, &parsed); err != nil {
+		t.Fatalf("json: malformed line %q: %s", line, err)
+	}
+	expected := map[string]interface{}{
+		"time": "2020-01-02T03:04:05Z", "level": "warn", "msg": `upstream "api" failed`,
+		"remote_addr": "192.0.2.1:5000", "conn_id": 7.0, "url": "/a?b=<c>&d",
+	}
+	for key, value := range expected {
+		if parsed[key] != value {
+			t.Errorf("json: %s = %v, expected %v", key, parsed[key], value)
+		}
+	}
+	if len(parsed) != len(expected) || !strings.Contains(string(line), `<c>&d`) {
+		t.Errorf("json: unexpected line %s", line)
+	}
+
+	line = formatLogfmtLine(now, LevelError, "request failed\nagain", Fields("conn_id", 7, "method", "", "url", "/a b"))
+	if string(line) != `time=2020-01-02T03:04:05Z level=error msg="request failed\nagain" conn_id=7 method="" url="/a b"`+"\n" {
+		t.Errorf("logfmt: got %q", line)
+	}
+}
+
+func TestRequestLogFields(t *testing.T) {
+	c := &ProxyClient{originalRequest: httptest.NewRequest("GET", "/ws", nil), id: 3, identity: &Identity{UserId: "u1"}}
+	rq := &JsonRpcRequest{Id: 5.0}
+	rq.logInfo.method = "GET"
+	rq.logInfo.upstream = "api"
+	keys := []string{}
+	for _, f := range c.requestLogFields(rq) {
+		keys = append(keys, f.Key)
+	}
+	if strings.Join(keys, ",") != "remote_addr,real_ip,conn_id,user_id,rpc_id,method,upstream" {
+		t.Errorf("got fields %v", keys)
+	}
+}
+
+func TestServeLogLevel(t *testing.T) {
+	defer logger.SetLevel(logger.Level())
+	cases := []struct {
+		method, query string
+		status        int
+		level         string
+	}{
+		{"POST", "level=debug", http.StatusOK, "debug"},
+		{"GET", "level=error", http.StatusOK, "debug"},
+		{"POST", "level=verbose", http.StatusBadRequest, "debug"},
+		{"POST", "level=WARN", http.StatusOK, "warn"},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		serveLogLevel(w, httptest.NewRequest(c.method, "/admin/loglevel?"+c.query, nil))
+		if w.Code != c.status || logger.Level().String() != c.level {
+			t.Errorf("%s %s: got status %d and level %s", c.method, c.query, w.Code, logger.Level())
+		}
+	}
+}
@@ -1,27 +1,88 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"strings"
+	"time"
 )
 
 var (
+	configFile                          = flag.String("config", "", "path to a JSON file with settings (keys are flag names); reloaded on SIGHUP and POST /admin/reload")
 	listenAddr                          = flag.String("listen", ":6066", "host:port to listen on")
-	defaultHost                         = flag.String("default-host", "", "if not empty, requests without specified host will be proxied to this host")
+	adminListenAddr                     = flag.String("admin-listen", "", "if not empty, host:port to serve admin endpoints on (e.g. /admin/upstreams) and Prometheus metrics on /metrics")
+	defaultHost                         = flag.String("default-host", "", "if not empty, requests without specified host which match no route will be proxied to this host")
+	routesFile                          = flag.String("routes", "", "path to a JSON file with upstreams and routes for requests without specified host")
 	defaultTimeout                      = flag.Int("timeout-seconds", 60, "timeout for proxied HTTP requests, in seconds")
-	upstreamHostWhitelist               = flag.String("upstream-host-whitelist", "", "comma-separated list of allowed upstream hosts")
-	originWhitelist                     = flag.String("origin-whitelist", "", "comma-separated list of allowed origin hosts (suffixes)")
+	methodTimeouts                      = flag.String("method-timeouts", "", "comma-separated list of METHOD=DURATION pairs overriding -timeout-seconds for specific HTTP methods, e.g. GET=10s,POST=1m")
+	pathTimeouts                        = flag.String("path-timeouts", "", "comma-separated list of PATH_PREFIX=DURATION pairs overriding timeouts for requests whose path (as requested by the client, before any route rewriting) starts with the prefix, e.g. /mobileapi/catalogue/=5s (the longest prefix wins)")
+	maxClientTimeoutMs                  = flag.Int("max-client-timeout-ms", 0, "upper limit for timeout_ms supplied by clients in requests; if 0, clients may only shorten the configured timeout")
+	retryMaxAttempts                    = flag.Int("retry-max-attempts", 1, "maximum number of attempts for idempotent upstream requests (GET, HEAD, OPTIONS); 1 disables retries")
+	retryBackoffMs                      = flag.Int("retry-backoff-ms", 100, "initial pause between retry attempts, in milliseconds (doubled after each attempt, with jitter)")
+	retryMaxBackoffMs                   = flag.Int("retry-max-backoff-ms", 2000, "maximum pause between retry attempts, in milliseconds")
+	retryStatuses                       = flag.String("retry-statuses", "502,503,504", "comma-separated list of upstream HTTP statuses which cause a retry")
+	retryPutDelete                      = flag.Bool("retry-put-delete", false, "also retry PUT and DELETE requests")
+	breakerErrorRate                    = flag.Int("breaker-error-rate", 0, "if greater than 0, open the circuit breaker of an upstream when this percentage of its requests fail (network errors, timeouts, 502/503/504)")
+	breakerSlowRate                     = flag.Int("breaker-slow-rate", 0, "if greater than 0, open the circuit breaker of an upstream when this percentage of its requests are slower than -breaker-slow-threshold-ms")
+	breakerSlowThresholdMs              = flag.Int("breaker-slow-threshold-ms", 5000, "response time above which an upstream request counts as slow for the circuit breaker")
+	breakerMinRequests                  = flag.Int("breaker-min-requests", 20, "minimum number of requests within the window before the circuit breaker may open")
+	breakerWindowSeconds                = flag.Int("breaker-window-seconds", 10, "length of the window in which the circuit breaker counts failures, in seconds")
+	breakerOpenSeconds                  = flag.Int("breaker-open-seconds", 30, "how long an open circuit breaker fails requests before letting probe requests through, in seconds")
+	breakerHalfOpenRequests             = flag.Int("breaker-half-open-requests", 1, "number of probe requests let through a half-open circuit breaker; all of them must succeed to close it")
+	cacheSizeMb                         = flag.Int("cache-size-mb", 0, "if greater than 0, cache upstream responses to GET requests in memory, up to this total size in megabytes")
+	cacheMaxEntryKb                     = flag.Int("cache-max-entry-kb", 1024, "responses larger than this size in kilobytes are not cached")
+	coalesceGetRequests                 = flag.Bool("coalesce-get-requests", false, "share one upstream request between identical concurrent GET requests from the same client IP (can be overridden per route; set `coalesce_across_ips` in a route to share requests of different IPs)")
+	cookieJarSeedCookies                = flag.String("cookie-jar-seed-cookies", "", "comma-separated list of cookie names (`*` suffix matches a prefix) copied from the websocket handshake request into the cookie jar of upstreams with cookie_jar enabled")
+	authJwtSecretFile                   = flag.String("auth-jwt-secret-file", "", "if set, clients must present a JWT signed with HMAC using the secret from this file")
+	authJwtIssuer                       = flag.String("auth-jwt-issuer", "", "if set, the iss claim of client JWTs must be equal to this value")
+	authJwtAudience                     = flag.String("auth-jwt-audience", "", "if set, the aud claim of client JWTs must contain this value")
+	authTokenFile                       = flag.String("auth-token-file", "", "if set, clients may present one of the opaque tokens listed in this file (lines of `<token> <user id> [scope,scope]`)")
+	authOptional                        = flag.Bool("auth-optional", false, "let clients without a token connect anonymously (invalid tokens are still rejected)")
+	authQueryParam                      = flag.String("auth-query-param", "access_token", "query parameter with the client token (empty to disable)")
+	authCookie                          = flag.String("auth-cookie", "", "cookie with the client token (empty to disable)")
+	authProtocolPrefix                  = flag.String("auth-protocol-prefix", "bearer.", "prefix of a Sec-WebSocket-Protocol value carrying the client token (empty to disable)")
+	authUserHeader                      = flag.String("auth-user-header", "X-Auth-User-Id", "trusted header with the authenticated user id sent to upstreams")
+	authScopesHeader                    = flag.String("auth-scopes-header", "X-Auth-Scopes", "trusted header with space-separated scopes of the authenticated user sent to upstreams")
+	trustedProxies                      = flag.String("trusted-proxies", "", "comma-separated list of networks (CIDR) or addresses of reverse proxies whose Forwarded, X-Forwarded-For, X-Forwarded-Proto and X-Real-IP headers are trusted")
+	upstreamHostWhitelist               = flag.String("upstream-host-whitelist", "", "comma-separated list of allowed upstream hosts: host:port allows that port, a plain host allows only the default port of the scheme (80 for http, 443 for https); `*` wildcards allowed")
+	upstreamRulesFile                   = flag.String("upstream-rules", "", "path to a JSON file with rules allowing or denying upstreams for requests with specified host")
+	originWhitelist                     = flag.String("origin-whitelist", "", "comma-separated list of allowed origins: host matches exactly that host, *.domain matches its subdomains (e.g. example.com,*.example.com); optionally with scheme:// and :port")
+	originMissing                       = flag.String("origin-missing", OriginAllow, "whether to let clients without Origin header connect when origin whitelist is set (allow or deny)")
+	originNull                          = flag.String("origin-null", OriginDeny, "whether to let clients with `Origin: null` connect when origin whitelist is set (allow or deny)")
+	clientHeaderWhitelist               = flag.String("client-header-whitelist", "Accept,Accept-Language,Authorization,If-Match,If-Modified-Since,If-None-Match,X-App-*", "comma-separated list of headers clients may pass to upstream (`*` suffix matches a prefix); if empty, any header not in blacklist is allowed")
+	clientHeaderBlacklist               = flag.String("client-header-blacklist", "Cookie", "comma-separated list of headers clients may never pass to upstream (`*` suffix matches a prefix)")
+	sessionHeaderWhitelist              = flag.String("session-header-whitelist", "Accept,Accept-Language,Authorization,X-App-*", "comma-separated list of headers clients may store in the session with httpsocket.setheaders (`*` suffix matches a prefix); if empty, any header not in blacklist is allowed")
+	sessionHeaderBlacklist              = flag.String("session-header-blacklist", "Cookie", "comma-separated list of headers clients may never store in the session (`*` suffix matches a prefix)")
+	responseHeaderWhitelist             = flag.String("response-header-whitelist", "Allow,Cache-Control,Content-Language,ETag,Expires,Last-Modified,Link,Location,Retry-After,Vary", "comma-separated list of upstream response headers returned to clients in http_headers (`*` suffix matches a prefix); if empty, any header not in blacklist is returned")
+	responseHeaderBlacklist             = flag.String("response-header-blacklist", "Set-Cookie,Server,X-Powered-By", "comma-separated list of upstream response headers never returned to clients (`*` suffix matches a prefix)")
 	fakeUpstreamResponseTimeMs          = flag.Int("fake-upstream-response-time-ms", 0, "if greater than 0, instead of actually proxying requests, sleep for specified duration in milliseconds before returning a 502 Bad Gateway response")
-	throttleRps = flag.Int("throttle-rps", 0, "if greater than 0, total RPS will be limited to specified number (by blocking all clients for the remainder of current second once the limit is reached)")
-	throttleConcurrentRequests = flag.Int("throttle-concurrent-requests", 0, "if greater than 0, number of concurrent (in-flight) requests will be limited to specified number (by blocking all clients for the remainder of current second once the limit is reached)")
-	throttleRpsPerClient                = flag.Int("throttle-rps-per-client", 50, "if greater than 0, RPS per client will be limited to specified number (by blocking for the remainder of current second once the limit is reached)")
-	throttleConcurrentRequestsPerClient = flag.Int("throttle-concurrent-requests-per-client", 10, "if greater than 0, number of concurrent (in-flight) requests per client will be limited to specified number (by blocking for the remainder of current second once the limit is reached)")
+	throttleRps                         = flag.Float64("throttle-rps", 0, "if greater than 0, total RPS will be limited to specified number (requests over the limit wait for a token bucket to refill)")
+	throttleBurst                       = flag.Int("throttle-burst", 0, "how many requests over -throttle-rps may pass at once after a quiet period (0 means equal to the RPS limit)")
+	throttleRpsPerClient                = flag.Float64("throttle-rps-per-client", 50, "if greater than 0, RPS per client connection will be limited to specified number")
+	throttleBurstPerClient              = flag.Int("throttle-burst-per-client", 0, "burst size for -throttle-rps-per-client (0 means equal to the RPS limit)")
+	throttleRpsPerIp                    = flag.Float64("throttle-rps-per-ip", 0, "if greater than 0, RPS of all connections from one client IP will be limited to specified number")
+	throttleBurstPerIp                  = flag.Int("throttle-burst-per-ip", 0, "burst size for -throttle-rps-per-ip (0 means equal to the RPS limit)")
+	throttleRpsPerRoute                 = flag.Float64("throttle-rps-per-route", 0, "if greater than 0, RPS of requests through each route of the routing table will be limited to specified number (unless the route sets its own `rps`)")
+	throttleBurstPerRoute               = flag.Int("throttle-burst-per-route", 0, "burst size for -throttle-rps-per-route (0 means equal to the RPS limit)")
+	throttleConcurrentRequests          = flag.Int("throttle-concurrent-requests", 0, "if greater than 0, number of concurrent (in-flight) requests will be limited to specified number (requests over the limit wait for others to finish)")
+	throttleConcurrentRequestsPerClient = flag.Int("throttle-concurrent-requests-per-client", 10, "if greater than 0, number of concurrent (in-flight) requests per client will be limited to specified number (requests over the limit wait for others to finish)")
+	throttleMaxPendingPerClient         = flag.Int("throttle-max-pending-per-client", 100, "if greater than 0, stop reading messages of a client connection while it has this many unfinished (waiting or running) requests")
+	throttlePolicy                      = flag.String("throttle-policy", ThrottleBlock, "what to do with requests over the throttling limits: block (wait as long as needed), queue (wait up to -throttle-max-wait-ms, then reject) or reject (reject right away with a retry_after_ms hint)")
+	throttleMaxWaitMs                   = flag.Int("throttle-max-wait-ms", 1000, "how long a request may wait for the throttling limits with -throttle-policy queue, in milliseconds")
+	throttleCloseAfterRejects           = flag.Int("throttle-close-after-rejects", 0, "if greater than 0, close the websocket with a policy violation after this many of its requests are rejected for exceeding per-client limits within -throttle-reject-window-seconds")
+	throttleRejectWindowSeconds         = flag.Int("throttle-reject-window-seconds", 10, "length of the window in which rejected requests are counted for -throttle-close-after-rejects, in seconds")
 	logConnections                      = flag.Bool("log-connections", false, "log connection opening/closing")
 	logClientIoErrors                   = flag.Bool("log-client-io-errors", false, "log input/output errors on client sockets")
-	debug                               = flag.Bool("debug", false, "enable more detailed logging")
+	debug                               = flag.Bool("debug", false, "enable more detailed logging (same as -log-level debug)")
+	logLevel                            = flag.String("log-level", "info", "minimum level of logged messages: debug, info, warn or error (can be changed at runtime with POST /admin/loglevel?level=...)")
+	logFormat                           = flag.String("log-format", LogFormatText, "log format: text, json or logfmt")
+	accessLogPath                       = flag.String("access-log", "", "if not empty, write a line for every proxied request to this file (`-` for stdout); the file is reopened on SIGUSR1")
+	accessLogFormat                     = flag.String("access-log-format", AccessLogFormatJson, "access log format: json or combined (nginx-like)")
+	accessLogSampleRate                 = flag.Float64("access-log-sample-rate", 1, "fraction of successful requests written to the access log (failed requests are always written)")
 )
 
 // Оборачиваем хендлер-функцию в стандартные миддлвари
@@ -31,14 +92,24 @@ func httpHandleFunc(url string, handler func(http.ResponseWriter, *http.Request)
 	http.HandleFunc(url, handler)
 }
 
+// Мультиплексор служебных обработчиков, доступных на -admin-listen
+var adminMux = http.NewServeMux()
+
+// Оборачиваем служебную хендлер-функцию в стандартные миддлвари
+func adminHandleFunc(url string, handler func(http.ResponseWriter, *http.Request)) {
+	handler = panicCatcherMiddleware(handler)
+
+	adminMux.HandleFunc(url, handler)
+}
+
 // Перехват паник и вывод трейсбеков
 func panicCatcherMiddleware(next func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
 	return func(rw http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if x := recover(); x != nil {
 				stack := GetTraceback()
-				errinfo := fmt.Sprintf("ERROR: PANIC: %s\n%s", x, stack)
-				log.Printf("%s", errinfo)
+				errinfo := fmt.Sprintf("PANIC: %s\n%s", x, stack)
+				logErrorf(nil, "%s", errinfo)
 				http.Error(rw, errinfo, 500)
 			}
 		}()
@@ -46,31 +117,220 @@ func panicCatcherMiddleware(next func(http.ResponseWriter, *http.Request)) func(
 	}
 }
 
+// Собрать параметры прокси из настроек (см. config.go)
+func NewProxyParams(s Settings) (*ProxyParams, error) {
+	r := &settingsReader{s: s}
+	params := &ProxyParams{
+		Routing:       &RoutingTable{},
+		UpstreamRules: &UpstreamRuleSet{},
+	}
+	var err error
+	if routes := r.String("routes"); isInlineJson(routes) {
+		params.Routing, err = ParseRoutingTable([]byte(routes))
+	} else if routes != "" {
+		params.Routing, err = LoadRoutingTable(routes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("-routes: %s", err)
+	}
+	if host := r.String("default-host"); host != "" {
+		if err := params.Routing.AddDefaultHost(host); err != nil {
+			return nil, fmt.Errorf("-default-host: %s", err)
+		}
+	}
+	if rules := r.String("upstream-rules"); isInlineJson(rules) {
+		params.UpstreamRules, err = ParseUpstreamRules([]byte(rules))
+	} else if rules != "" {
+		params.UpstreamRules, err = LoadUpstreamRules(rules)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("-upstream-rules: %s", err)
+	}
+	if err := params.UpstreamRules.AddHostWhitelist(SplitCommaList(r.String("upstream-host-whitelist"))); err != nil {
+		return nil, fmt.Errorf("-upstream-host-whitelist: %s", err)
+	}
+	originRules, err := ParseOriginRules(r.String("origin-whitelist"))
+	if err != nil {
+		return nil, fmt.Errorf("-origin-whitelist: %s", err)
+	}
+	params.Origins = OriginPolicy{Rules: originRules}
+	params.Origins.AllowMissing, err = ParseOriginAction(r.String("origin-missing"))
+	if err != nil {
+		return nil, fmt.Errorf("-origin-missing: %s", err)
+	}
+	params.Origins.AllowNull, err = ParseOriginAction(r.String("origin-null"))
+	if err != nil {
+		return nil, fmt.Errorf("-origin-null: %s", err)
+	}
+	params.TrustedProxies, err = ParseCidrList(r.String("trusted-proxies"))
+	if err != nil {
+		return nil, fmt.Errorf("-trusted-proxies: %s", err)
+	}
+	params.Timeouts = TimeoutPolicy{
+		Default:  time.Duration(r.Int("timeout-seconds")) * time.Second,
+		ByMethod: map[string]time.Duration{},
+		Max:      time.Duration(r.Int("max-client-timeout-ms")) * time.Millisecond,
+	}
+	byMethod, err := ParseTimeoutList(r.String("method-timeouts"))
+	if err != nil {
+		return nil, fmt.Errorf("-method-timeouts: %s", err)
+	}
+	for _, kt := range byMethod {
+		params.Timeouts.ByMethod[strings.ToUpper(kt.Key)] = kt.Timeout
+	}
+	params.Timeouts.ByPathPrefix, err = ParseTimeoutList(r.String("path-timeouts"))
+	if err != nil {
+		return nil, fmt.Errorf("-path-timeouts: %s", err)
+	}
+	params.Retries = RetryPolicy{
+		MaxAttempts:    r.Int("retry-max-attempts"),
+		BaseBackoff:    time.Duration(r.Int("retry-backoff-ms")) * time.Millisecond,
+		MaxBackoff:     time.Duration(r.Int("retry-max-backoff-ms")) * time.Millisecond,
+		RetryPutDelete: r.Bool("retry-put-delete"),
+	}
+	params.Retries.RetryableStatuses, err = ParseStatusList(r.String("retry-statuses"))
+	if err != nil {
+		return nil, fmt.Errorf("-retry-statuses: %s", err)
+	}
+	params.Breakers = BreakerPolicy{
+		Window:           time.Duration(r.Int("breaker-window-seconds")) * time.Second,
+		MinRequests:      r.Int("breaker-min-requests"),
+		ErrorRatePercent: r.Int("breaker-error-rate"),
+		SlowThreshold:    time.Duration(r.Int("breaker-slow-threshold-ms")) * time.Millisecond,
+		SlowRatePercent:  r.Int("breaker-slow-rate"),
+		OpenDuration:     time.Duration(r.Int("breaker-open-seconds")) * time.Second,
+		HalfOpenRequests: r.Int("breaker-half-open-requests"),
+	}
+	params.CoalesceGetRequests = r.Bool("coalesce-get-requests")
+	params.Auth = AuthPolicy{
+		Optional:       r.Bool("auth-optional"),
+		QueryParam:     r.String("auth-query-param"),
+		CookieName:     r.String("auth-cookie"),
+		ProtocolPrefix: r.String("auth-protocol-prefix"),
+		UserIdHeader:   r.String("auth-user-header"),
+		ScopesHeader:   r.String("auth-scopes-header"),
+	}
+	authenticators := AuthenticatorChain{}
+	if filename := r.String("auth-jwt-secret-file"); filename != "" {
+		secret, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("-auth-jwt-secret-file: %s", err)
+		}
+		authenticators = append(authenticators, &JwtAuthenticator{
+			Secret:   bytes.TrimSpace(secret),
+			Issuer:   r.String("auth-jwt-issuer"),
+			Audience: r.String("auth-jwt-audience"),
+		})
+	}
+	if filename := r.String("auth-token-file"); filename != "" {
+		tokens, err := LoadTokenFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("-auth-token-file: %s", err)
+		}
+		authenticators = append(authenticators, tokens)
+	}
+	if len(authenticators) > 0 {
+		params.Auth.Authenticator = authenticators
+	}
+	params.CookieJarSeedCookies = SplitCommaList(r.String("cookie-jar-seed-cookies"))
+	params.ClientHeaderPolicy = NewClientHeaderPolicy(SplitCommaList(r.String("client-header-whitelist")), SplitCommaList(r.String("client-header-blacklist")))
+	params.SessionHeaderPolicy = NewClientHeaderPolicy(SplitCommaList(r.String("session-header-whitelist")), SplitCommaList(r.String("session-header-blacklist")))
+	params.ResponseHeaderPolicy = NewResponseHeaderPolicy(SplitCommaList(r.String("response-header-whitelist")), SplitCommaList(r.String("response-header-blacklist")))
+	params.Throttle = ThrottlePolicy{
+		Global:                      RateLimit{Rps: r.Float("throttle-rps"), Burst: r.Int("throttle-burst")},
+		PerClient:                   RateLimit{Rps: r.Float("throttle-rps-per-client"), Burst: r.Int("throttle-burst-per-client")},
+		PerIp:                       RateLimit{Rps: r.Float("throttle-rps-per-ip"), Burst: r.Int("throttle-burst-per-ip")},
+		PerRoute:                    RateLimit{Rps: r.Float("throttle-rps-per-route"), Burst: r.Int("throttle-burst-per-route")},
+		ConcurrentRequests:          r.Int("throttle-concurrent-requests"),
+		ConcurrentRequestsPerClient: r.Int("throttle-concurrent-requests-per-client"),
+		MaxPendingPerClient:         r.Int("throttle-max-pending-per-client"),
+		MaxWait:                     time.Duration(r.Int("throttle-max-wait-ms")) * time.Millisecond,
+		CloseAfterRejects:           r.Int("throttle-close-after-rejects"),
+		RejectWindow:                time.Duration(r.Int("throttle-reject-window-seconds")) * time.Second,
+	}
+	params.Throttle.Mode, err = ParseThrottleMode(r.String("throttle-policy"))
+	if err != nil {
+		return nil, fmt.Errorf("-throttle-policy: %s", err)
+	}
+	params.FakeUpstreamResponse = time.Duration(r.Int("fake-upstream-response-time-ms")) * time.Millisecond
+	params.LogConnections = r.Bool("log-connections")
+	params.LogClientIoErrors = r.Bool("log-client-io-errors")
+	params.LogLevel, err = ParseLogLevel(r.String("log-level"))
+	if err != nil {
+		return nil, fmt.Errorf("-log-level: %s", err)
+	}
+	if r.Bool("debug") {
+		params.LogLevel = LevelDebug
+	}
+	params.LogFormat, err = ParseLogFormat(r.String("log-format"))
+	if err != nil {
+		return nil, fmt.Errorf("-log-format: %s", err)
+	}
+	params.AccessLog = AccessLogSettings{
+		Path:       r.String("access-log"),
+		Format:     r.String("access-log-format"),
+		SampleRate: r.Float("access-log-sample-rate"),
+	}
+	if err := params.AccessLog.Validate(); err != nil {
+		return nil, fmt.Errorf("-access-log: %s", err)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return params, nil
+}
+
 func main() {
 	flag.Parse()
 
-	initHttpClient(*defaultTimeout)
-
-	proxy := &WsProxy{
-		params: ProxyParams{
-			DefaultHost:              *defaultHost,
-			WhitelistedUpstreamHosts: []string{},
-			WhitelistedOrigins:       []string{},
-		},
+	settings, err := LoadSettings(*configFile)
+	if err != nil {
+		log.Fatalf("-config: %s", err)
+	}
+	params, err := NewProxyParams(settings)
+	if err != nil {
+		log.Fatal(err)
 	}
-	if *upstreamHostWhitelist != "" {
-		proxy.params.WhitelistedUpstreamHosts = strings.Split(*upstreamHostWhitelist, ",")
+	r := &settingsReader{s: settings}
+	initHttpClient(params.Timeouts.Default)
+	initResponseCache(r.Int("cache-size-mb"), r.Int("cache-max-entry-kb"))
+	if r.err != nil {
+		log.Fatal(r.err)
 	}
-	if *originWhitelist != "" {
-		proxy.params.WhitelistedOrigins = strings.Split(*originWhitelist, ",")
+
+	logger.SetLevel(params.LogLevel)
+	logger.SetFormat(params.LogFormat)
+	if err := accessLog.Configure(params.AccessLog); err != nil {
+		log.Fatalf("-access-log: %s", err)
 	}
 
+	proxy := &WsProxy{params: params, settings: settings, configFile: *configFile, limiters: NewLimiters(systemClock{})}
+
 	httpHandleFunc("/", handleFrontpage)
 	httpHandleFunc("/ws", proxy.ServeWebsocket)
 	httpHandleFunc("/jsonrpc", proxy.ServeHttp)
 
+	adminHandleFunc("/admin/upstreams", proxy.ServeUpstreamsStatus)
+	adminHandleFunc("/admin/breakers", serveBreakersStatus)
+	adminHandleFunc("/admin/origins", serveRejectedOrigins)
+	adminHandleFunc("/admin/reload", proxy.ServeReload)
+	adminHandleFunc("/metrics", serveMetrics)
+	adminHandleFunc("/stats", serveStats)
+	adminHandleFunc("/admin/loglevel", serveLogLevel)
+
 	go globalStatCounter.TickingLoop()
+	go proxy.ReloadOnSignal()
+	go accessLog.ReopenOnSignal()
+	params.Routing.StartHealthChecks()
+
+	listen, adminListen := settings["listen"], settings["admin-listen"]
+	if adminListen != "" {
+		go func() {
+			logInfof(nil, "Serving admin endpoints on %s...", adminListen)
+			log.Fatal(http.ListenAndServe(adminListen, adminMux))
+		}()
+	}
 
-	log.Printf("Listening on %s...", *listenAddr)
-	log.Fatal(http.ListenAndServe(*listenAddr, nil))
+	logInfof(nil, "Listening on %s...", listen)
+	log.Fatal(http.ListenAndServe(listen, nil))
 }
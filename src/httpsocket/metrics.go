@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Метрики в текстовом формате Prometheus (/metrics на -admin-listen).
+//
+// Отдаются:
+//
+// * накопленные с запуска значения счетчиков globalStatCounter (попытки подключения,
+//   соединения, притормаживания, запросы, ответы и т.д.) и текущие значения активных
+//   соединений и запросов;
+// * гистограмма времени ответа апстримов и число ответов по кодам статуса - в разрезе
+//   HTTP-метода и апстрима: имени апстрима из таблицы маршрутизации, а для запросов по
+//   явному адресу - разрешившего их правила или "(direct)" (см. upstream_rules.go); хосты,
+//   выбранные клиентом, в метки не попадают, чтобы их число не росло без ограничений;
+// * число байт в телах запросов к апстримам и их ответов.
+//
+// Запросы, не дошедшие до апстрима (выключатель разомкнут, ответ из кеша), в метрики
+// апстримов не попадают. Неудачные обращения учитываются с code="error", "timeout" или
+// "canceled" вместо кода статуса.
+
+// Границы корзин гистограммы времени ответа апстрима, в секундах
+var upstreamDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Гистограмма с фиксированными корзинами
+type Histogram struct {
+	bounds []float64
+	counts []int64 // counts[i] - число значений <= bounds[i] (не накопительно); последний - +Inf
+	count  int64
+	sumNs  int64
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+}
+
+// Учесть длительность d
+func (h *Histogram) Observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(h.bounds, seconds)
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.count, 1)
+	atomic.AddInt64(&h.sumNs, int64(d))
+}
+
+// Метрики одного метода одного апстрима
+type upstreamMetricSet struct {
+	method        string
+	upstream      string
+	durations     *Histogram
+	requestBytes  int64
+	responseBytes int64
+
+	lock  sync.Mutex
+	codes map[string]int64
+}
+
+// Метрики апстримов по методу и апстриму
+type UpstreamMetrics struct {
+	lock sync.Mutex
+	sets map[string]*upstreamMetricSet
+}
+
+var (
+	upstreamMetrics = &UpstreamMetrics{sets: map[string]*upstreamMetricSet{}}
+)
+
+// Учесть обращение к апстриму: code - код статуса или вид ошибки, requestBytes и
+// responseBytes - размеры тел запроса и ответа
+func (um *UpstreamMetrics) Observe(method, upstream, code string, d time.Duration, requestBytes, responseBytes int) {
+	key := method + " " + upstream
+	um.lock.Lock()
+	set, ok := um.sets[key]
+	if !ok {
+		set = &upstreamMetricSet{
+			method:    method,
+			upstream:  upstream,
+			durations: NewHistogram(upstreamDurationBuckets),
+			codes:     map[string]int64{},
+		}
+		um.sets[key] = set
+	}
+	um.lock.Unlock()
+
+	set.durations.Observe(d)
+	atomic.AddInt64(&set.requestBytes, int64(requestBytes))
+	atomic.AddInt64(&set.responseBytes, int64(responseBytes))
+	set.lock.Lock()
+	set.codes[code]++
+	set.lock.Unlock()
+}
+
+// Метка code для неудачного обращения к апстриму
+func upstreamErrorCodeLabel(errCode int) string {
+	switch errCode {
+	case ErrCodeGatewayTimeout:
+		return "timeout"
+	case ErrCodeCanceled:
+		return "canceled"
+	}
+	return "error"
+}
+
+// Отдать метрики
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	buf := &bytes.Buffer{}
+	globalStatCounter.WriteMetrics(buf)
+	upstreamMetrics.WriteMetrics(buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// Записать заголовок метрики
+func writeMetricHeader(buf *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Записать значение метрики; labels - пары имя, значение
+func writeMetric(buf *bytes.Buffer, name string, value float64, labels ...string) {
+	buf.WriteString(name)
+	if len(labels) > 0 {
+		buf.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			fmt.Fprintf(buf, "%s=%q", labels[i], escapeMetricLabel(labels[i+1]))
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(formatMetricValue(value))
+	buf.WriteByte('\n')
+}
+
+// Prometheus понимает в значениях меток только экранирование \\, \" и \n: кавычки и
+// обратные слеши экранирует %q, а непечатаемые символы заменяем
+func escapeMetricLabel(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return '?'
+		}
+		return r
+	}, s)
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Записать накопленные значения счетчиков
+func (sc *StatCounter) WriteMetrics(buf *bytes.Buffer) {
+	counters := []struct {
+		name  string
+		help  string
+		value *int64
+	}{
+		{"httpsocket_connection_attempts_total", "Websocket connection attempts.", &sc.connectionAttemptsTotal},
+		{"httpsocket_connections_total", "Opened websocket connections.", &sc.connectionsTotal},
+		{"httpsocket_throttled_total", "Times a client was throttled.", &sc.throttledConnectionsTotal},
+		{"httpsocket_requests_total", "Requests received from clients.", &sc.requestsTotal},
+		{"httpsocket_responses_total", "Requests handled.", &sc.responsesTotal},
+		{"httpsocket_circuit_broken_requests_total", "Requests failed by an open circuit breaker.", &sc.circuitBrokenTotal},
+		{"httpsocket_coalesced_requests_total", "Requests which shared an identical in-flight upstream request.", &sc.coalescedTotal},
+	}
+	for _, c := range counters {
+		writeMetricHeader(buf, c.name, "counter", c.help)
+		writeMetric(buf, c.name, float64(atomic.LoadInt64(c.value)))
+	}
+
+	writeMetricHeader(buf, "httpsocket_cache_lookups_total", "counter", "Response cache lookups by result.")
+	writeMetric(buf, "httpsocket_cache_lookups_total", float64(atomic.LoadInt64(&sc.cacheHitsTotal)), "result", "hit")
+	writeMetric(buf, "httpsocket_cache_lookups_total", float64(atomic.LoadInt64(&sc.cacheRevalidatedTotal)), "result", "revalidated")
+	writeMetric(buf, "httpsocket_cache_lookups_total", float64(atomic.LoadInt64(&sc.cacheMissesTotal)), "result", "miss")
+
+	writeMetricHeader(buf, "httpsocket_active_connections", "gauge", "Currently open websocket connections.")
+	writeMetric(buf, "httpsocket_active_connections", float64(atomic.LoadInt64(&sc.activeConnections)))
+	writeMetricHeader(buf, "httpsocket_active_requests", "gauge", "Requests currently in progress.")
+	writeMetric(buf, "httpsocket_active_requests", float64(atomic.LoadInt64(&sc.activeRequests)))
+}
+
+// Записать метрики апстримов
+func (um *UpstreamMetrics) WriteMetrics(buf *bytes.Buffer) {
+	um.lock.Lock()
+	sets := make([]*upstreamMetricSet, 0, len(um.sets))
+	for _, set := range um.sets {
+		sets = append(sets, set)
+	}
+	um.lock.Unlock()
+	sort.Slice(sets, func(i, j int) bool {
+		if sets[i].upstream != sets[j].upstream {
+			return sets[i].upstream < sets[j].upstream
+		}
+		return sets[i].method < sets[j].method
+	})
+
+	writeMetricHeader(buf, "httpsocket_upstream_response_seconds", "histogram", "Upstream response time, including retries and reading the body.")
+	for _, set := range sets {
+		h := set.durations
+		cumulative := int64(0)
+		for i := range h.counts {
+			cumulative += atomic.LoadInt64(&h.counts[i])
+			le := math.Inf(1)
+			if i < len(h.bounds) {
+				le = h.bounds[i]
+			}
+			writeMetric(buf, "httpsocket_upstream_response_seconds_bucket", float64(cumulative),
+				"method", set.method, "upstream", set.upstream, "le", formatMetricValue(le))
+		}
+		writeMetric(buf, "httpsocket_upstream_response_seconds_sum", time.Duration(atomic.LoadInt64(&h.sumNs)).Seconds(),
+			"method", set.method, "upstream", set.upstream)
+		writeMetric(buf, "httpsocket_upstream_response_seconds_count", float64(atomic.LoadInt64(&h.count)),
+			"method", set.method, "upstream", set.upstream)
+	}
+
+	writeMetricHeader(buf, "httpsocket_upstream_responses_total", "counter", "Upstream responses by status code (or error, timeout, canceled).")
+	for _, set := range sets {
+		set.lock.Lock()
+		codes := make([]string, 0, len(set.codes))
+		for code := range set.codes {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			writeMetric(buf, "httpsocket_upstream_responses_total", float64(set.codes[code]),
+				"method", set.method, "upstream", set.upstream, "code", code)
+		}
+		set.lock.Unlock()
+	}
+
+	writeMetricHeader(buf, "httpsocket_upstream_request_bytes_total", "counter", "Bytes sent to upstreams in request bodies.")
+	for _, set := range sets {
+		writeMetric(buf, "httpsocket_upstream_request_bytes_total", float64(atomic.LoadInt64(&set.requestBytes)),
+			"method", set.method, "upstream", set.upstream)
+	}
+	writeMetricHeader(buf, "httpsocket_upstream_response_bytes_total", "counter", "Bytes received from upstreams in response bodies.")
+	for _, set := range sets {
+		writeMetric(buf, "httpsocket_upstream_response_bytes_total", float64(atomic.LoadInt64(&set.responseBytes)),
+			"method", set.method, "upstream", set.upstream)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpstreamMetrics(t *testing.T) {
+	um := &UpstreamMetrics{sets: map[string]*upstreamMetricSet{}}
+	um.Observe("GET", "api", "200", 3*time.Millisecond, 0, 100)
+	um.Observe("GET", "api", "200", 70*time.Millisecond, 0, 50)
+	um.Observe("GET", "api", upstreamErrorCodeLabel(ErrCodeGatewayTimeout), 30*time.Second, 0, 0)
+	um.Observe("POST", `(rule "x")`, "502", time.Second, 10, 0)
+
+	buf := &bytes.Buffer{}
+	um.WriteMetrics(buf)
+	out := buf.String()
+	for _, line := range []string{
+		`httpsocket_upstream_response_seconds_bucket{method="GET",upstream="api",le="0.005"} 1`,
+		`httpsocket_upstream_response_seconds_bucket{method="GET",upstream="api",le="0.1"} 2`,
+		`httpsocket_upstream_response_seconds_bucket{method="GET",upstream="api",le="+Inf"} 3`,
+		`httpsocket_upstream_response_seconds_count{method="GET",upstream="api"} 3`,
+		`httpsocket_upstream_responses_total{method="GET",upstream="api",code="200"} 2`,
+		`httpsocket_upstream_responses_total{method="GET",upstream="api",code="timeout"} 1`,
+		`httpsocket_upstream_response_bytes_total{method="GET",upstream="api"} 150`,
+		`httpsocket_upstream_request_bytes_total{method="POST",upstream="(rule \"x\")"} 10`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %s", line)
+		}
+	}
+	if t.Failed() {
+		t.Log(out)
+	}
+}
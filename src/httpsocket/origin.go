@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	urlmodule "net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Проверка заголовка Origin при открытии вебсокета.
+//
+// Элементы -origin-whitelist:
+//
+// * example.com - ровно этот хост, с любой схемой и портом;
+// * *.example.com - любой поддомен example.com (но не сам example.com);
+// * https://example.com, https://*.example.com - то же, но только по https;
+// * http://localhost:3000 - с указанным портом (если порт не указан, подходит любой).
+//
+// Origin разбирается на схему, хост и порт; хосты сравниваются без учета регистра.
+// Для отсутствующего Origin (не браузерные клиенты) и Origin "null" (sandbox-фреймы,
+// file://, некоторые редиректы) действуют отдельные политики -origin-missing и -origin-null.
+// Если список пуст, Origin не проверяется.
+//
+// Раньше элементы сравнивались как суффиксы, и example.com пропускал все поддомены
+// (а заодно evil-example.com); теперь поддомены нужно перечислить или указать *.example.com.
+//
+// Отклоненные Origin логируются и подсчитываются по значению (см. /admin/origins).
+
+const (
+	OriginAllow = "allow"
+	OriginDeny  = "deny"
+
+	// сколько разных отклоненных Origin помнить; остальные считаются вместе
+	MaxTrackedRejectedOrigins = 1000
+	OtherRejectedOrigins      = "(other)"
+)
+
+// Разрешенный источник
+type OriginRule struct {
+	Scheme string // пусто - любая схема
+	Host   string // точное имя или *.домен
+	Port   string // пусто - любой порт
+}
+
+type OriginPolicy struct {
+	Rules        []OriginRule
+	AllowMissing bool // пускать клиентов без Origin
+	AllowNull    bool // пускать клиентов с Origin: null
+}
+
+// Разобрать политику allow / deny
+func ParseOriginAction(s string) (bool, error) {
+	switch s {
+	case OriginAllow:
+		return true, nil
+	case OriginDeny:
+		return false, nil
+	}
+	return false, fmt.Errorf("expected %s or %s", OriginAllow, OriginDeny)
+}
+
+// Разобрать элемент списка разрешенных источников
+func ParseOriginRule(s string) (OriginRule, error) {
+	rule := OriginRule{}
+	if i := strings.Index(s, "://"); i >= 0 {
+		rule.Scheme = strings.ToLower(s[:i])
+		s = s[i+3:]
+	}
+	s = strings.TrimSuffix(s, "/")
+	if strings.ContainsAny(s, "/?#@") {
+		return rule, fmt.Errorf("malformed origin %q", s)
+	}
+	host, port, err := splitHostPortOptional(s)
+	if err != nil || host == "" {
+		return rule, fmt.Errorf("malformed origin %q", s)
+	}
+	rule.Host = strings.ToLower(strings.TrimSuffix(host, "."))
+	rule.Port = port
+	if strings.Contains(strings.TrimPrefix(rule.Host, "*."), "*") {
+		return rule, fmt.Errorf("malformed origin %q: only a leading `*.` wildcard is supported", s)
+	}
+	return rule, nil
+}
+
+// Разобрать список разрешенных источников через запятую
+func ParseOriginRules(s string) ([]OriginRule, error) {
+	rules := []OriginRule{}
+	for _, item := range SplitCommaList(s) {
+		rule, err := ParseOriginRule(item)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Подходит ли источник scheme://host:port под правило?
+func (r *OriginRule) Matches(scheme, host, port string) bool {
+	if r.Scheme != "" && r.Scheme != scheme {
+		return false
+	}
+	if r.Port != "" && r.Port != port {
+		return false
+	}
+	if strings.HasPrefix(r.Host, "*.") {
+		return strings.HasSuffix(host, r.Host[1:])
+	}
+	return host == r.Host
+}
+
+// Проверить значение заголовка Origin. Если доступ запрещен, возвращает причину.
+func (p *OriginPolicy) Check(origin string) (bool, string) {
+	if len(p.Rules) == 0 {
+		return true, ""
+	}
+	switch origin {
+	case "":
+		return p.AllowMissing, "missing origin"
+	case "null":
+		return p.AllowNull, "null origin"
+	}
+	u, err := urlmodule.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") || u.User != nil {
+		return false, "malformed origin"
+	}
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	port := u.Port()
+	if port == "" {
+		port = fmt.Sprint(defaultPort(scheme))
+	}
+	for i := range p.Rules {
+		if p.Rules[i].Matches(scheme, host, port) {
+			return true, ""
+		}
+	}
+	return false, "origin not in whitelist"
+}
+
+// Счетчики отклоненных Origin по значению
+type OriginRejections struct {
+	lock   sync.Mutex
+	counts map[string]int64
+}
+
+var (
+	rejectedOrigins = &OriginRejections{counts: map[string]int64{}}
+)
+
+// Учесть отклоненный Origin
+func (or *OriginRejections) Record(origin string) {
+	or.lock.Lock()
+	defer or.lock.Unlock()
+	if _, ok := or.counts[origin]; !ok && len(or.counts) >= MaxTrackedRejectedOrigins {
+		origin = OtherRejectedOrigins
+	}
+	or.counts[origin]++
+}
+
+// Отклоненный Origin для админки
+type RejectedOriginStatus struct {
+	Origin string `json:"origin"`
+	Count  int64  `json:"count"`
+}
+
+// Отклоненные Origin, начиная с самых частых
+func (or *OriginRejections) Status() []RejectedOriginStatus {
+	or.lock.Lock()
+	result := make([]RejectedOriginStatus, 0, len(or.counts))
+	for origin, count := range or.counts {
+		result = append(result, RejectedOriginStatus{Origin: origin, Count: count})
+	}
+	or.lock.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Origin < result[j].Origin
+	})
+	return result
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestOriginPolicy(t *testing.T) {
+	rules, err := ParseOriginRules("example.com, *.apps.example.com, https://secure.example.org, http://localhost:3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &OriginPolicy{Rules: rules, AllowMissing: true}
+	cases := map[string]bool{
+		"https://example.com":            true,
+		"http://example.com:8080":        true,
+		"https://EXAMPLE.com.":           true,
+		"https://www.example.com":        false,
+		"https://evil-example.com":       false,
+		"https://example.com.evil":       false,
+		"https://a.apps.example.com":     true,
+		"https://a.b.apps.example.com":   true,
+		"https://apps.example.com":       false,
+		"https://evilapps.example.com":   false,
+		"https://secure.example.org":     true,
+		"https://secure.example.org:443": true,
+		"http://secure.example.org":      false,
+		"https://secure.example.org:444": true,
+		"http://localhost:3000":          true,
+		"http://localhost":               false,
+		"https://localhost:3000":         false,
+		"":                               true,
+		"null":                           false,
+		"example.com":                    false,
+		"https://example.com/path":       false,
+		"https://user@example.com":       false,
+	}
+	for origin, allowed := range cases {
+		if ok, reason := p.Check(origin); ok != allowed {
+			t.Errorf("%q: allowed = %v (%s)", origin, ok, reason)
+		}
+	}
+
+	p = &OriginPolicy{Rules: rules, AllowNull: true}
+	if ok, _ := p.Check("null"); !ok {
+		t.Error("null origin should be allowed with AllowNull")
+	}
+	if ok, _ := p.Check(""); ok {
+		t.Error("missing origin should be rejected without AllowMissing")
+	}
+	if ok, _ := (&OriginPolicy{}).Check("https://anything.test"); !ok {
+		t.Error("empty whitelist should allow any origin")
+	}
+}
+
+func TestParseOriginRule(t *testing.T) {
+	valid := map[string]OriginRule{
+		"Example.COM":           {Host: "example.com"},
+		"*.example.com":         {Host: "*.example.com"},
+		"HTTPS://example.com/":  {Scheme: "https", Host: "example.com"},
+		"http://localhost:3000": {Scheme: "http", Host: "localhost", Port: "3000"},
+	}
+	for s, expected := range valid {
+		rule, err := ParseOriginRule(s)
+		if err != nil {
+			t.Errorf("%q: %s", s, err)
+		} else if rule != expected {
+			t.Errorf("%q: parsed as %+v, expected %+v", s, rule, expected)
+		}
+	}
+	for _, s := range []string{"example.com/path", "user@example.com", "ex*ample.com", "*.*.example.com", "https://"} {
+		if _, err := ParseOriginRule(s); err == nil {
+			t.Errorf("%q should be rejected", s)
+		}
+	}
+}
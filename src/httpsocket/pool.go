@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Пул экземпляров апстрима, балансировка и проверки здоровья.
+//
+// Апстрим может состоять из нескольких экземпляров ("hosts": [...]). Экземпляр выбирается
+// одним из способов ("balancer"):
+//
+// * round_robin (по умолчанию) - по очереди;
+// * least_in_flight - экземпляр с наименьшим числом выполняющихся запросов;
+// * ip_hash - по хешу IP клиента (рандеву-хеширование: при выпадении экземпляра
+//   перераспределяются только его клиенты).
+//
+// Экземпляр выводится из ротации:
+//
+// * активно - если задан "health_check", экземпляр периодически опрашивается GET-запросом,
+//   и после unhealthy_threshold неудач подряд считается нездоровым, а после
+//   healthy_threshold успехов подряд возвращается;
+// * пассивно - после max_fails неудачных запросов подряд (сетевая ошибка, таймаут или
+//   ответ 502/503/504) экземпляр исключается на fail_timeout.
+
+const (
+	BalancerRoundRobin    = "round_robin"
+	BalancerLeastInFlight = "least_in_flight"
+	BalancerIpHash        = "ip_hash"
+)
+
+// Настройки активной проверки здоровья
+type HealthCheck struct {
+	Path               string   `json:"path"`
+	Interval           Duration `json:"interval"`
+	Timeout            Duration `json:"timeout"`
+	HealthyThreshold   int      `json:"healthy_threshold"`
+	UnhealthyThreshold int      `json:"unhealthy_threshold"`
+}
+
+// Экземпляр апстрима
+type UpstreamInstance struct {
+	Host string
+
+	inFlight int64 // atomic
+
+	lock                sync.Mutex
+	healthy             bool // по результатам активной проверки
+	healthCheckStreak   int  // число одинаковых результатов проверки подряд, противоположных healthy
+	consecutiveFailures int
+	ejectedUntil        time.Time
+}
+
+// Состояние экземпляра для админки
+type UpstreamInstanceStatus struct {
+	Host                string     `json:"host"`
+	Healthy             bool       `json:"healthy"`
+	Ejected             bool       `json:"ejected"`
+	EjectedUntil        *time.Time `json:"ejected_until,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	InFlight            int64      `json:"in_flight"`
+}
+
+// Состояние апстрима для админки
+type UpstreamStatus struct {
+	Name      string                   `json:"name"`
+	Balancer  string                   `json:"balancer"`
+	Instances []UpstreamInstanceStatus `json:"instances"`
+}
+
+// Подготовить пул экземпляров апстрима
+func (u *Upstream) initPool() {
+	hosts := u.Hosts
+	if len(hosts) == 0 {
+		hosts = []string{u.Host}
+	}
+	u.instances = make([]*UpstreamInstance, len(hosts))
+	for i, h := range hosts {
+		u.instances[i] = &UpstreamInstance{Host: h, healthy: true}
+	}
+	if u.HealthCheck != nil {
+		hc := u.HealthCheck
+		if hc.Interval <= 0 {
+			hc.Interval = Duration(10 * time.Second)
+		}
+		if hc.Timeout <= 0 {
+			hc.Timeout = Duration(2 * time.Second)
+		}
+		if hc.HealthyThreshold <= 0 {
+			hc.HealthyThreshold = 2
+		}
+		if hc.UnhealthyThreshold <= 0 {
+			hc.UnhealthyThreshold = 3
+		}
+	}
+	if u.FailTimeout <= 0 {
+		u.FailTimeout = Duration(10 * time.Second)
+	}
+}
+
+// Доступен ли экземпляр для запросов в момент now?
+func (inst *UpstreamInstance) available(now time.Time) bool {
+	inst.lock.Lock()
+	defer inst.lock.Unlock()
+	return inst.healthy && !now.Before(inst.ejectedUntil)
+}
+
+// Выбрать экземпляр для запроса клиента с адресом clientIp.
+// Возвращает nil, если доступных экземпляров нет.
+func (u *Upstream) Pick(clientIp string) *UpstreamInstance {
+	now := time.Now()
+	available := make([]*UpstreamInstance, 0, len(u.instances))
+	for _, inst := range u.instances {
+		if inst.available(now) {
+			available = append(available, inst)
+		}
+	}
+	if len(available) == 0 {
+		return nil
+	}
+
+	switch u.Balancer {
+	case BalancerLeastInFlight:
+		best := available[0]
+		for _, inst := range available[1:] {
+			if atomic.LoadInt64(&inst.inFlight) < atomic.LoadInt64(&best.inFlight) {
+				best = inst
+			}
+		}
+		return best
+	case BalancerIpHash:
+		var best *UpstreamInstance
+		var bestScore uint64
+		for _, inst := range available {
+			h := fnv.New64a()
+			h.Write([]byte(inst.Host))
+			h.Write([]byte{0})
+			h.Write([]byte(clientIp))
+			if score := h.Sum64(); best == nil || score > bestScore {
+				best, bestScore = inst, score
+			}
+		}
+		return best
+	default:
+		n := atomic.AddUint64(&u.roundRobinCounter, 1)
+		return available[int(n%uint64(len(available)))]
+	}
+}
+
+// Отметить начало запроса к экземпляру
+func (inst *UpstreamInstance) Acquire() {
+	atomic.AddInt64(&inst.inFlight, 1)
+}
+
+// Отметить окончание запроса к экземпляру; failed - запрос не удался по вине апстрима
+func (inst *UpstreamInstance) Release(u *Upstream, failed bool) {
+	atomic.AddInt64(&inst.inFlight, -1)
+	inst.lock.Lock()
+	defer inst.lock.Unlock()
+	if !failed {
+		inst.consecutiveFailures = 0
+		return
+	}
+	inst.consecutiveFailures++
+	if u.MaxFails > 0 && inst.consecutiveFailures >= u.MaxFails {
+		inst.consecutiveFailures = 0
+		inst.ejectedUntil = time.Now().Add(time.Duration(u.FailTimeout))
+		logWarnf(Fields("upstream", u.Name, "instance", inst.Host),
+			"upstream %s: instance %s ejected for %s after %d consecutive failures",
+			u.Name, inst.Host, time.Duration(u.FailTimeout), u.MaxFails)
+	}
+}
+
+// Считается ли ответ с кодом status неудачей апстрима?
+func IsUpstreamFailureStatus(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// Запустить активные проверки здоровья всех апстримов, для которых они настроены
+func (t *RoutingTable) StartHealthChecks() {
+	t.stopHealthChecks = make(chan struct{})
+	for _, u := range t.Upstreams {
+		if u.HealthCheck == nil {
+			continue
+		}
+		for _, inst := range u.instances {
+			go u.healthCheckLoop(inst, t.stopHealthChecks)
+		}
+	}
+}
+
+// Остановить проверки здоровья (таблица маршрутизации заменена новой)
+func (t *RoutingTable) StopHealthChecks() {
+	if t.stopHealthChecks != nil {
+		close(t.stopHealthChecks)
+		t.stopHealthChecks = nil
+	}
+}
+
+func (u *Upstream) healthCheckLoop(inst *UpstreamInstance, stop chan struct{}) {
+	hc := u.HealthCheck
+	ticker := time.NewTicker(time.Duration(hc.Interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		ok := u.probe(inst)
+		inst.lock.Lock()
+		if ok == inst.healthy {
+			inst.healthCheckStreak = 0
+		} else {
+			inst.healthCheckStreak++
+			threshold := hc.UnhealthyThreshold
+			if ok {
+				threshold = hc.HealthyThreshold
+			}
+			if inst.healthCheckStreak >= threshold {
+				inst.healthy = ok
+				inst.healthCheckStreak = 0
+				if ok {
+					logInfof(Fields("upstream", u.Name, "instance", inst.Host), "upstream %s: instance %s is healthy again", u.Name, inst.Host)
+				} else {
+					logWarnf(Fields("upstream", u.Name, "instance", inst.Host), "upstream %s: instance %s failed health checks, taken out of rotation", u.Name, inst.Host)
+				}
+			}
+		}
+		inst.lock.Unlock()
+	}
+}
+
+// Выполнить одну проверку здоровья экземпляра
+func (u *Upstream) probe(inst *UpstreamInstance) bool {
+	defer simpleRecover()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(u.HealthCheck.Timeout))
+	defer cancel()
+	url := u.Scheme + "://" + inst.Host + joinUrlPath(u.BasePath, u.HealthCheck.Path)
+	rq, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := httpClient.Do(rq)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
+
+// Состояние всех апстримов
+func (t *RoutingTable) Status() []UpstreamStatus {
+	now := time.Now()
+	result := []UpstreamStatus{}
+	for _, u := range t.Upstreams {
+		us := UpstreamStatus{Name: u.Name, Balancer: u.Balancer}
+		for _, inst := range u.instances {
+			inst.lock.Lock()
+			is := UpstreamInstanceStatus{
+				Host:                inst.Host,
+				Healthy:             inst.healthy,
+				Ejected:             now.Before(inst.ejectedUntil),
+				ConsecutiveFailures: inst.consecutiveFailures,
+				InFlight:            atomic.LoadInt64(&inst.inFlight),
+			}
+			if is.Ejected {
+				ejectedUntil := inst.ejectedUntil
+				is.EjectedUntil = &ejectedUntil
+			}
+			inst.lock.Unlock()
+			us.Instances = append(us.Instances, is)
+		}
+		result = append(result, us)
+	}
+	return result
+}
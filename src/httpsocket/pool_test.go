@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Единственный апстрим таблицы маршрутизации из JSON-описания upstream
+func testPool(t *testing.T, upstream string) *Upstream {
+	table, err := ParseRoutingTable([]byte(`{"upstreams": [` + upstream + `], "routes": []}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table.Upstreams[0]
+}
+
+// Последовательность хостов, выбранных n запросами клиента clientIp
+func pickHosts(u *Upstream, clientIp string, n int) []string {
+	hosts := []string{}
+	for i := 0; i < n; i++ {
+		if inst := u.Pick(clientIp); inst != nil {
+			hosts = append(hosts, inst.Host)
+		} else {
+			hosts = append(hosts, "-")
+		}
+	}
+	return hosts
+}
+
+func TestPoolBalancers(t *testing.T) {
+	u := testPool(t, `{"name": "api", "hosts": ["a:1", "b:1", "c:1"]}`)
+	seen := map[string]int{}
+	for _, host := range pickHosts(u, "192.0.2.1", 6) {
+		seen[host]++
+	}
+	if seen["a:1"] != 2 || seen["b:1"] != 2 || seen["c:1"] != 2 {
+		t.Errorf("round_robin: uneven distribution %v", seen)
+	}
+
+	u = testPool(t, `{"name": "api", "hosts": ["a:1", "b:1"], "balancer": "least_in_flight"}`)
+	busy := u.Pick("192.0.2.1")
+	busy.Acquire()
+	for _, host := range pickHosts(u, "192.0.2.1", 3) {
+		if host == busy.Host {
+			t.Errorf("least_in_flight: busy instance %s picked", host)
+		}
+	}
+	busy.Release(u, false)
+
+	u = testPool(t, `{"name": "api", "hosts": ["a:1", "b:1", "c:1"], "balancer": "ip_hash"}`)
+	clients := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4", "192.0.2.5"}
+	before := map[string]string{}
+	for _, ip := range clients {
+		hosts := pickHosts(u, ip, 3)
+		if hosts[0] != hosts[1] || hosts[1] != hosts[2] {
+			t.Errorf("ip_hash: client %s moves between instances %v", ip, hosts)
+		}
+		before[ip] = hosts[0]
+	}
+	// при выпадении экземпляра перераспределяются только его клиенты
+	u.instances[0].healthy = false
+	for _, ip := range clients {
+		host := u.Pick(ip).Host
+		if host == "a:1" || (before[ip] != "a:1" && host != before[ip]) {
+			t.Errorf("ip_hash: client %s moved from %s to %s", ip, before[ip], host)
+		}
+	}
+}
+
+func TestPoolPassiveEjection(t *testing.T) {
+	u := testPool(t, `{"name": "api", "hosts": ["a:1", "b:1"], "max_fails": 2, "fail_timeout": "50ms"}`)
+	a := u.instances[0]
+	for _, failed := range []bool{true, false, true} {
+		a.Acquire()
+		a.Release(u, failed)
+	}
+	if !strings.Contains(strings.Join(pickHosts(u, "", 2), ","), "a:1") {
+		t.Error("instance ejected after non-consecutive failures")
+	}
+	a.Acquire()
+	a.Release(u, true)
+	for _, host := range pickHosts(u, "", 4) {
+		if host != "b:1" {
+			t.Errorf("ejected instance %s picked", host)
+		}
+	}
+	if status := instanceStatus(t, u, "a:1"); !status.Ejected || status.EjectedUntil == nil {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	u.instances[1].healthy = false
+	if inst := u.Pick(""); inst != nil {
+		t.Errorf("picked %s with no instances available", inst.Host)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if inst := u.Pick(""); inst == nil || inst.Host != "a:1" {
+		t.Error("instance did not return after fail_timeout")
+	}
+}
+
+func TestPoolHealthChecks(t *testing.T) {
+	var failing int32
+	instance := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/base/health" || atomic.LoadInt32(&failing) != 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer instance.Close()
+	host := strings.TrimPrefix(instance.URL, "http://")
+	if httpClient == nil {
+		initHttpClient(time.Second)
+	}
+	table, err := ParseRoutingTable([]byte(`{"upstreams": [{"name": "api", "hosts": ["` + host + `"], "base_path": "/base",
+		"health_check": {"path": "/health", "interval": "5ms", "healthy_threshold": 2, "unhealthy_threshold": 2}}], "routes": []}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.StartHealthChecks()
+	defer table.StopHealthChecks()
+	u := table.Upstreams[0]
+
+	waitHealthy := func(healthy bool) {
+		for i := 0; i < 2000; i++ {
+			if instanceStatus(t, u, host).Healthy == healthy {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("instance did not become healthy=%v", healthy)
+	}
+	atomic.StoreInt32(&failing, 1)
+	waitHealthy(false)
+	if inst := u.Pick(""); inst != nil {
+		t.Error("unhealthy instance picked")
+	}
+	atomic.StoreInt32(&failing, 0)
+	waitHealthy(true)
+	if inst := u.Pick(""); inst == nil {
+		t.Error("healthy instance not picked")
+	}
+}
+
+// Состояние экземпляра host из RoutingTable.Status
+func instanceStatus(t *testing.T, u *Upstream, host string) UpstreamInstanceStatus {
+	table := &RoutingTable{Upstreams: []*Upstream{u}}
+	for _, status := range table.Status()[0].Instances {
+		if status.Host == host {
+			return status
+		}
+	}
+	t.Fatalf("no instance %s", host)
+	return UpstreamInstanceStatus{}
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Ограничение частоты и числа одновременных запросов.
+//
+// Частота ограничивается корзинами токенов (token bucket): корзина пополняется со
+// скоростью Rps токенов в секунду и вмещает не больше Burst токенов, каждый запрос берет
+// один токен. Если токенов нет, запрос ждет появления своего токена - без ожидания начала
+// следующей секунды всеми клиентами сразу. Корзины заводятся на нескольких уровнях, каждый
+// настраивается отдельно:
+//
+// * общая на весь прокси (-throttle-rps, -throttle-burst);
+// * на соединение (-throttle-rps-per-client, -throttle-burst-per-client);
+// * на IP-адрес клиента (-throttle-rps-per-ip, -throttle-burst-per-ip);
+// * на маршрут из таблицы маршрутизации (-throttle-rps-per-route, -throttle-burst-per-route
+//   или поля "rps" и "burst" маршрута).
+//
+// Число одновременных запросов ограничивается -throttle-concurrent-requests и
+// -throttle-concurrent-requests-per-client: лишние запросы ждут завершения выполняющихся.
+//
+// Сначала запрос берет токен соединения и только потом - общие токены (прокси, IP-адреса,
+// маршрута). Пока запрос ждет своего токена или отклоняется ограничением соединения, общие
+// корзины не трогаются: клиент, превысивший свою частоту, не занимает токены остальных.
+//
+// Что делать с запросом сверх ограничения, задает -throttle-policy:
+//
+// * block (по умолчанию) - ждать, сколько потребуется;
+// * queue - ждать не дольше -throttle-max-wait-ms, а если не дождаться - отклонить;
+// * reject - сразу отклонить.
+//
+// Отклоненный запрос получает ошибку ErrCodeThrottled с подсказкой, через сколько его
+// повторить: {"code": -429, "message": "too many requests", "data": {"retry_after_ms": 180}}.
+// Если за -throttle-reject-window-seconds запросы соединения отклонены из-за его собственных
+// ограничений (-throttle-rps-per-client, -throttle-concurrent-requests-per-client)
+// -throttle-close-after-rejects раз, вебсокет закрывается с кодом 1008 (policy violation).
+//
+// Ожидание происходит в горутине запроса, а не в цикле чтения вебсокета, так что
+// ping/pong и остальные сообщения соединения продолжают обрабатываться. Ожидающий запрос
+// можно отменить (httpsocket.cancel или закрытием соединения).
+//
+// Незавершенных (ожидающих и выполняющихся) запросов у соединения может быть не больше
+// -throttle-max-pending-per-client. Когда их столько, цикл чтения перестает читать
+// сообщения клиента, пока какой-нибудь запрос не завершится, - клиент упирается в TCP, а
+// не плодит горутины и долг в корзинах токенов.
+
+// Источник времени для ограничителей (подменяется в тестах)
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Частота запросов и емкость корзины
+type RateLimit struct {
+	Rps   float64 // 0 - без ограничения
+	Burst int     // 0 - равна Rps (но не меньше 1)
+}
+
+func (l RateLimit) Enabled() bool {
+	return l.Rps > 0
+}
+
+// Емкость корзины
+func (l RateLimit) Capacity() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rps))
+}
+
+// Ограничитель частоты
+type Limiter interface {
+	// Взять токен, если он появится не позже чем через maxWait (меньше 0 - сколько бы ни
+	// пришлось ждать). Возвращает время до появления токена и то, взят ли он.
+	Reserve(maxWait time.Duration) (time.Duration, bool)
+	// Вернуть токен, взятый Reserve, если запрос так и не был выполнен
+	Cancel()
+}
+
+// Корзина токенов
+type TokenBucket struct {
+	clock Clock
+
+	lock   sync.Mutex
+	limit  RateLimit
+	tokens float64 // может быть меньше 0: токены, обещанные ожидающим запросам
+	last   time.Time
+}
+
+func NewTokenBucket(limit RateLimit, clock Clock) *TokenBucket {
+	return &TokenBucket{clock: clock, limit: limit, tokens: limit.Capacity(), last: clock.Now()}
+}
+
+// Пополнить корзину на момент now
+func (b *TokenBucket) advance(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.limit.Capacity(), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rps)
+		b.last = now
+	}
+}
+
+func (b *TokenBucket) Reserve(maxWait time.Duration) (time.Duration, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.limit.Enabled() {
+		return 0, true
+	}
+	b.advance(b.clock.Now())
+	wait := time.Duration(0)
+	if b.tokens < 1 {
+		wait = time.Duration((1 - b.tokens) / b.limit.Rps * float64(time.Second))
+	}
+	if maxWait >= 0 && wait > maxWait {
+		return wait, false
+	}
+	b.tokens--
+	return wait, true
+}
+
+func (b *TokenBucket) Cancel() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.limit.Enabled() {
+		return
+	}
+	b.advance(b.clock.Now())
+	b.tokens = math.Min(b.limit.Capacity(), b.tokens+1)
+}
+
+// Сменить ограничение (при перезагрузке настроек)
+func (b *TokenBucket) SetLimit(limit RateLimit) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.limit == limit {
+		return
+	}
+	now := b.clock.Now()
+	b.advance(now)
+	if !b.limit.Enabled() {
+		b.tokens = limit.Capacity() // корзина не пополнялась, пока ограничения не было
+	}
+	b.limit = limit
+	b.tokens = math.Min(limit.Capacity(), b.tokens)
+	b.last = now
+}
+
+// Полна ли корзина (давно не было запросов)?
+func (b *TokenBucket) Idle() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.advance(b.clock.Now())
+	return !b.limit.Enabled() || b.tokens >= b.limit.Capacity()
+}
+
+// Как часто удалять из реестра простаивающие корзины
+const LimiterSweepInterval = 1 * time.Minute
+
+// Реестр корзин по ключам (IP-адресам, маршрутам)
+type TokenBuckets struct {
+	clock Clock
+
+	lock      sync.Mutex
+	buckets   map[string]*TokenBucket
+	lastSweep time.Time
+}
+
+func NewTokenBuckets(clock Clock) *TokenBuckets {
+	return &TokenBuckets{clock: clock, buckets: map[string]*TokenBucket{}, lastSweep: clock.Now()}
+}
+
+// Корзина для ключа key (создается при первом обращении)
+func (bs *TokenBuckets) Get(key string, limit RateLimit) *TokenBucket {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	if now := bs.clock.Now(); now.Sub(bs.lastSweep) >= LimiterSweepInterval {
+		bs.lastSweep = now
+		for k, b := range bs.buckets {
+			if b.Idle() {
+				delete(bs.buckets, k) // полная корзина ничем не отличается от новой
+			}
+		}
+	}
+	b, ok := bs.buckets[key]
+	if !ok {
+		b = NewTokenBucket(limit, bs.clock)
+		bs.buckets[key] = b
+	} else {
+		b.SetLimit(limit)
+	}
+	return b
+}
+
+// Ограничитель числа одновременных запросов
+type ConcurrencyLimiter struct {
+	lock     sync.Mutex
+	active   int
+	released chan struct{} // закрывается (и заменяется) при освобождении места
+}
+
+// Занять место, если выполняется меньше limit запросов (limit <= 0 - без ограничения).
+// Если мест нет, возвращает канал, который закроется при освобождении места.
+func (cl *ConcurrencyLimiter) TryAcquire(limit int) (bool, <-chan struct{}) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	if limit <= 0 || cl.active < limit {
+		cl.active++
+		return true, nil
+	}
+	if cl.released == nil {
+		cl.released = make(chan struct{})
+	}
+	return false, cl.released
+}
+
+func (cl *ConcurrencyLimiter) Release() {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	cl.active--
+	if cl.released != nil {
+		close(cl.released)
+		cl.released = nil
+	}
+}
+
+// Ограничители, общие для всех соединений прокси
+type Limiters struct {
+	clock       Clock
+	global      *TokenBucket
+	perIp       *TokenBuckets
+	perRoute    *TokenBuckets
+	concurrency ConcurrencyLimiter
+}
+
+func NewLimiters(clock Clock) *Limiters {
+	return &Limiters{
+		clock:    clock,
+		global:   NewTokenBucket(RateLimit{}, clock),
+		perIp:    NewTokenBuckets(clock),
+		perRoute: NewTokenBuckets(clock),
+	}
+}
+
+// Что делать с запросом, превысившим ограничение
+const (
+	ThrottleBlock  = "block"  // ждать, сколько потребуется
+	ThrottleQueue  = "queue"  // ждать не дольше MaxWait, затем отклонить
+	ThrottleReject = "reject" // сразу отклонить
+)
+
+// Разобрать имя политики
+func ParseThrottleMode(s string) (string, error) {
+	switch s {
+	case ThrottleBlock, ThrottleQueue, ThrottleReject:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown throttle policy %q, expected block, queue or reject", s)
+}
+
+// Ограничения частоты и числа одновременных запросов (0 - без ограничения)
+type ThrottlePolicy struct {
+	Global                      RateLimit
+	PerClient                   RateLimit
+	PerIp                       RateLimit
+	PerRoute                    RateLimit // если не задано в маршруте
+	ConcurrentRequests          int
+	ConcurrentRequestsPerClient int
+	MaxPendingPerClient         int // сколько запросов соединения может ждать или выполняться
+
+	Mode              string
+	MaxWait           time.Duration // для ThrottleQueue
+	CloseAfterRejects int           // закрывать соединение после стольких отказов за RejectWindow (0 - не закрывать)
+	RejectWindow      time.Duration
+}
+
+// Сколько запрос может ждать (меньше 0 - без ограничения)
+func (p *ThrottlePolicy) maxWait() time.Duration {
+	switch p.Mode {
+	case ThrottleQueue:
+		return p.MaxWait
+	case ThrottleReject:
+		return 0
+	}
+	return -1
+}
+
+// Ограничение частоты для маршрута
+func (p *ThrottlePolicy) RouteLimit(route *Route) RateLimit {
+	if route.Rps > 0 {
+		return RateLimit{Rps: route.Rps, Burst: route.Burst}
+	}
+	return p.PerRoute
+}
+
+// Ключ маршрута в реестре корзин
+func routeLimiterKey(route *Route) string {
+	return strings.Join(route.Methods, ",") + " " + route.Prefix
+}
+
+// Через сколько советовать повторить запрос, не дождавшийся места среди одновременных
+const ConcurrencyRetryAfter = 100 * time.Millisecond
+
+// Запрос отклонен ограничителями (политики queue и reject)
+type ThrottledError struct {
+	RetryAfter time.Duration
+	PerClient  bool // сработало ограничение соединения, а не общее
+}
+
+func (e *ThrottledError) Error() string {
+	return "too many requests"
+}
+
+// Дождаться, пока ограничители пропустят запрос к маршруту route (nil - запрос не по
+// таблице маршрутизации). Возвращает функцию, которую нужно вызвать по завершении
+// запроса, или ошибку: *ThrottledError, если запрос отклонен, или ошибку контекста ctx,
+// если запрос отменили во время ожидания.
+func (c *ProxyClient) admit(ctx context.Context, route *Route) (func(), error) {
+	throttle := &c.params().Throttle
+	limiters := c.limiters()
+	maxWait := throttle.maxWait()
+	limiters.global.SetLimit(throttle.Global)
+	c.rateLimiter.SetLimit(throttle.PerClient)
+	shared := []Limiter{
+		limiters.global,
+		limiters.perIp.Get(c.address.Ip, throttle.PerIp),
+	}
+	if route != nil {
+		shared = append(shared, limiters.perRoute.Get(routeLimiterKey(route), throttle.RouteLimit(route)))
+	}
+
+	started := limiters.clock.Now()
+	// сколько еще можно ждать (меньше 0 - без ограничения)
+	remaining := func() time.Duration {
+		if maxWait < 0 {
+			return -1
+		}
+		if d := maxWait - limiters.clock.Now().Sub(started); d > 0 {
+			return d
+		}
+		return 0
+	}
+	throttled := false
+	markThrottled := func() {
+		if !throttled {
+			throttled = true
+			c.statCounter.ConnectionThrottled()
+		}
+	}
+
+	reserved := []Limiter{}
+	cancelReserved := func() {
+		for _, l := range reserved {
+			l.Cancel()
+		}
+	}
+	// взять токены у ограничителей ls и дождаться их
+	reserve := func(ls []Limiter, perClient bool) error {
+		wait := time.Duration(0)
+		for _, l := range ls {
+			d, ok := l.Reserve(remaining())
+			if !ok {
+				cancelReserved()
+				markThrottled()
+				return &ThrottledError{RetryAfter: d, PerClient: perClient}
+			}
+			reserved = append(reserved, l)
+			if d > wait {
+				wait = d
+			}
+		}
+		if wait <= 0 {
+			return nil
+		}
+		markThrottled()
+		select {
+		case <-limiters.clock.After(wait):
+			return nil
+		case <-ctx.Done():
+			cancelReserved()
+			return ctx.Err()
+		}
+	}
+	// общие токены - только после того, как запрос пропустило ограничение соединения
+	if err := reserve([]Limiter{c.rateLimiter}, true); err != nil {
+		return nil, err
+	}
+	if err := reserve(shared, false); err != nil {
+		return nil, err
+	}
+
+	concurrencyLimiters := []struct {
+		cl        *ConcurrencyLimiter
+		limit     int
+		perClient bool
+	}{
+		// сначала место клиента, чтобы не занимать общее место в ожидании своего
+		{&c.concurrencyLimiter, throttle.ConcurrentRequestsPerClient, true},
+		{&limiters.concurrency, throttle.ConcurrentRequests, false},
+	}
+	acquired := []*ConcurrencyLimiter{}
+	release := func() {
+		for _, cl := range acquired {
+			cl.Release()
+		}
+	}
+	for _, x := range concurrencyLimiters {
+		for {
+			ok, released := x.cl.TryAcquire(x.limit)
+			if ok {
+				acquired = append(acquired, x.cl)
+				break
+			}
+			var timeout <-chan time.Time
+			if left := remaining(); left == 0 {
+				release()
+				cancelReserved()
+				markThrottled()
+				return nil, &ThrottledError{RetryAfter: ConcurrencyRetryAfter, PerClient: x.perClient}
+			} else if left > 0 {
+				timeout = limiters.clock.After(left)
+			}
+			markThrottled()
+			select {
+			case <-released:
+			case <-timeout:
+			case <-ctx.Done():
+				release()
+				cancelReserved()
+				return nil, ctx.Err()
+			}
+		}
+	}
+	return release, nil
+}
+
+// Общие ограничители прокси, к которому подключен клиент
+func (c *ProxyClient) limiters() *Limiters {
+	return c.proxy.limiters
+}
+
+// Занять место среди незавершенных запросов соединения (см. -throttle-max-pending-per-client),
+// дождавшись его, если нужно. Возвращает false, если соединение закрылось раньше.
+func (c *ProxyClient) acquirePending() bool {
+	for {
+		ok, released := c.pendingRequests.TryAcquire(c.params().Throttle.MaxPendingPerClient)
+		if ok {
+			return true
+		}
+		select {
+		case <-released:
+		case <-c.ctx.Done():
+			return false
+		}
+	}
+}
+
+// Отказы в обслуживании соединения за текущее окно
+type throttleRejects struct {
+	lock        sync.Mutex
+	windowStart time.Time
+	count       int
+}
+
+// Ответить на отклоненный ограничителями запрос rq ошибкой ErrCodeThrottled с подсказкой
+// retry_after_ms. Соединение, слишком часто превышающее свои ограничения, закрывается.
+func (c *ProxyClient) rejectThrottled(rq *JsonRpcRequest, err *ThrottledError) {
+	retryAfter := err.RetryAfter
+	if retryAfter < time.Millisecond {
+		retryAfter = time.Millisecond
+	}
+	c.SendErrorWithData(rq, ErrCodeThrottled, err.Error(), MakeRetryHint(retryAfter))
+	if !err.PerClient {
+		return // клиент не виноват в общей перегрузке
+	}
+
+	throttle := &c.params().Throttle
+	if throttle.CloseAfterRejects <= 0 {
+		return
+	}
+	now := c.limiters().clock.Now()
+	c.throttleRejects.lock.Lock()
+	if now.Sub(c.throttleRejects.windowStart) >= throttle.RejectWindow {
+		c.throttleRejects.windowStart = now
+		c.throttleRejects.count = 0
+	}
+	c.throttleRejects.count++
+	count := c.throttleRejects.count
+	c.throttleRejects.lock.Unlock()
+
+	if count == throttle.CloseAfterRejects {
+		c.LogWarnf("Closing connection: %d requests rejected by throttling within %s", count, throttle.RejectWindow)
+		c.closeConnection(websocket.ClosePolicyViolation, "too many requests")
+	}
+}
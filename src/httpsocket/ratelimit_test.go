@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Часы, которые идут только по Advance
+type fakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1000, 0)}
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	return fc.now
+}
+
+func (fc *fakeClock) After(d time.Duration) <-chan time.Time {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- fc.now
+		return ch
+	}
+	fc.timers = append(fc.timers, fakeTimer{at: fc.now.Add(d), ch: ch})
+	return ch
+}
+
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	fc.now = fc.now.Add(d)
+	pending := fc.timers[:0]
+	for _, t := range fc.timers {
+		if t.at.After(fc.now) {
+			pending = append(pending, t)
+		} else {
+			t.ch <- fc.now
+		}
+	}
+	fc.timers = pending
+}
+
+// Дождаться, пока кто-нибудь станет ждать n таймеров
+func (fc *fakeClock) waitTimers(t *testing.T, n int) {
+	for i := 0; i < 1000; i++ {
+		fc.lock.Lock()
+		count := len(fc.timers)
+		fc.lock.Unlock()
+		if count >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("nobody is waiting for %d timers", n)
+}
+
+func TestTokenBucket(t *testing.T) {
+	type step struct {
+		advance time.Duration
+		maxWait time.Duration
+		wait    time.Duration // ожидаемое время до токена
+		ok      bool
+		cancel  bool // вернуть токен после Reserve
+	}
+	const noLimit = -1
+	cases := []struct {
+		name  string
+		limit RateLimit
+		steps []step
+	}{
+		{"burst", RateLimit{Rps: 10, Burst: 3}, []step{
+			{0, 0, 0, true, false},
+			{0, 0, 0, true, false},
+			{0, 0, 0, true, false},
+			{0, 0, 100 * time.Millisecond, false, false},
+			{0, 50 * time.Millisecond, 100 * time.Millisecond, false, false},
+		}},
+		{"refill", RateLimit{Rps: 10, Burst: 1}, []step{
+			{0, 0, 0, true, false},
+			{50 * time.Millisecond, 0, 50 * time.Millisecond, false, false},
+			{50 * time.Millisecond, 0, 0, true, false},
+		}},
+		{"refill is capped by burst", RateLimit{Rps: 10, Burst: 2}, []step{
+			{0, 0, 0, true, false},
+			{10 * time.Second, 0, 0, true, false},
+			{0, 0, 0, true, false},
+			{0, 0, 100 * time.Millisecond, false, false},
+		}},
+		{"burst defaults to rps", RateLimit{Rps: 2}, []step{
+			{0, 0, 0, true, false},
+			{0, 0, 0, true, false},
+			{0, 0, 500 * time.Millisecond, false, false},
+		}},
+		{"waiting requests borrow tokens", RateLimit{Rps: 10, Burst: 1}, []step{
+			{0, noLimit, 0, true, false},
+			{0, noLimit, 100 * time.Millisecond, true, false},
+			{0, noLimit, 200 * time.Millisecond, true, false},
+			{200 * time.Millisecond, 0, 100 * time.Millisecond, false, false},
+		}},
+		{"cancel returns the token", RateLimit{Rps: 10, Burst: 1}, []step{
+			{0, 0, 0, true, true},
+			{0, 0, 0, true, false},
+			{0, 0, 100 * time.Millisecond, false, false},
+		}},
+		{"disabled", RateLimit{}, []step{
+			{0, 0, 0, true, false},
+			{0, 0, 0, true, false},
+		}},
+	}
+	for _, c := range cases {
+		clock := newFakeClock()
+		b := NewTokenBucket(c.limit, clock)
+		for i, s := range c.steps {
+			clock.Advance(s.advance)
+			wait, ok := b.Reserve(s.maxWait)
+			if wait != s.wait || ok != s.ok {
+				t.Errorf("%s, step %d: got (%s, %v), expected (%s, %v)", c.name, i, wait, ok, s.wait, s.ok)
+			}
+			if s.cancel {
+				b.Cancel()
+			}
+		}
+	}
+}
+
+func TestTokenBucketsSweep(t *testing.T) {
+	clock := newFakeClock()
+	bs := NewTokenBuckets(clock)
+	limit := RateLimit{Rps: 0.01, Burst: 1} // за LimiterSweepInterval корзина не наполнится
+	bs.Get("busy", limit).Reserve(0)
+	bs.Get("idle", limit)
+	clock.Advance(LimiterSweepInterval)
+	bs.Get("other", limit)
+	if _, ok := bs.buckets["idle"]; ok {
+		t.Error("idle bucket was not swept")
+	}
+	if _, ok := bs.buckets["busy"]; !ok {
+		t.Error("busy bucket was swept")
+	}
+}
+
+func newThrottleTestClient(clock Clock, throttle ThrottlePolicy) *ProxyClient {
+	proxy := &WsProxy{params: &ProxyParams{Throttle: throttle}, limiters: NewLimiters(clock)}
+	return &ProxyClient{
+		proxy:       proxy,
+		address:     ClientAddress{Ip: "192.0.2.1"},
+		ctx:         context.Background(),
+		statCounter: NewStatCounter(nil),
+		rateLimiter: NewTokenBucket(throttle.PerClient, clock),
+	}
+}
+
+func admitAsync(c *ProxyClient, ctx context.Context) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		release, err := c.admit(ctx, nil)
+		if release != nil {
+			release()
+		}
+		result <- err
+	}()
+	return result
+}
+
+func expectThrottled(t *testing.T, name string, err error, retryAfter time.Duration, perClient bool) {
+	throttled, ok := err.(*ThrottledError)
+	if !ok {
+		t.Errorf("%s: expected ThrottledError, got %v", name, err)
+		return
+	}
+	if throttled.RetryAfter != retryAfter || throttled.PerClient != perClient {
+		t.Errorf("%s: got %+v, expected retry after %s, per client %v", name, throttled, retryAfter, perClient)
+	}
+}
+
+func TestAdmitPolicies(t *testing.T) {
+	perClient := RateLimit{Rps: 10, Burst: 1}
+	cases := []struct {
+		name    string
+		mode    string
+		maxWait time.Duration
+		waits   bool // второй запрос ждет токена, а не отклоняется
+	}{
+		{"block", ThrottleBlock, 0, true},
+		{"queue within max wait", ThrottleQueue, 200 * time.Millisecond, true},
+		{"queue over max wait", ThrottleQueue, 50 * time.Millisecond, false},
+		{"reject", ThrottleReject, time.Second, false},
+	}
+	for _, tc := range cases {
+		clock := newFakeClock()
+		c := newThrottleTestClient(clock, ThrottlePolicy{
+			Global:    RateLimit{Rps: 100, Burst: 5},
+			PerClient: perClient,
+			Mode:      tc.mode,
+			MaxWait:   tc.maxWait,
+		})
+		if release, err := c.admit(context.Background(), nil); err != nil {
+			t.Fatalf("%s: first request: %v", tc.name, err)
+		} else {
+			release()
+		}
+		globalTokens := c.limiters().global.tokens
+
+		result := admitAsync(c, context.Background())
+		if !tc.waits {
+			expectThrottled(t, tc.name, <-result, 100*time.Millisecond, true)
+		} else {
+			clock.waitTimers(t, 1)
+			if c.limiters().global.tokens != globalTokens {
+				t.Errorf("%s: global token taken while waiting for the per-client one", tc.name)
+			}
+			clock.Advance(100 * time.Millisecond)
+			if err := <-result; err != nil {
+				t.Errorf("%s: second request: %v", tc.name, err)
+			}
+		}
+		if !tc.waits && c.limiters().global.tokens != globalTokens {
+			t.Errorf("%s: global token taken by a rejected request", tc.name)
+		}
+	}
+}
+
+func TestAdmitGlobalLimitIsShared(t *testing.T) {
+	clock := newFakeClock()
+	throttle := ThrottlePolicy{Global: RateLimit{Rps: 10, Burst: 1}, PerClient: RateLimit{Rps: 10, Burst: 1}, Mode: ThrottleReject}
+	a := newThrottleTestClient(clock, throttle)
+	b := newThrottleTestClient(clock, throttle)
+	b.proxy = a.proxy
+	if _, err := a.admit(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	_, err := b.admit(context.Background(), nil)
+	expectThrottled(t, "global", err, 100*time.Millisecond, false)
+	if b.rateLimiter.tokens != 1 {
+		t.Error("per-client token of the rejected request was not returned")
+	}
+}
+
+func TestAdmitCanceledWhileWaiting(t *testing.T) {
+	clock := newFakeClock()
+	c := newThrottleTestClient(clock, ThrottlePolicy{PerClient: RateLimit{Rps: 10, Burst: 1}, Mode: ThrottleBlock})
+	c.admit(context.Background(), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	result := admitAsync(c, ctx)
+	clock.waitTimers(t, 1)
+	cancel()
+	if err := <-result; err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	// токен отмененного запроса вернулся: следующий ждет 100ms, а не 200ms
+	if wait, _ := c.rateLimiter.Reserve(0); wait != 100*time.Millisecond {
+		t.Errorf("expected 100ms wait, got %s", wait)
+	}
+}
+
+func TestAdmitConcurrencyQueueTimeout(t *testing.T) {
+	clock := newFakeClock()
+	c := newThrottleTestClient(clock, ThrottlePolicy{
+		ConcurrentRequestsPerClient: 1,
+		Mode:                        ThrottleQueue,
+		MaxWait:                     50 * time.Millisecond,
+	})
+	release, err := c.admit(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := admitAsync(c, context.Background())
+	clock.waitTimers(t, 1)
+	clock.Advance(50 * time.Millisecond)
+	expectThrottled(t, "concurrency", <-result, ConcurrencyRetryAfter, true)
+
+	result = admitAsync(c, context.Background())
+	clock.waitTimers(t, 1)
+	release()
+	if err := <-result; err != nil {
+		t.Errorf("request after release: %v", err)
+	}
+}
+
+func TestPendingRequestsLimit(t *testing.T) {
+	c := newThrottleTestClient(newFakeClock(), ThrottlePolicy{MaxPendingPerClient: 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	c.ctx = ctx
+	if !c.acquirePending() {
+		t.Fatal("first request was not admitted")
+	}
+	acquired := make(chan bool, 1)
+	go func() { acquired <- c.acquirePending() }()
+	select {
+	case <-acquired:
+		t.Fatal("second request was admitted over the limit")
+	case <-time.After(10 * time.Millisecond):
+	}
+	c.pendingRequests.Release()
+	if !<-acquired {
+		t.Fatal("second request was not admitted after release")
+	}
+
+	go func() { acquired <- c.acquirePending() }()
+	cancel()
+	if <-acquired {
+		t.Error("request was admitted on a closed connection")
+	}
+}
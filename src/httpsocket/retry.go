@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Повторные попытки проксирования идемпотентных запросов.
+//
+// Запрос повторяется, если апстрим не ответил из-за сетевой ошибки (например, отказ в
+// соединении во время выкладки) или вернул один из RetryableStatuses. Пауза между попытками
+// растет экспоненциально от BaseBackoff до MaxBackoff со случайным разбросом; если апстрим
+// прислал Retry-After, пауза будет не меньше указанной. Попытка не делается, если пауза
+// не укладывается в таймаут запроса.
+type RetryPolicy struct {
+	MaxAttempts       int // 1 - без повторов
+	BaseBackoff       time.Duration
+	MaxBackoff        time.Duration
+	RetryableStatuses []int
+	RetryPutDelete    bool // повторять также PUT и DELETE
+}
+
+// Можно ли повторять запрос с методом method?
+func (p *RetryPolicy) RetriesMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	case "PUT", "DELETE":
+		return p.RetryPutDelete
+	}
+	return false
+}
+
+// Нужно ли повторять запрос, получивший ответ с кодом status?
+func (p *RetryPolicy) RetriesStatus(status int) bool {
+	for _, s := range p.RetryableStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// Пауза перед попыткой номер attempt+1 (attempt начинается с 1)
+func (p *RetryPolicy) Backoff(attempt int) time.Duration {
+	backoff := p.BaseBackoff
+	for i := 1; i < attempt && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	// половина паузы фиксирована, половина случайна, чтобы клиенты не повторяли запросы синхронно
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// Разобрать список кодов HTTP-ответов через запятую
+func ParseStatusList(s string) ([]int, error) {
+	result := []int{}
+	for _, item := range SplitCommaList(s) {
+		status, err := strconv.Atoi(item)
+		if err != nil {
+			return nil, fmt.Errorf("malformed HTTP status %q", item)
+		}
+		result = append(result, status)
+	}
+	return result, nil
+}
+
+// Выполнить запрос к апстриму с повторами согласно ProxyParams.Retries.
+// Возвращает ответ (или ошибку) последней попытки и число сделанных попыток.
+func (c *ProxyClient) doWithRetries(ctx context.Context, httpRq *http.Request) (*http.Response, int, error) {
+	policy := &c.params().Retries
+	attempt := 0
+	for {
+		attempt++
+		rq := httpRq
+		if attempt > 1 {
+			var err error
+			if rq, err = cloneRequest(ctx, httpRq); err != nil {
+				return nil, attempt - 1, err
+			}
+		}
+		httpResp, err := c.roundTrip(ctx, rq)
+
+		if attempt >= policy.MaxAttempts || !policy.RetriesMethod(httpRq.Method) {
+			return httpResp, attempt, err
+		}
+		var retryAfter time.Duration
+		if err != nil {
+			if err == FakeUpstreamResponse || ctx.Err() != nil {
+				return httpResp, attempt, err
+			}
+		} else {
+			if !policy.RetriesStatus(httpResp.StatusCode) {
+				return httpResp, attempt, err
+			}
+			retryAfter = parseRetryAfter(httpResp.Header.Get("Retry-After"), time.Now())
+		}
+
+		pause := policy.Backoff(attempt)
+		if retryAfter > pause {
+			pause = retryAfter
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(pause).After(deadline) {
+			return httpResp, attempt, err // следующая попытка все равно не успеет
+		}
+		if httpResp != nil {
+			httpResp.Body.Close()
+		}
+		if logger.Enabled(LevelDebug) {
+			fields := append(c.logFields(), Fields("request_id", httpRq.Header.Get("X-Request-ID"), "method", httpRq.Method, "url", httpRq.URL.String())...)
+			logger.Log(LevelDebug, fields, "Retrying %s %s in %s (attempt %d failed)", httpRq.Method, httpRq.URL, pause, attempt)
+		}
+
+		select {
+		case <-time.After(pause):
+		case <-ctx.Done():
+			return nil, attempt, ctx.Err()
+		}
+	}
+}
+
+// Копия запроса с заново открытым телом, для повторной попытки
+func cloneRequest(ctx context.Context, httpRq *http.Request) (*http.Request, error) {
+	rq := httpRq.Clone(ctx)
+	if httpRq.GetBody != nil {
+		body, err := httpRq.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		rq.Body = body
+	}
+	return rq, nil
+}
+
+// Разобрать заголовок Retry-After (число секунд или HTTP-дата)
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
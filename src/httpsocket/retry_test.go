@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	p := &RetryPolicy{BaseBackoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond}
+	cases := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 300 * time.Millisecond},
+		{10, 300 * time.Millisecond},
+	}
+	for _, c := range cases {
+		for i := 0; i < 20; i++ {
+			if backoff := p.Backoff(c.attempt); backoff < c.max/2 || backoff > c.max {
+				t.Errorf("attempt %d: backoff %s out of [%s, %s]", c.attempt, backoff, c.max/2, c.max)
+			}
+		}
+	}
+	if backoff := (&RetryPolicy{}).Backoff(1); backoff != 0 {
+		t.Errorf("zero policy: backoff %s", backoff)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		value string
+		pause time.Duration
+	}{
+		{"", 0},
+		{"3", 3 * time.Second},
+		{" 1 ", time.Second},
+		{"-1", 0},
+		{"Wed, 01 Jan 2020 00:00:05 GMT", 5 * time.Second},
+		{"Tue, 31 Dec 2019 23:59:00 GMT", 0},
+		{"soon", 0},
+	}
+	for _, c := range cases {
+		if pause := parseRetryAfter(c.value, now); pause != c.pause {
+			t.Errorf("%q: got %s, expected %s", c.value, pause, c.pause)
+		}
+	}
+}
+
+// Апстрим, который отвечает statuses по очереди (последний - на все остальные запросы),
+// со счетчиком запросов
+func newFlakyUpstream(t *testing.T, statuses ...int) (*httptest.Server, *int32) {
+	var count int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&count, 1))
+		if n > len(statuses) {
+			n = len(statuses)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statuses[n-1])
+		w.Write([]byte(`{}`))
+	}))
+	return upstream, &count
+}
+
+func TestProxyRetries(t *testing.T) {
+	cases := []struct {
+		name           string
+		method         string
+		statuses       []int
+		retryPutDelete bool
+		status         int // итоговый HTTP-статус
+		attempts       int
+	}{
+		{"GET retried until success", "GET", []int{503, 502, 200}, false, 200, 3},
+		{"attempts are limited", "GET", []int{503}, false, 503, 3},
+		{"non-retryable status", "GET", []int{500, 200}, false, 500, 1},
+		{"POST is not retried", "POST", []int{503, 200}, false, 503, 1},
+		{"PUT is not retried by default", "PUT", []int{503, 200}, false, 503, 1},
+		{"PUT retried with -retry-put-delete", "PUT", []int{503, 200}, true, 200, 2},
+		{"DELETE retried with -retry-put-delete", "DELETE", []int{504, 200}, true, 200, 2},
+	}
+	for _, c := range cases {
+		upstream, count := newFlakyUpstream(t, c.statuses...)
+		p := newTestProxy(t, func(params *ProxyParams) {
+			params.Retries = RetryPolicy{
+				MaxAttempts:       3,
+				BaseBackoff:       time.Millisecond,
+				MaxBackoff:        time.Millisecond,
+				RetryableStatuses: []int{502, 503, 504},
+				RetryPutDelete:    c.retryPutDelete,
+			}
+		})
+		resp := callProxy(t, p, `{"id": 1, "method": "`+c.method+` `+upstream.URL+`/a", "params": {}}`)
+		if resp.HttpStatus != c.status || resp.UpstreamAttempts != c.attempts || int(atomic.LoadInt32(count)) != c.attempts {
+			t.Errorf("%s: got status %d after %d attempts (upstream saw %d), expected %d after %d",
+				c.name, resp.HttpStatus, resp.UpstreamAttempts, atomic.LoadInt32(count), c.status, c.attempts)
+		}
+		upstream.Close()
+	}
+}
+
+func TestProxyRetryAfterExceedsTimeout(t *testing.T) {
+	var count int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(503)
+	}))
+	defer upstream.Close()
+	p := newTestProxy(t, func(params *ProxyParams) {
+		params.Retries = RetryPolicy{MaxAttempts: 3, RetryableStatuses: []int{503}}
+		params.Timeouts.Default = time.Second
+	})
+	resp := callProxy(t, p, `{"id": 1, "method": "GET `+upstream.URL+`/a"}`)
+	if resp.HttpStatus != 503 || resp.UpstreamAttempts != 1 || atomic.LoadInt32(&count) != 1 {
+		t.Errorf("got status %d after %d attempts, expected the first response", resp.HttpStatus, resp.UpstreamAttempts)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Таблица маршрутизации запросов без указания хоста.
+//
+// Запрос с путем (например "GET /orders/v1/list") направляется по маршруту с самым
+// длинным подходящим префиксом пути (и подходящим методом, если у маршрута указаны методы)
+// в один из именованных апстримов. Таблица загружается из JSON-файла:
+//
+//     {
+//         "upstreams": [
+//             {"name": "catalogue", "scheme": "http", "host": "catalogue.lan:8080"},
+//             {"name": "orders", "scheme": "https", "host": "orders.lan", "base_path": "/api", "timeout": "10s"},
+//             {"name": "auth", "hosts": ["auth1.lan", "auth2.lan"], "balancer": "least_in_flight",
+//              "health_check": {"path": "/ping", "interval": "5s"}, "max_fails": 3, "fail_timeout": "30s",
+//              "cookie_jar": true}
+//         ],
+//         "routes": [
+//             {"prefix": "/mobileapi/catalogue/", "upstream": "catalogue", "coalesce": true, "coalesce_across_ips": true},
+//             {"prefix": "/orders/", "methods": ["GET"], "upstream": "orders", "strip_prefix": true, "rps": 200, "burst": 50},
+//             {"prefix": "/v2/orders/", "upstream": "orders", "rewrite_prefix": "/orders/v2/"}
+//         ]
+//     }
+//
+// Итоговый адрес: scheme://host + base_path + путь запроса, в котором prefix заменен
+// на rewrite_prefix (или удален, если strip_prefix).
+//
+// Об апстримах из нескольких экземпляров см. pool.go.
+
+// Апстрим - бэкенд, в который проксируются запросы
+type Upstream struct {
+	Name        string       `json:"name"`
+	Scheme      string       `json:"scheme"`       // http (по умолчанию) или https
+	Host        string       `json:"host"`         // host:port
+	Hosts       []string     `json:"hosts"`        // несколько экземпляров вместо host
+	Balancer    string       `json:"balancer"`     // способ выбора экземпляра
+	HealthCheck *HealthCheck `json:"health_check"` // активная проверка здоровья экземпляров
+	MaxFails    int          `json:"max_fails"`    // после скольких неудач подряд исключать экземпляр (0 - не исключать)
+	FailTimeout Duration     `json:"fail_timeout"` // на сколько исключать экземпляр
+	BasePath    string       `json:"base_path"`    // префикс, добавляемый ко всем путям
+	Timeout     Duration     `json:"timeout"`      // таймаут запросов к апстриму (если не задан, см. TimeoutPolicy)
+	CookieJar   bool         `json:"cookie_jar"`   // хранить куки апстрима на соединении (см. cookiejar.go)
+
+	instances         []*UpstreamInstance
+	roundRobinCounter uint64 // atomic
+}
+
+// Маршрут: какие запросы в какой апстрим направлять
+type Route struct {
+	Prefix            string   `json:"prefix"`
+	Methods           []string `json:"methods"` // если пусто - любые методы
+	UpstreamName      string   `json:"upstream"`
+	StripPrefix       bool     `json:"strip_prefix"`
+	RewritePrefix     string   `json:"rewrite_prefix"`
+	Coalesce          *bool    `json:"coalesce"`            // объединять одинаковые GET-запросы (если не задано - см. -coalesce-get-requests)
+	CoalesceAcrossIps bool     `json:"coalesce_across_ips"` // объединять запросы клиентов с разными IP (см. coalesce.go)
+	Rps               float64  `json:"rps"`                 // ограничение частоты запросов по маршруту (если не задано - см. -throttle-rps-per-route)
+	Burst             int      `json:"burst"`               // емкость корзины токенов (см. ratelimit.go)
+
+	Upstream *Upstream `json:"-"`
+}
+
+type RoutingTable struct {
+	Upstreams []*Upstream `json:"upstreams"`
+	Routes    []*Route    `json:"routes"`
+
+	stopHealthChecks chan struct{}
+}
+
+// Загрузить таблицу маршрутизации из JSON-файла
+func LoadRoutingTable(filename string) (*RoutingTable, error) {
+	bs, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	t, err := ParseRoutingTable(bs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return t, nil
+}
+
+// Разобрать таблицу маршрутизации из JSON
+func ParseRoutingTable(bs []byte) (*RoutingTable, error) {
+	t := &RoutingTable{}
+	if err := json.Unmarshal(bs, t); err != nil {
+		return nil, err
+	}
+	if err := t.Link(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Имя апстрима, добавляемого AddDefaultHost
+const DefaultUpstreamName = "default"
+
+// Добавить апстрим и маршрут на него для всех путей, не подошедших под другие маршруты.
+// Возвращает ошибку, если в таблице уже есть апстрим с именем DefaultUpstreamName.
+func (t *RoutingTable) AddDefaultHost(host string) error {
+	for _, u := range t.Upstreams {
+		if u.Name == DefaultUpstreamName {
+			return fmt.Errorf("upstream %s is already defined in the routing table", DefaultUpstreamName)
+		}
+	}
+	u := &Upstream{Name: DefaultUpstreamName, Scheme: "http", Host: host, Balancer: BalancerRoundRobin}
+	u.initPool()
+	t.Upstreams = append(t.Upstreams, u)
+	t.Routes = append(t.Routes, &Route{Prefix: "/", UpstreamName: u.Name, Upstream: u})
+	return nil
+}
+
+// Проверить таблицу и связать маршруты с апстримами
+func (t *RoutingTable) Link() error {
+	byName := map[string]*Upstream{}
+	for _, u := range t.Upstreams {
+		if u.Name == "" {
+			return fmt.Errorf("upstream without name")
+		}
+		if _, ok := byName[u.Name]; ok {
+			return fmt.Errorf("duplicate upstream %s", u.Name)
+		}
+		if u.Host == "" && len(u.Hosts) == 0 {
+			return fmt.Errorf("upstream %s: host or hosts is required", u.Name)
+		}
+		if u.Host != "" && len(u.Hosts) > 0 {
+			return fmt.Errorf("upstream %s: only one of host and hosts may be specified", u.Name)
+		}
+		switch u.Balancer {
+		case "":
+			u.Balancer = BalancerRoundRobin
+		case BalancerRoundRobin, BalancerLeastInFlight, BalancerIpHash:
+		default:
+			return fmt.Errorf("upstream %s: unknown balancer %s", u.Name, u.Balancer)
+		}
+		switch u.Scheme {
+		case "":
+			u.Scheme = "http"
+		case "http", "https":
+		default:
+			return fmt.Errorf("upstream %s: unsupported scheme %s", u.Name, u.Scheme)
+		}
+		u.BasePath = strings.TrimSuffix(u.BasePath, "/")
+		u.initPool()
+		byName[u.Name] = u
+	}
+	for _, r := range t.Routes {
+		if !strings.HasPrefix(r.Prefix, "/") {
+			return fmt.Errorf("route %s: prefix must start with /", r.Prefix)
+		}
+		u, ok := byName[r.UpstreamName]
+		if !ok {
+			return fmt.Errorf("route %s: unknown upstream %s", r.Prefix, r.UpstreamName)
+		}
+		for i := range r.Methods {
+			r.Methods[i] = strings.ToUpper(r.Methods[i])
+		}
+		r.Upstream = u
+	}
+	return nil
+}
+
+// Подходит ли маршрут для запроса method к пути path?
+func (r *Route) Matches(method string, path string) bool {
+	if !strings.HasPrefix(path, r.Prefix) {
+		return false
+	}
+	// "/orders" подходит для "/orders" и "/orders/1", но не для "/ordersarchive"
+	if len(path) > len(r.Prefix) && !strings.HasSuffix(r.Prefix, "/") {
+		switch path[len(r.Prefix)] {
+		case '/', '?':
+		default:
+			return false
+		}
+	}
+	if len(r.Methods) == 0 {
+		return true
+	}
+	for _, m := range r.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Найти маршрут для запроса method к пути path (с querystring).
+// Возвращает nil, если подходящего маршрута нет.
+func (t *RoutingTable) Match(method string, path string) *Route {
+	var best *Route
+	for _, r := range t.Routes {
+		if r.Matches(method, path) && (best == nil || len(r.Prefix) > len(best.Prefix)) {
+			best = r
+		}
+	}
+	return best
+}
+
+// Полный адрес экземпляра апстрима host для пути path (с querystring), пришедшего по этому маршруту
+func (r *Route) MakeUrl(host string, path string) string {
+	rest := strings.TrimPrefix(path, r.Prefix)
+	switch {
+	case r.RewritePrefix != "":
+		path = joinUrlPath(r.RewritePrefix, rest)
+	case r.StripPrefix:
+		path = joinUrlPath("/", rest)
+	}
+	u := r.Upstream
+	return u.Scheme + "://" + host + joinUrlPath(u.BasePath, path)
+}
+
+// Склеить части пути ровно одним слешем
+func joinUrlPath(a, b string) string {
+	if b == "" || b[0] == '?' {
+		if a == "" {
+			return "/" + b
+		}
+		return a + b
+	}
+	return strings.TrimSuffix(a, "/") + "/" + strings.TrimPrefix(b, "/")
+}
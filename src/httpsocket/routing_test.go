@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestAddDefaultHostConflict(t *testing.T) {
+	table, err := ParseRoutingTable([]byte(`{
+		"upstreams": [{"name": "default", "host": "a.lan"}],
+		"routes": [{"prefix": "/a/", "upstream": "default"}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := table.AddDefaultHost("b.lan"); err == nil {
+		t.Fatal("expected an error for a second upstream named default")
+	}
+
+	table, err = ParseRoutingTable([]byte(`{
+		"upstreams": [{"name": "a", "host": "a.lan"}],
+		"routes": [{"prefix": "/a/", "upstream": "a"}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := table.AddDefaultHost("b.lan"); err != nil {
+		t.Fatal(err)
+	}
+	if r := table.Match("GET", "/b"); r == nil || r.Upstream.Name != DefaultUpstreamName {
+		t.Fatalf("expected /b to be routed to the default upstream, got %+v", r)
+	}
+	if r := table.Match("GET", "/a/1"); r == nil || r.Upstream.Name != "a" {
+		t.Fatalf("expected /a/1 to be routed to a, got %+v", r)
+	}
+}
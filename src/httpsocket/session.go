@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Заголовки сессии.
+//
+// Клиент может один раз сохранить на соединении заголовки (например Authorization,
+// X-App-Version, Accept-Language), которые затем добавляются ко всем его проксируемым
+// запросам:
+//
+//     {"method": "httpsocket.setheaders", "params": {"Authorization": "Bearer ...", "X-App-Version": "3.1"}, "id": 1}
+//     {"method": "httpsocket.unsetheaders", "params": ["Authorization"], "id": 2}
+//     {"method": "httpsocket.unsetheaders", "id": 3}  // убрать все
+//     {"method": "httpsocket.getsession", "id": 4}
+//
+// Какие заголовки можно сохранить, определяет ProxyParams.SessionHeaderPolicy. Заголовки
+// из конверта запроса (см. envelope.go) имеют приоритет над заголовками сессии.
+// Запросы выполняются параллельно, поэтому изменение сессии гарантированно действует только
+// на запросы, отправленные после получения ответа на него.
+
+const (
+	MaxSessionHeaders = 32
+)
+
+// Состояние сессии для httpsocket.getsession
+type SessionInfo struct {
+	XRealIp          string            `json:"x_real_ip"`
+	Headers          map[string]string `json:"headers"`
+	StrictJsonRpc    bool              `json:"strict_jsonrpc"`
+	InFlightRequests int               `json:"in_flight_requests"`
+	Identity         *Identity         `json:"identity,omitempty"`
+}
+
+// Сохранить заголовки сессии; params - объект {"имя": "значение"}
+func (c *ProxyClient) setSessionHeaders(params json.RawMessage) error {
+	headers := map[string]string{}
+	if err := json.Unmarshal(params, &headers); err != nil || len(headers) == 0 {
+		return fmt.Errorf("params must be a non-empty object of header names and values")
+	}
+	for name, value := range headers {
+		if !c.params().SessionHeaderPolicy.Allows(name) {
+			return fmt.Errorf("header not allowed: %s", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("malformed value of header %s", name)
+		}
+	}
+
+	c.sessionLock.Lock()
+	defer c.sessionLock.Unlock()
+	updated := c.sessionHeaders.Clone()
+	if updated == nil {
+		updated = http.Header{}
+	}
+	for name, value := range headers {
+		updated.Set(name, value)
+	}
+	if len(updated) > MaxSessionHeaders {
+		return fmt.Errorf("too many session headers (max %d)", MaxSessionHeaders)
+	}
+	c.sessionHeaders = updated
+	return nil
+}
+
+// Убрать заголовки сессии; params - массив имен, если не указаны - убрать все
+func (c *ProxyClient) unsetSessionHeaders(params json.RawMessage) error {
+	var names []string
+	if len(params) > 0 && string(params) != "null" {
+		if err := json.Unmarshal(params, &names); err != nil {
+			return fmt.Errorf("params must be an array of header names")
+		}
+	}
+
+	c.sessionLock.Lock()
+	defer c.sessionLock.Unlock()
+	if names == nil {
+		c.sessionHeaders = nil
+		return nil
+	}
+	updated := c.sessionHeaders.Clone()
+	for _, name := range names {
+		updated.Del(name)
+	}
+	c.sessionHeaders = updated
+	return nil
+}
+
+// Добавить заголовки сессии к запросу апстриму
+func (c *ProxyClient) applySessionHeaders(httpRq *http.Request) {
+	c.sessionLock.Lock()
+	defer c.sessionLock.Unlock()
+	for name, values := range c.sessionHeaders {
+		httpRq.Header[name] = values
+	}
+}
+
+// Текущее состояние сессии
+func (c *ProxyClient) sessionInfo() *SessionInfo {
+	clientIp, _ := c.clientAddress()
+	info := &SessionInfo{
+		XRealIp:       clientIp,
+		Headers:       map[string]string{},
+		StrictJsonRpc: c.strictJsonRpc,
+		Identity:      c.identity,
+	}
+	c.sessionLock.Lock()
+	for name := range c.sessionHeaders {
+		info.Headers[name] = c.sessionHeaders.Get(name)
+	}
+	c.sessionLock.Unlock()
+
+	c.inFlight.lock.Lock()
+	info.InFlightRequests = len(c.inFlight.requests)
+	c.inFlight.lock.Unlock()
+	return info
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+)
+
+// Заголовок name запроса, который увидел тестовый апстрим, из ответа в вебсокет
+func wsUpstreamHeader(t *testing.T, resp map[string]interface{}, name string) string {
+	result, _ := resp["result"].(map[string]interface{})
+	header, _ := result["header"].(map[string]interface{})
+	values, _ := header[name].([]interface{})
+	if len(values) == 0 {
+		return ""
+	}
+	value, _ := values[0].(string)
+	return value
+}
+
+func TestSessionHeaders(t *testing.T) {
+	upstream := newTestUpstream(t)
+	defer upstream.Close()
+	p := newTestProxy(t, nil)
+	conn := dialTestProxy(t, p, "")
+	request := `"method": "GET ` + upstream.URL + `/a"`
+
+	wsSend(t, conn, `{"id": 1, "method": "httpsocket.setheaders", "params": {"Authorization": "Bearer t", "x-app-version": "3.1"}}`)
+	if resp := wsReceive(t, conn); resp["result"] != "ok" {
+		t.Fatalf("setheaders: got %v", resp)
+	}
+	wsSend(t, conn, `{"id": 2, `+request+`}`)
+	resp := wsReceive(t, conn)
+	if wsUpstreamHeader(t, resp, "Authorization") != "Bearer t" || wsUpstreamHeader(t, resp, "X-App-Version") != "3.1" {
+		t.Errorf("session headers not passed: %v", resp["result"])
+	}
+	// заголовки конверта имеют приоритет над заголовками сессии
+	wsSend(t, conn, `{"id": 3, `+request+`, "params": {"httpsocket.request": {"headers": {"X-App-Version": "4.0"}}}}`)
+	if resp := wsReceive(t, conn); wsUpstreamHeader(t, resp, "X-App-Version") != "4.0" {
+		t.Errorf("envelope header overridden by session: %v", resp["result"])
+	}
+
+	for _, params := range []string{`{"Cookie": "a=1"}`, `{"X-Real-IP": "10.0.0.1"}`, `{"Accept": "a\r\nX: 1"}`, `{}`, `["Accept"]`} {
+		wsSend(t, conn, `{"id": 4, "method": "httpsocket.setheaders", "params": `+params+`}`)
+		if resp := wsReceive(t, conn); strictErrorCode(resp) != ErrCodeGenericBadRequest {
+			t.Errorf("setheaders %s: got %v", params, resp)
+		}
+	}
+
+	wsSend(t, conn, `{"id": 5, "method": "httpsocket.getsession"}`)
+	info, _ := wsReceive(t, conn)["result"].(map[string]interface{})
+	headers, _ := info["headers"].(map[string]interface{})
+	if len(headers) != 2 || headers["Authorization"] != "Bearer t" || headers["X-App-Version"] != "3.1" {
+		t.Errorf("getsession: got %v", info)
+	}
+
+	wsSend(t, conn, `{"id": 6, "method": "httpsocket.unsetheaders", "params": ["authorization"]}`)
+	wsReceive(t, conn)
+	wsSend(t, conn, `{"id": 7, `+request+`}`)
+	resp = wsReceive(t, conn)
+	if wsUpstreamHeader(t, resp, "Authorization") != "" || wsUpstreamHeader(t, resp, "X-App-Version") != "3.1" {
+		t.Errorf("unsetheaders with names: %v", resp["result"])
+	}
+	wsSend(t, conn, `{"id": 8, "method": "httpsocket.unsetheaders"}`)
+	wsReceive(t, conn)
+	wsSend(t, conn, `{"id": 9, `+request+`}`)
+	if resp := wsReceive(t, conn); wsUpstreamHeader(t, resp, "X-App-Version") != "" {
+		t.Errorf("unsetheaders without names: %v", resp["result"])
+	}
+
+	// сессия принадлежит соединению
+	other := dialTestProxy(t, p, "")
+	wsSend(t, conn, `{"id": 10, "method": "httpsocket.setheaders", "params": {"Accept-Language": "ru"}}`)
+	wsReceive(t, conn)
+	wsSend(t, other, `{"id": 1, `+request+`}`)
+	if resp := wsReceive(t, other); wsUpstreamHeader(t, resp, "Accept-Language") != "" {
+		t.Errorf("session header leaked to another connection: %v", resp["result"])
+	}
+}
@@ -9,7 +9,6 @@ import (
 // Счетчики числа событий в секунду, числа активных соединений/запросов, и ограничители
 type StatCounter struct {
 	parentCounter              *StatCounter
-	tickLoopRunning            bool
 	unixtime                   int64
 	connectionAttemptsPerSec   int64
 	connectionsPerSec          int64
@@ -18,6 +17,26 @@ type StatCounter struct {
 	requestsPerSec             int64
 	responsesPerSec            int64
 	activeRequests             int64
+	circuitBrokenPerSec        int64
+	cacheHitsPerSec            int64
+	cacheRevalidatedPerSec     int64
+	cacheMissesPerSec          int64
+	coalescedPerSec            int64
+
+	// накопленные с запуска значения (для /metrics)
+	connectionAttemptsTotal   int64
+	connectionsTotal          int64
+	throttledConnectionsTotal int64
+	requestsTotal             int64
+	responsesTotal            int64
+	circuitBrokenTotal        int64
+	cacheHitsTotal            int64
+	cacheRevalidatedTotal     int64
+	cacheMissesTotal          int64
+	coalescedTotal            int64
+
+	lastSecondRequests int64 // число запросов за последнюю завершившуюся секунду
+	lastActivityNs     int64 // время последнего начала или завершения запроса, UnixNano
 }
 
 func NewStatCounter(parentCounter *StatCounter) *StatCounter {
@@ -28,33 +47,67 @@ func NewStatCounter(parentCounter *StatCounter) *StatCounter {
 }
 
 func (sc *StatCounter) TickingLoop() {
-	sc.tickLoopRunning = true
 	for now := range time.Tick(1 * time.Second) {
 		nowUnix := now.Unix()
 		scCopy := sc.Tick(nowUnix)
 		if scCopy.activeConnections == 0 && scCopy.requestsPerSec == 0 && scCopy.responsesPerSec == 0 {
 			continue
 		}
-		log.Printf("New conns per sec: %d; Active conns: %d; Throttled conns: %d; RPS: %d; Handled RPS: %d; Active requests: %d",
+		if !logger.Enabled(LevelInfo) {
+			continue
+		}
+		if logger.Format() != LogFormatText {
+			logInfof(Fields(
+				"new_conns_per_sec", scCopy.connectionsPerSec,
+				"active_conns", scCopy.activeConnections,
+				"throttled_conns", scCopy.throttledConnectionsPerSec,
+				"rps", scCopy.requestsPerSec,
+				"handled_rps", scCopy.responsesPerSec,
+				"active_requests", scCopy.activeRequests,
+				"circuit_broken_rps", scCopy.circuitBrokenPerSec,
+				"cache_hits", scCopy.cacheHitsPerSec,
+				"cache_revalidated", scCopy.cacheRevalidatedPerSec,
+				"cache_misses", scCopy.cacheMissesPerSec,
+				"coalesced_rps", scCopy.coalescedPerSec,
+			), "stats")
+			continue
+		}
+		log.Printf("New conns per sec: %d; Active conns: %d; Throttled conns: %d; RPS: %d; Handled RPS: %d; Active requests: %d; Circuit-broken RPS: %d; Cache hits/revalidated/misses: %d/%d/%d (hit ratio %.1f%%); Coalesced RPS: %d",
 			scCopy.connectionsPerSec, scCopy.activeConnections, scCopy.throttledConnectionsPerSec,
-			scCopy.requestsPerSec, scCopy.responsesPerSec, scCopy.activeRequests)
+			scCopy.requestsPerSec, scCopy.responsesPerSec, scCopy.activeRequests, scCopy.circuitBrokenPerSec,
+			scCopy.cacheHitsPerSec, scCopy.cacheRevalidatedPerSec, scCopy.cacheMissesPerSec, scCopy.CacheHitRatio()*100,
+			scCopy.coalescedPerSec)
 	}
 }
 
 // Сбрасывает счетчики для начала новой секунды.
 // Возвращает копию sc с замороженными на предыдущей секунде значениями.
 func (sc *StatCounter) Tick(unixtime int64) *StatCounter {
+	return sc.reset(atomic.SwapInt64(&sc.unixtime, unixtime), unixtime)
+}
+
+func (sc *StatCounter) reset(prevUnixtime int64, unixtime int64) *StatCounter {
 	scCopy := &StatCounter{}
-	scCopy.unixtime = atomic.SwapInt64(&sc.unixtime, unixtime)
+	scCopy.unixtime = prevUnixtime
 	// counters
 	scCopy.connectionAttemptsPerSec = atomic.SwapInt64(&sc.connectionAttemptsPerSec, 0)
 	scCopy.connectionsPerSec = atomic.SwapInt64(&sc.connectionsPerSec, 0)
 	scCopy.throttledConnectionsPerSec = atomic.SwapInt64(&sc.throttledConnectionsPerSec, 0)
 	scCopy.requestsPerSec = atomic.SwapInt64(&sc.requestsPerSec, 0)
 	scCopy.responsesPerSec = atomic.SwapInt64(&sc.responsesPerSec, 0)
+	scCopy.circuitBrokenPerSec = atomic.SwapInt64(&sc.circuitBrokenPerSec, 0)
+	scCopy.cacheHitsPerSec = atomic.SwapInt64(&sc.cacheHitsPerSec, 0)
+	scCopy.cacheRevalidatedPerSec = atomic.SwapInt64(&sc.cacheRevalidatedPerSec, 0)
+	scCopy.cacheMissesPerSec = atomic.SwapInt64(&sc.cacheMissesPerSec, 0)
+	scCopy.coalescedPerSec = atomic.SwapInt64(&sc.coalescedPerSec, 0)
 	// gauges
 	scCopy.activeConnections = atomic.LoadInt64(&sc.activeConnections)
 	scCopy.activeRequests = atomic.LoadInt64(&sc.activeRequests)
+	if unixtime-prevUnixtime == 1 {
+		atomic.StoreInt64(&sc.lastSecondRequests, scCopy.requestsPerSec)
+	} else {
+		atomic.StoreInt64(&sc.lastSecondRequests, 0) // предыдущая секунда прошла без запросов
+	}
 	return scCopy
 }
 
@@ -62,12 +115,13 @@ func (sc *StatCounter) TickIfNeeded(t time.Time) {
 	nowUnix := t.Unix()
 	prevUnix := atomic.SwapInt64(&sc.unixtime, nowUnix)
 	if prevUnix < nowUnix {
-		sc.Tick(nowUnix)
+		sc.reset(prevUnix, nowUnix)
 	}
 }
 
 func (sc *StatCounter) ConnectionAttempt() {
 	atomic.AddInt64(&sc.connectionAttemptsPerSec, 1)
+	atomic.AddInt64(&sc.connectionAttemptsTotal, 1)
 	if sc.parentCounter != nil {
 		sc.parentCounter.ConnectionAttempt()
 	}
@@ -75,6 +129,7 @@ func (sc *StatCounter) ConnectionAttempt() {
 
 func (sc *StatCounter) OpenedConnection() {
 	atomic.AddInt64(&sc.connectionsPerSec, 1)
+	atomic.AddInt64(&sc.connectionsTotal, 1)
 	atomic.AddInt64(&sc.activeConnections, 1)
 	if sc.parentCounter != nil {
 		sc.parentCounter.OpenedConnection()
@@ -89,7 +144,9 @@ func (sc *StatCounter) ClosedConnection() {
 }
 
 func (sc *StatCounter) RequestStarted() {
+	atomic.StoreInt64(&sc.lastActivityNs, time.Now().UnixNano())
 	atomic.AddInt64(&sc.requestsPerSec, 1)
+	atomic.AddInt64(&sc.requestsTotal, 1)
 	atomic.AddInt64(&sc.activeRequests, 1)
 	if sc.parentCounter != nil {
 		sc.parentCounter.RequestStarted()
@@ -97,41 +154,83 @@ func (sc *StatCounter) RequestStarted() {
 }
 
 func (sc *StatCounter) RequestFinished() {
+	atomic.StoreInt64(&sc.lastActivityNs, time.Now().UnixNano())
 	atomic.AddInt64(&sc.responsesPerSec, 1)
+	atomic.AddInt64(&sc.responsesTotal, 1)
 	atomic.AddInt64(&sc.activeRequests, -1)
 	if sc.parentCounter != nil {
 		sc.parentCounter.RequestFinished()
 	}
 }
 
-func (sc *StatCounter) ConnectionThrottled() {
-	atomic.AddInt64(&sc.throttledConnectionsPerSec, 1)
+func (sc *StatCounter) RequestCircuitBroken() {
+	atomic.AddInt64(&sc.circuitBrokenPerSec, 1)
+	atomic.AddInt64(&sc.circuitBrokenTotal, 1)
 	if sc.parentCounter != nil {
-		sc.parentCounter.ConnectionThrottled()
+		sc.parentCounter.RequestCircuitBroken()
 	}
 }
 
-// Проверить превышение счетчиков за текущую секунду.
-// Заснуть до наступления следующей секунды при превышении.
-func (sc *StatCounter) ThrottleIfNeeded(now time.Time, rpsLimit int, activeRequestsLimit int) {
-	if rpsLimit > 0 && int64(rpsLimit) <= atomic.LoadInt64(&sc.requestsPerSec) {
-		sc.throttle(now)
-	} else if activeRequestsLimit > 0 && int64(activeRequestsLimit) <= atomic.LoadInt64(&sc.activeRequests) {
-		sc.throttle(now)
+// Запрос присоединился к уже выполняющемуся такому же запросу к апстриму
+func (sc *StatCounter) RequestCoalesced() {
+	atomic.AddInt64(&sc.coalescedPerSec, 1)
+	atomic.AddInt64(&sc.coalescedTotal, 1)
+	if sc.parentCounter != nil {
+		sc.parentCounter.RequestCoalesced()
 	}
 }
 
-const (
-	NanosecondsPerSecond = 1000000000
-)
+func (sc *StatCounter) CacheHit() {
+	atomic.AddInt64(&sc.cacheHitsPerSec, 1)
+	atomic.AddInt64(&sc.cacheHitsTotal, 1)
+	if sc.parentCounter != nil {
+		sc.parentCounter.CacheHit()
+	}
+}
 
-func (sc *StatCounter) throttle(now time.Time) {
-	sc.ConnectionThrottled()
-	nowNs := now.Nanosecond()
-	remainingNs := NanosecondsPerSecond - nowNs + 1
-	time.Sleep(time.Duration(remainingNs) * time.Nanosecond)
-	newNow := time.Now()
-	if !sc.tickLoopRunning {
-		sc.TickIfNeeded(newNow)
+func (sc *StatCounter) CacheRevalidated() {
+	atomic.AddInt64(&sc.cacheRevalidatedPerSec, 1)
+	atomic.AddInt64(&sc.cacheRevalidatedTotal, 1)
+	if sc.parentCounter != nil {
+		sc.parentCounter.CacheRevalidated()
+	}
+}
+
+func (sc *StatCounter) CacheMiss() {
+	atomic.AddInt64(&sc.cacheMissesPerSec, 1)
+	atomic.AddInt64(&sc.cacheMissesTotal, 1)
+	if sc.parentCounter != nil {
+		sc.parentCounter.CacheMiss()
+	}
+}
+
+// Доля ответов из кеша (включая перепроверенные) среди запросов, которые могли быть им обслужены
+func (sc *StatCounter) CacheHitRatio() float64 {
+	hits := atomic.LoadInt64(&sc.cacheHitsPerSec) + atomic.LoadInt64(&sc.cacheRevalidatedPerSec)
+	total := hits + atomic.LoadInt64(&sc.cacheMissesPerSec)
+	if total == 0 {
+		return 0
+	}
+	return float64(hits) / float64(total)
+}
+
+// Число запросов за последнюю завершившуюся секунду перед now.
+// Счетчики клиентов сбрасываются только при их запросах, поэтому у простаивающего
+// клиента значения могут относиться к давно прошедшей секунде.
+func (sc *StatCounter) RecentRps(now time.Time) int64 {
+	switch atomic.LoadInt64(&sc.unixtime) {
+	case now.Unix():
+		return atomic.LoadInt64(&sc.lastSecondRequests)
+	case now.Unix() - 1:
+		return atomic.LoadInt64(&sc.requestsPerSec)
+	}
+	return 0
+}
+
+func (sc *StatCounter) ConnectionThrottled() {
+	atomic.AddInt64(&sc.throttledConnectionsPerSec, 1)
+	atomic.AddInt64(&sc.throttledConnectionsTotal, 1)
+	if sc.parentCounter != nil {
+		sc.parentCounter.ConnectionThrottled()
 	}
 }
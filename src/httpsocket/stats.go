@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Статистика в JSON (/stats на -admin-listen): общие счетчики и все открытые вебсокеты
+// со счетчиками каждого клиента - чтобы во время инцидента найти шумного клиента.
+//
+// Параметры запроса:
+//
+// * sort - по какому полю сортировать соединения (по убыванию): rps (по умолчанию),
+//   active_requests, total_requests, throttled, connected_at, last_activity;
+// * limit - сколько первых соединений отдать (0 или не задан - все).
+//
+//     curl 'localhost:6067/stats?sort=active_requests&limit=10'
+
+// Значения счетчиков StatCounter
+type StatCounterStatus struct {
+	Rps            int64      `json:"rps"` // за последнюю завершившуюся секунду
+	ActiveRequests int64      `json:"active_requests"`
+	TotalRequests  int64      `json:"total_requests"`
+	Throttled      int64      `json:"throttled"` // сколько раз клиент был приторможен
+	LastActivity   *time.Time `json:"last_activity,omitempty"`
+}
+
+// Общая статистика
+type GlobalStatus struct {
+	StatCounterStatus
+	ActiveConnections  int64 `json:"active_connections"`
+	TotalConnections   int64 `json:"total_connections"`
+	ConnectionAttempts int64 `json:"connection_attempts"`
+}
+
+// Статистика соединения
+type ClientStatus struct {
+	Id          uint64    `json:"id"`
+	RemoteAddr  string    `json:"remote_addr"`
+	RealIp      string    `json:"real_ip"`
+	Origin      string    `json:"origin,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	UserId      string    `json:"user_id,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+	StatCounterStatus
+}
+
+type StatsResponse struct {
+	Global      GlobalStatus   `json:"global"`
+	Connections []ClientStatus `json:"connections"`
+}
+
+// Значения счетчиков на момент now
+func (sc *StatCounter) Status(now time.Time) StatCounterStatus {
+	st := StatCounterStatus{
+		Rps:            sc.RecentRps(now),
+		ActiveRequests: atomic.LoadInt64(&sc.activeRequests),
+		TotalRequests:  atomic.LoadInt64(&sc.requestsTotal),
+		Throttled:      atomic.LoadInt64(&sc.throttledConnectionsTotal),
+	}
+	if ns := atomic.LoadInt64(&sc.lastActivityNs); ns > 0 {
+		t := time.Unix(0, ns)
+		st.LastActivity = &t
+	}
+	return st
+}
+
+// Открытые вебсокеты
+type ClientRegistry struct {
+	lock    sync.Mutex
+	clients map[*ProxyClient]struct{}
+}
+
+var (
+	activeClients = &ClientRegistry{clients: map[*ProxyClient]struct{}{}}
+	lastClientId  uint64 // atomic
+)
+
+func (cr *ClientRegistry) Add(c *ProxyClient) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	cr.clients[c] = struct{}{}
+}
+
+func (cr *ClientRegistry) Remove(c *ProxyClient) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	delete(cr.clients, c)
+}
+
+// Статистика всех соединений
+func (cr *ClientRegistry) Status(now time.Time) []ClientStatus {
+	cr.lock.Lock()
+	clients := make([]*ProxyClient, 0, len(cr.clients))
+	for c := range cr.clients {
+		clients = append(clients, c)
+	}
+	cr.lock.Unlock()
+
+	result := make([]ClientStatus, len(clients))
+	for i, c := range clients {
+		realIp, _ := c.clientAddress()
+		result[i] = ClientStatus{
+			Id:                c.id,
+			RemoteAddr:        c.originalRequest.RemoteAddr,
+			RealIp:            realIp,
+			Origin:            c.originalRequest.Header.Get("Origin"),
+			UserAgent:         c.originalRequest.UserAgent(),
+			ConnectedAt:       c.connectedAt,
+			StatCounterStatus: c.statCounter.Status(now),
+		}
+		if c.identity != nil {
+			result[i].UserId = c.identity.UserId
+		}
+	}
+	return result
+}
+
+// Функции сравнения соединений для сортировки по убыванию поля
+var clientStatusOrderings = map[string]func(a, b *ClientStatus) bool{
+	"rps":             func(a, b *ClientStatus) bool { return a.Rps > b.Rps },
+	"active_requests": func(a, b *ClientStatus) bool { return a.ActiveRequests > b.ActiveRequests },
+	"total_requests":  func(a, b *ClientStatus) bool { return a.TotalRequests > b.TotalRequests },
+	"throttled":       func(a, b *ClientStatus) bool { return a.Throttled > b.Throttled },
+	"connected_at":    func(a, b *ClientStatus) bool { return a.ConnectedAt.After(b.ConnectedAt) },
+	"last_activity": func(a, b *ClientStatus) bool {
+		return a.LastActivity != nil && (b.LastActivity == nil || a.LastActivity.After(*b.LastActivity))
+	},
+}
+
+// Отдать статистику
+func serveStats(w http.ResponseWriter, r *http.Request) {
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy == "" {
+		sortBy = "rps"
+	}
+	less, ok := clientStatusOrderings[sortBy]
+	if !ok {
+		http.Error(w, "unknown sort field "+sortBy, http.StatusBadRequest)
+		return
+	}
+	limit := 0
+	if s := r.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			http.Error(w, "limit must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := time.Now()
+	sc := globalStatCounter
+	resp := StatsResponse{
+		Global: GlobalStatus{
+			StatCounterStatus:  sc.Status(now),
+			ActiveConnections:  atomic.LoadInt64(&sc.activeConnections),
+			TotalConnections:   atomic.LoadInt64(&sc.connectionsTotal),
+			ConnectionAttempts: atomic.LoadInt64(&sc.connectionAttemptsTotal),
+		},
+		Connections: activeClients.Status(now),
+	}
+	sort.SliceStable(resp.Connections, func(i, j int) bool {
+		a, b := &resp.Connections[i], &resp.Connections[j]
+		if less(a, b) != less(b, a) {
+			return less(a, b)
+		}
+		return a.Id < b.Id
+	})
+	if limit > 0 && len(resp.Connections) > limit {
+		resp.Connections = resp.Connections[:limit]
+	}
+	writeJsonResponse(w, resp)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Ответ /stats с параметрами query
+func getStats(t *testing.T, query string) (int, *StatsResponse) {
+	w := httptest.NewRecorder()
+	serveStats(w, httptest.NewRequest("GET", "/stats?"+query, nil))
+	if w.Code != http.StatusOK {
+		return w.Code, nil
+	}
+	resp := &StatsResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+		t.Fatalf("malformed stats %q: %s", w.Body.String(), err)
+	}
+	return w.Code, resp
+}
+
+func TestStats(t *testing.T) {
+	upstream := newTestUpstream(t)
+	defer upstream.Close()
+	p := newTestProxy(t, nil)
+	// соединения других тестов могут еще не закрыться, поэтому свои отмечаем User-Agent
+	agents := []string{"stats-quiet", "stats-medium", "stats-busy"}
+	for i, agent := range agents {
+		conn := dialTestProxyWithHeader(t, p, "", http.Header{"User-Agent": {agent}})
+		for n := 0; n < i*i*10; n++ {
+			wsSend(t, conn, `{"id": 1, "method": "GET `+upstream.URL+`/a"}`)
+			wsReceive(t, conn)
+		}
+	}
+
+	_, stats := getStats(t, "sort=total_requests")
+	order := []string{}
+	for _, c := range stats.Connections {
+		for i, agent := range agents {
+			if c.UserAgent == agent {
+				order = append(order, agent)
+				if c.TotalRequests != int64(i*i*10) || c.RealIp == "" || c.ConnectedAt.IsZero() {
+					t.Errorf("unexpected connection status %+v", c)
+				}
+			}
+		}
+	}
+	if len(order) != 3 || order[0] != "stats-busy" || order[1] != "stats-medium" || order[2] != "stats-quiet" {
+		t.Errorf("sort=total_requests: got %v", order)
+	}
+	if stats.Global.ActiveConnections < 3 || stats.Global.TotalRequests < 50 {
+		t.Errorf("unexpected global status %+v", stats.Global)
+	}
+
+	_, stats = getStats(t, "sort=total_requests&limit=1")
+	if len(stats.Connections) != 1 || stats.Connections[0].UserAgent != "stats-busy" {
+		t.Errorf("limit=1: got %+v", stats.Connections)
+	}
+	for _, query := range []string{"sort=user_agent", "limit=-1", "limit=x"} {
+		if code, _ := getStats(t, query); code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d", query, code)
+		}
+	}
+}
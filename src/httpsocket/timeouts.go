@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	urlmodule "net/url"
+	"strings"
+	"time"
+)
+
+// Таймауты проксируемых запросов.
+//
+// Таймаут выбирается так:
+//
+// 1. по самому длинному подходящему префиксу пути из ByPathPrefix;
+// 2. иначе таймаут апстрима из таблицы маршрутизации, если он задан;
+// 3. иначе по HTTP-методу из ByMethod;
+// 4. иначе Default.
+//
+// Префиксы сравниваются с путем, который запросил клиент, - до того, как маршрут
+// отрежет или заменит его начало (см. Route.MakeUrl).
+//
+// Клиент может передать в запросе timeout_ms; он заменяет выбранный таймаут,
+// но не может превышать Max (если Max не задан - выбранный таймаут).
+//
+// Таймаут покрывает весь запрос, включая чтение тела ответа.
+type TimeoutPolicy struct {
+	Default      time.Duration
+	ByMethod     map[string]time.Duration
+	ByPathPrefix []KeyedTimeout
+	Max          time.Duration
+}
+
+// Таймаут для HTTP-метода или префикса пути
+type KeyedTimeout struct {
+	Key     string
+	Timeout time.Duration
+}
+
+// Таймаут для запроса method к пути path апстрима с таймаутом upstreamTimeout (0 - не задан)
+func (p *TimeoutPolicy) For(method string, path string, upstreamTimeout time.Duration, clientTimeoutMs int) time.Duration {
+	timeout := p.Default
+	if t, ok := p.ByMethod[method]; ok {
+		timeout = t
+	}
+	if upstreamTimeout > 0 {
+		timeout = upstreamTimeout
+	}
+	longestPrefix := -1
+	for _, pt := range p.ByPathPrefix {
+		if strings.HasPrefix(path, pt.Key) && len(pt.Key) > longestPrefix {
+			longestPrefix = len(pt.Key)
+			timeout = pt.Timeout
+		}
+	}
+	if clientTimeoutMs > 0 {
+		limit := p.Max
+		if limit == 0 {
+			limit = timeout
+		}
+		timeout = time.Duration(clientTimeoutMs) * time.Millisecond
+		if timeout > limit {
+			timeout = limit
+		}
+	}
+	return timeout
+}
+
+// Путь из адреса запроса клиента: "/a/b?x=1" или "http://host/a/b?x=1" -> "/a/b"
+func requestPath(url string) string {
+	if u, err := urlmodule.Parse(url); err == nil {
+		return u.Path
+	}
+	return strings.SplitN(url, "?", 2)[0]
+}
+
+// Разобрать список вида "KEY=DURATION,KEY=DURATION" (например "GET=10s,POST=1m")
+func ParseTimeoutList(s string) ([]KeyedTimeout, error) {
+	result := []KeyedTimeout{}
+	for _, item := range SplitCommaList(s) {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed timeout %q: expected KEY=DURATION", item)
+		}
+		t, err := time.ParseDuration(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("malformed timeout %q: %s", item, err)
+		}
+		result = append(result, KeyedTimeout{Key: strings.TrimSpace(kv[0]), Timeout: t})
+	}
+	return result, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeoutPolicy(t *testing.T) {
+	byPath, err := ParseTimeoutList("/api/=5s, /api/slow/=1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &TimeoutPolicy{
+		Default:      30 * time.Second,
+		ByMethod:     map[string]time.Duration{"POST": 45 * time.Second},
+		ByPathPrefix: byPath,
+		Max:          2 * time.Minute,
+	}
+	cases := []struct {
+		method          string
+		url             string
+		upstreamTimeout time.Duration
+		clientTimeoutMs int
+		expected        time.Duration
+	}{
+		{"GET", "/other", 0, 0, 30 * time.Second},
+		{"POST", "/other", 0, 0, 45 * time.Second},
+		{"POST", "/other", 10 * time.Second, 0, 10 * time.Second},
+		{"GET", "/api/x?slow=1", 10 * time.Second, 0, 5 * time.Second},
+		{"GET", "/api/slow/x", 0, 0, time.Minute},
+		{"GET", "http://up.lan/api/slow/x?q", 0, 0, time.Minute},
+		{"GET", "/api/x", 0, 500, 500 * time.Millisecond},
+		{"GET", "/api/x", 0, 600000, 2 * time.Minute},
+	}
+	for _, c := range cases {
+		if timeout := p.For(c.method, requestPath(c.url), c.upstreamTimeout, c.clientTimeoutMs); timeout != c.expected {
+			t.Errorf("%s %s: got %s, expected %s", c.method, c.url, timeout, c.expected)
+		}
+	}
+
+	p.Max = 0
+	if timeout := p.For("GET", "/api/x", 0, 600000); timeout != 5*time.Second {
+		t.Errorf("client timeout without Max: got %s", timeout)
+	}
+	if _, err := ParseTimeoutList("/api/"); err == nil {
+		t.Error("entry without duration accepted")
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	urlmodule "net/url"
+	pathmodule "path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Правила, к каким апстримам можно проксировать запросы с явно указанным адресом
+// (запросы по таблице маршрутизации ими не проверяются).
+//
+// Правила загружаются из JSON-файла и проверяются по порядку; решение принимает первое
+// подошедшее правило. Если ни одно правило не подошло, запрос отклоняется:
+//
+//     {
+//         "rules": [
+//             {"name": "no-admin", "action": "deny", "path_regex": "^/(admin|internal)/"},
+//             {"name": "public-api", "hosts": ["*.example.com"], "schemes": ["https"],
+//              "path_prefix": "/api/", "methods": ["GET", "POST"]},
+//             {"name": "legacy", "hosts": ["legacy.lan"], "ports": [8080]}
+//         ]
+//     }
+//
+// Все условия правила необязательны, незаданное условие подходит для любого запроса:
+//
+// * hosts - шаблоны имени хоста без порта, без учета регистра; `*` соответствует любой
+//   последовательности символов (в том числе с точками), `?` - одному символу;
+// * schemes - http и/или https;
+// * ports - порты; если порт не указан в адресе, подразумевается 80 для http и 443 для https;
+// * path_prefix - префикс пути; path_regex - регулярное выражение для пути (не привязано к
+//   началу и концу пути, если в нем нет ^ и $). Путь перед проверкой нормализуется
+//   (убираются "." и "..");
+// * methods - HTTP-методы;
+// * action - allow (по умолчанию) или deny.
+//
+// Каждый элемент -upstream-host-whitelist превращается в разрешающее правило для хоста,
+// добавляемое после правил из файла: "host:port" разрешает только указанный порт, "host" -
+// только порт по умолчанию (80 для http, 443 для https).
+//
+// Ошибка отклоненного запроса содержит имя правила, которое его запретило.
+//
+// Выключатели (breaker.go) и метрики (metrics.go) заводятся не на каждый хост, указанный
+// клиентом, а на разрешившее запрос правило ("(rule public-api)") или, если правил нет, одни
+// на все такие запросы (DirectUpstreamName) - так их число ограничено настройками, а не клиентами.
+
+const (
+	UpstreamRuleAllow = "allow"
+	UpstreamRuleDeny  = "deny"
+
+	// под каким именем учитываются запросы по явному адресу, если правил нет
+	DirectUpstreamName = "(direct)"
+)
+
+type UpstreamRule struct {
+	Name       string   `json:"name"`
+	Action     string   `json:"action"`
+	Hosts      []string `json:"hosts"`
+	Schemes    []string `json:"schemes"`
+	Ports      []int    `json:"ports"`
+	PathPrefix string   `json:"path_prefix"`
+	PathRegex  string   `json:"path_regex"`
+	Methods    []string `json:"methods"`
+
+	pathRegex       *regexp.Regexp
+	defaultPortOnly bool // только порт по умолчанию для схемы (элемент -upstream-host-whitelist без порта)
+}
+
+// Набор правил; пустой набор разрешает любые апстримы
+type UpstreamRuleSet struct {
+	Rules []*UpstreamRule `json:"rules"`
+}
+
+// Загрузить правила из JSON-файла
+func LoadUpstreamRules(filename string) (*UpstreamRuleSet, error) {
+	bs, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := ParseUpstreamRules(bs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return rs, nil
+}
+
+// Разобрать правила из JSON: объект {"rules": [...]} или просто массив правил
+func ParseUpstreamRules(bs []byte) (*UpstreamRuleSet, error) {
+	rs := &UpstreamRuleSet{}
+	var err error
+	if trimmed := bytes.TrimSpace(bs); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(bs, &rs.Rules)
+	} else {
+		err = json.Unmarshal(bs, rs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range rs.Rules {
+		if err := r.compile(i); err != nil {
+			return nil, err
+		}
+	}
+	return rs, nil
+}
+
+// Добавить разрешающие правила для хостов из списка вида "host" или "host:port"
+func (rs *UpstreamRuleSet) AddHostWhitelist(hosts []string) error {
+	for _, h := range hosts {
+		host, port, err := splitHostPortOptional(h)
+		if err != nil {
+			return fmt.Errorf("malformed host %q", h)
+		}
+		r := &UpstreamRule{Name: "whitelist " + h, Hosts: []string{host}, defaultPortOnly: true}
+		if port != "" {
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				return fmt.Errorf("malformed port in %q", h)
+			}
+			r.Ports, r.defaultPortOnly = []int{p}, false
+		}
+		if err := r.compile(len(rs.Rules)); err != nil {
+			return err
+		}
+		rs.Rules = append(rs.Rules, r)
+	}
+	return nil
+}
+
+// Проверить правило и подготовить его к использованию; i - номер правила
+func (r *UpstreamRule) compile(i int) error {
+	if r.Name == "" {
+		r.Name = fmt.Sprintf("#%d", i+1)
+	}
+	switch r.Action {
+	case "":
+		r.Action = UpstreamRuleAllow
+	case UpstreamRuleAllow, UpstreamRuleDeny:
+	default:
+		return fmt.Errorf("rule %s: unknown action %s", r.Name, r.Action)
+	}
+	for i, h := range r.Hosts {
+		r.Hosts[i] = strings.ToLower(h)
+		if _, err := pathmodule.Match(r.Hosts[i], ""); err != nil {
+			return fmt.Errorf("rule %s: malformed host pattern %q", r.Name, h)
+		}
+	}
+	for i, s := range r.Schemes {
+		r.Schemes[i] = strings.ToLower(s)
+	}
+	for i, m := range r.Methods {
+		r.Methods[i] = strings.ToUpper(m)
+	}
+	if r.PathRegex != "" {
+		re, err := regexp.Compile(r.PathRegex)
+		if err != nil {
+			return fmt.Errorf("rule %s: %s", r.Name, err)
+		}
+		r.pathRegex = re
+	}
+	return nil
+}
+
+// Включены ли правила вообще?
+func (rs *UpstreamRuleSet) Enabled() bool {
+	return rs != nil && len(rs.Rules) > 0
+}
+
+// Проверить, можно ли проксировать запрос method по адресу u.
+// Возвращает ошибку с именем запретившего правила.
+func (rs *UpstreamRuleSet) Check(method string, u *urlmodule.URL) error {
+	_, err := rs.Match(method, u)
+	return err
+}
+
+// То же, что Check, но возвращает разрешившее правило (nil, если набор пуст)
+func (rs *UpstreamRuleSet) Match(method string, u *urlmodule.URL) (*UpstreamRule, error) {
+	if !rs.Enabled() {
+		return nil, nil
+	}
+	for _, r := range rs.Rules {
+		if !r.Matches(method, u) {
+			continue
+		}
+		if r.Action == UpstreamRuleDeny {
+			return nil, fmt.Errorf("upstream %s denied by rule %s", u.Host, r.Name)
+		}
+		return r, nil
+	}
+	return nil, fmt.Errorf("upstream not allowed: no rule allows %s %s://%s%s", method, u.Scheme, u.Host, u.EscapedPath())
+}
+
+// Имя, под которым учитываются запросы, разрешенные правилом r (nil - правил нет)
+func (r *UpstreamRule) UpstreamName() string {
+	if r == nil {
+		return DirectUpstreamName
+	}
+	return "(rule " + r.Name + ")"
+}
+
+// Подходит ли правило для запроса method по адресу u?
+func (r *UpstreamRule) Matches(method string, u *urlmodule.URL) bool {
+	scheme := strings.ToLower(u.Scheme)
+	if len(r.Schemes) > 0 && !stringInList(scheme, r.Schemes) {
+		return false
+	}
+	if len(r.Methods) > 0 && !stringInList(method, r.Methods) {
+		return false
+	}
+	if len(r.Hosts) > 0 {
+		host := strings.ToLower(u.Hostname())
+		matched := false
+		for _, pattern := range r.Hosts {
+			if ok, _ := pathmodule.Match(pattern, host); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(r.Ports) > 0 || r.defaultPortOnly {
+		port, err := strconv.Atoi(u.Port())
+		if u.Port() == "" {
+			port, err = defaultPort(scheme), nil
+		}
+		if err != nil {
+			return false
+		}
+		if r.defaultPortOnly && port != defaultPort(scheme) {
+			return false
+		}
+		matched := len(r.Ports) == 0
+		for _, p := range r.Ports {
+			if p == port {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if r.PathPrefix != "" || r.pathRegex != nil {
+		path := normalizeUrlPath(u.Path)
+		if r.PathPrefix != "" && !strings.HasPrefix(path, r.PathPrefix) {
+			return false
+		}
+		if r.pathRegex != nil && !r.pathRegex.MatchString(path) {
+			return false
+		}
+	}
+	return true
+}
+
+// Путь без "." и ".." (так, как его поймет апстрим), с сохранением завершающего слеша
+func normalizeUrlPath(path string) string {
+	cleaned := pathmodule.Clean("/" + path)
+	if strings.HasSuffix(path, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+func defaultPort(scheme string) int {
+	if scheme == "https" {
+		return 443
+	}
+	return 80
+}
+
+// Разделить "host:port" или "host" (порт может отсутствовать)
+func splitHostPortOptional(s string) (string, string, error) {
+	u, err := urlmodule.Parse("//" + s)
+	if err != nil {
+		return "", "", err
+	}
+	return u.Hostname(), u.Port(), nil
+}
+
+func stringInList(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
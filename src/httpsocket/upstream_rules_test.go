@@ -0,0 +1,115 @@
+package main
+
+import (
+	urlmodule "net/url"
+	"strings"
+	"testing"
+)
+
+func checkUpstream(t *testing.T, rs *UpstreamRuleSet, method string, url string) error {
+	u, err := urlmodule.Parse(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rs.Check(method, u)
+}
+
+func TestHostWhitelist(t *testing.T) {
+	rs := &UpstreamRuleSet{}
+	if err := rs.AddHostWhitelist([]string{"api.example.com", "legacy.lan:8080", "*.cdn.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]bool{
+		"http://api.example.com/a":           true,
+		"https://api.example.com/a":          true,
+		"http://api.example.com:80/a":        true,
+		"https://api.example.com:443/a":      true,
+		"http://API.example.com/a":           true,
+		"http://api.example.com:6379/a":      false,
+		"http://api.example.com:22/a":        false,
+		"http://api.example.com:443/a":       false,
+		"https://api.example.com:80/a":       false,
+		"http://legacy.lan:8080/a":           true,
+		"http://legacy.lan/a":                false,
+		"http://legacy.lan:8081/a":           false,
+		"https://img.cdn.example.com/a":      true,
+		"https://img.cdn.example.com:8443/a": false,
+		"http://example.com/a":               false,
+		"http://api.example.com.evil/a":      false,
+	}
+	for url, allowed := range cases {
+		if err := checkUpstream(t, rs, "GET", url); (err == nil) != allowed {
+			t.Errorf("%s: allowed = %v, error %v", url, !allowed, err)
+		}
+	}
+	if err := rs.AddHostWhitelist([]string{"host:port"}); err == nil {
+		t.Error("malformed port should be rejected")
+	}
+}
+
+func TestUpstreamRules(t *testing.T) {
+	rs, err := ParseUpstreamRules([]byte(`[
+		{"name": "no-admin", "action": "deny", "path_regex": "^/(admin|internal)/"},
+		{"name": "public-api", "hosts": ["*.example.com"], "schemes": ["https"], "path_prefix": "/api/", "methods": ["get", "POST"]},
+		{"name": "legacy", "hosts": ["legacy.lan"], "ports": [8080]}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		method string
+		url    string
+		rule   string // "" - разрешен
+	}{
+		{"GET", "https://www.example.com/api/v1", ""},
+		{"POST", "https://www.example.com/api/v1", ""},
+		{"DELETE", "https://www.example.com/api/v1", "no rule"},
+		{"GET", "http://www.example.com/api/v1", "no rule"},
+		{"GET", "https://www.example.com/other", "no rule"},
+		{"GET", "https://www.example.com/admin/x", "no-admin"},
+		{"GET", "https://www.example.com/api/../admin/x", "no-admin"},
+		{"GET", "https://www.example.com/api/%2e%2e/admin/x", "no-admin"},
+		{"GET", "http://legacy.lan:8080/x", ""},
+		{"GET", "http://legacy.lan/x", "no rule"},
+	}
+	for _, c := range cases {
+		err := checkUpstream(t, rs, c.method, c.url)
+		switch {
+		case c.rule == "" && err != nil:
+			t.Errorf("%s %s: unexpected error %s", c.method, c.url, err)
+		case c.rule != "" && (err == nil || !strings.Contains(err.Error(), c.rule)):
+			t.Errorf("%s %s: expected rejection by %s, got %v", c.method, c.url, c.rule, err)
+		}
+	}
+
+	for _, bad := range []string{`[{"action": "maybe"}]`, `[{"path_regex": "("}]`, `[{"hosts": ["[a"]}]`} {
+		if _, err := ParseUpstreamRules([]byte(bad)); err == nil {
+			t.Errorf("%s should not parse", bad)
+		}
+	}
+}
+
+func TestUpstreamRuleNames(t *testing.T) {
+	rs := &UpstreamRuleSet{}
+	if err := rs.AddHostWhitelist([]string{"*.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, url := range []string{"http://a.example.com/", "http://b.example.com/", "http://c.example.com/x"} {
+		u, _ := urlmodule.Parse(url)
+		rule, err := rs.Match("GET", u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names[rule.UpstreamName()] = true
+	}
+	if len(names) != 1 || !names["(rule whitelist *.example.com)"] {
+		t.Errorf("expected one name for all hosts of the rule, got %v", names)
+	}
+
+	u, _ := urlmodule.Parse("http://any.host/")
+	rule, err := (&UpstreamRuleSet{}).Match("GET", u)
+	if err != nil || rule.UpstreamName() != DirectUpstreamName {
+		t.Errorf("empty rule set: got %v, %v", rule, err)
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	"runtime"
@@ -18,17 +17,17 @@ func dieOnError(err error) {
 	}
 }
 
-// Соорудить http-клиент, умеющий таймаут
-func MakeTimeoutingHttpClient(timeout time.Duration) *http.Client {
+// Соорудить http-клиент, умеющий таймаут на подключение; timeout вызывается при каждом
+// подключении, так что таймаут можно менять на лету.
+// Таймаут на весь запрос, включая чтение ответа, задается через контекст запроса.
+func MakeTimeoutingHttpClient(timeout func() time.Duration) *http.Client {
 	timeoutFn := func(network, addr string) (net.Conn, error) {
-		return net.DialTimeout(network, addr, timeout) // таймаут на подключение
+		return net.DialTimeout(network, addr, timeout()) // таймаут на подключение
 	}
 
 	transport := http.Transport{
 		Dial: timeoutFn,
-		ResponseHeaderTimeout: timeout, // таймаут на заголовки респонза
 	}
-	// таймаута на чтение ответа, похоже, нет
 
 	client := http.Client{
 		Transport: &transport,
@@ -55,12 +54,16 @@ func GetTraceback() string {
 // падение которых не должно завалить всё приложение
 func simpleRecover() {
 	if x := recover(); x != nil {
-		stack := GetTraceback()
-		errinfo := fmt.Sprintf("ERROR: PANIC: %s\n%s", x, stack)
-		log.Printf("%s", errinfo)
+		logPanic(x)
 	}
 }
 
+// Залогировать пойманную панику вместе с трейсбеком
+func logPanic(x interface{}) {
+	stack := GetTraceback()
+	logErrorf(nil, "PANIC: %s\n%s", x, stack)
+}
+
 // Сериализовать JSON, паникуя при (совершенно уж неожиданной) ошибке
 func MustMarshalJson(v interface{}) []byte {
 	bs, err := json.Marshal(v)
@@ -80,3 +83,35 @@ func IsJsonContentType(ct string) bool {
 	}
 	return false
 }
+
+// Разбить список через запятую, выбросив пустые элементы и пробелы по краям
+func SplitCommaList(s string) []string {
+	result := []string{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// Длительность, которая в JSON записывается строкой вида "1m30s"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(bs []byte) error {
+	var s string
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"10s\"")
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
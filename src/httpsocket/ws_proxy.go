@@ -1,12 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"io"
 	"io/ioutil"
-	"log"
-	"net"
 	"net/http"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -16,7 +17,20 @@ import (
 
 // Общие параметры прокси
 type WsProxy struct {
-	params ProxyParams
+	lock       sync.RWMutex
+	params     *ProxyParams
+	settings   Settings // настройки, из которых собраны params
+	configFile string
+	limiters   *Limiters // общие ограничители частоты и числа запросов (см. ratelimit.go)
+
+	reloadLock sync.Mutex
+}
+
+// Текущие параметры прокси
+func (p *WsProxy) Params() *ProxyParams {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.params
 }
 
 const (
@@ -30,6 +44,7 @@ const (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  ReadBufferSizeLimit,
 	WriteBufferSize: WriteBufferSizeLimit,
+	Subprotocols:    []string{JsonRpcSubprotocol},
 	CheckOrigin: func(r *http.Request) bool {
 		return true // проверим origin сами до Upgrader, потому что эта штука некрасиво паникует
 	},
@@ -39,14 +54,21 @@ var (
 	globalStatCounter = NewStatCounter(nil)
 )
 
-// Проверка, пускать ли клиента к вебсокету, на основе заголовка Origin
+// Проверка, пускать ли клиента к вебсокету, на основе заголовка Origin (см. origin.go)
 func (p *WsProxy) CheckOrigin(r *http.Request) bool {
-	if len(p.params.WhitelistedOrigins) == 0 {
-		return true
-	}
 	origin := r.Header.Get("Origin")
-	for _, h := range p.params.WhitelistedOrigins {
-		if h != "" && strings.HasSuffix(origin, h) {
+	ok, reason := p.Params().Origins.Check(origin)
+	if !ok {
+		logWarnf(Fields("remote_addr", r.RemoteAddr, "origin", origin), "rejected origin `%s`: %s", origin, reason)
+		rejectedOrigins.Record(origin)
+	}
+	return ok
+}
+
+// Предложил ли клиент протокол protocol в Sec-WebSocket-Protocol?
+func websocketProtocolOffered(r *http.Request, protocol string) bool {
+	for _, p := range websocket.Subprotocols(r) {
+		if p == protocol {
 			return true
 		}
 	}
@@ -55,33 +77,62 @@ func (p *WsProxy) CheckOrigin(r *http.Request) bool {
 
 // Обработчик Websocket
 func (p *WsProxy) ServeWebsocket(w http.ResponseWriter, r *http.Request) {
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	dieOnError(err)
+	params := p.Params()
+	addr := params.ResolveClientAddress(r)
 
 	globalStatCounter.ConnectionAttempt()
 
 	if !p.CheckOrigin(r) {
-		log.Printf("WARN: request from non-whitelisted origin: `%s`", r.Header.Get("Origin"))
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
-	conn, err := upgrader.Upgrade(w, r, nil)
+	identity, tokenProtocol, err := params.Auth.Authenticate(r)
+	if err != nil {
+		logWarnf(Fields("remote_addr", r.RemoteAddr), "authentication failed: %s", err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	connUpgrader := &upgrader
+	if tokenProtocol != "" && !websocketProtocolOffered(r, JsonRpcSubprotocol) {
+		// браузер закроет соединение, если сервер не выберет ни один из предложенных протоколов
+		u := upgrader
+		u.Subprotocols = []string{tokenProtocol}
+		connUpgrader = &u
+	}
+	conn, err := connUpgrader.Upgrade(w, r, nil)
 	dieOnError(err)
 	defer conn.Close()
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // отменяем все незавершенные запросы соединения
+
 	client := &ProxyClient{
-		params:          &p.params,
+		proxy:           p,
+		id:              atomic.AddUint64(&lastClientId, 1),
+		connectedAt:     time.Now(),
 		originalRequest: r,
-		xRealIp:         ip,
+		address:         addr,
+		xRealIp:         addr.Ip,
+		forwardedFor:    addr.ForwardedFor,
 		conn:            conn,
+		ctx:             ctx,
 		statCounter:     NewStatCounter(globalStatCounter),
+		rateLimiter:     NewTokenBucket(params.Throttle.PerClient, p.limiters.clock),
+		strictJsonRpc:   conn.Subprotocol() == JsonRpcSubprotocol || wantsStrictJsonRpc(r.URL.Query().Get("jsonrpc")),
+		identity:        identity,
 	}
-	if *logConnections {
-		client.LogInfof("Connected")
+	if params.LogConnections {
+		if identity != nil {
+			client.LogInfof("Connected as %s", identity.UserId)
+		} else {
+			client.LogInfof("Connected")
+		}
 		defer client.LogInfof("Disconnected")
 	}
 	globalStatCounter.OpenedConnection()
 	defer globalStatCounter.ClosedConnection()
+	activeClients.Add(client)
+	defer activeClients.Remove(client)
 
 	conn.SetReadLimit(MessageSizeLimit)
 	conn.SetReadDeadline(time.Now().Add(ReadDeadline))
@@ -102,52 +153,142 @@ func (p *WsProxy) ServeWebsocket(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	for {
-		rq := JsonRpcRequest{}
-		err := conn.ReadJSON(&rq)
+		_, bs, err := conn.ReadMessage()
 		if err != nil {
 			if websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
 				break
 			}
-			if *logConnections {
+			if client.params().LogConnections && atomic.LoadInt32(&client.closedByProxy) == 0 {
 				client.LogErrorf("On read: %s", err)
 			}
 			break
 		}
 
-		now := time.Now()
-		client.statCounter.TickIfNeeded(now)
-		globalStatCounter.ThrottleIfNeeded(now, *throttleRps, *throttleConcurrentRequests)
-		client.statCounter.ThrottleIfNeeded(now, *throttleRpsPerClient, *throttleConcurrentRequestsPerClient)
+		handleWebsocketMessage(client, bs)
 
 		if client.gotWriteError {
 			break
 		}
 
-		client.statCounter.RequestStarted()
-		go client.HandleRpcRequest(&rq)
-
 		conn.SetReadDeadline(time.Now().Add(ReadDeadline))
 	}
 }
 
+// Разобрать сообщение клиента и запустить обработку запросов из него.
+// Сообщения, которые не удалось разобрать, получают ответ с ошибкой, соединение при этом не закрывается.
+func handleWebsocketMessage(client *ProxyClient, bs []byte) {
+	if client.strictJsonRpc && IsJsonRpcBatch(bs) {
+		batch, requests, err := client.parseBatch(bs)
+		if err != nil {
+			client.SendMalformedMessageError(bs, err)
+			return
+		}
+		client.startRpcBatch(batch, requests)
+		go client.finishRpcBatch(batch)
+		return
+	}
+
+	rq := &JsonRpcRequest{}
+	if err := json.Unmarshal(bs, rq); err != nil {
+		client.SendMalformedMessageError(bs, err)
+		return
+	}
+	client.goHandleRpcRequest(rq, nil)
+}
+
+// Запустить обработку запроса rq в отдельной горутине и вызвать done (если не nil) по ее
+// завершении. Если у соединения уже -throttle-max-pending-per-client незавершенных запросов,
+// сначала ждет, пока какой-нибудь завершится: цикл чтения вебсокета тем временем стоит.
+// Возвращает false, если соединение закрылось раньше и запрос не запущен.
+func (c *ProxyClient) goHandleRpcRequest(rq *JsonRpcRequest, done func()) bool {
+	if !c.acquirePending() {
+		return false
+	}
+	countRequest(c)
+	go func() {
+		defer c.pendingRequests.Release()
+		if done != nil {
+			defer done()
+		}
+		c.HandleRpcRequest(rq)
+	}()
+	return true
+}
+
+// Учесть очередной запрос клиента (ограничения частоты применяются при его обработке, см. ratelimit.go)
+func countRequest(client *ProxyClient) {
+	client.statCounter.TickIfNeeded(time.Now())
+	client.statCounter.RequestStarted()
+}
+
+// Закрыть вебсокет клиента с кодом code (у HTTP-клиентов закрывать нечего)
+func (c *ProxyClient) closeConnection(code int, text string) {
+	conn, ok := c.conn.(*websocket.Conn)
+	if !ok {
+		return
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	atomic.StoreInt32(&c.closedByProxy, 1)
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(time.Second))
+	conn.Close() // цикл чтения завершится ошибкой и отменит запросы соединения
+}
+
 // Обработчик HTTP, для упрощения отладки HTTP-over-JSON-RPC
 func (p *WsProxy) ServeHttp(w http.ResponseWriter, r *http.Request) {
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	dieOnError(err)
+	params := p.Params()
+	addr := params.ResolveClientAddress(r)
+	identity, _, err := params.Auth.Authenticate(r)
+	if err != nil {
+		logWarnf(Fields("remote_addr", r.RemoteAddr), "authentication failed: %s", err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 
 	client := &ProxyClient{
-		params:          &p.params,
+		proxy:           p,
+		id:              atomic.AddUint64(&lastClientId, 1),
+		connectedAt:     time.Now(),
 		originalRequest: r,
-		xRealIp:         ip,
+		address:         addr,
+		xRealIp:         addr.Ip,
+		forwardedFor:    addr.ForwardedFor,
 		conn:            &HttpJsonWriter{w},
+		ctx:             r.Context(),
+		statCounter:     NewStatCounter(globalStatCounter),
+		rateLimiter:     NewTokenBucket(params.Throttle.PerClient, p.limiters.clock),
+		strictJsonRpc:   wantsStrictJsonRpc(r.URL.Query().Get("jsonrpc")),
+		identity:        identity,
+	}
+
+	bs, err := ioutil.ReadAll(io.LimitReader(r.Body, MessageSizeLimit))
+	if err != nil {
+		http.Error(w, "reading request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	if IsJsonRpcBatch(bs) {
+		client.strictJsonRpc = true // пакеты бывают только в JSON-RPC 2.0
+		batch, requests, err := client.parseBatch(bs)
+		if err != nil {
+			client.SendMalformedMessageError(bs, err)
+			return
+		}
+		client.HandleRpcBatch(batch, requests)
+		return
 	}
 
 	rq := JsonRpcRequest{}
-	bs, err := ioutil.ReadAll(r.Body)
-	dieOnError(err)
 	err = json.Unmarshal(bs, &rq)
-	dieOnError(err)
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err != nil {
+		client.SendMalformedMessageError(bs, err)
+		return
+	}
+	if rq.JsonRpc == JsonRpcVersion {
+		client.strictJsonRpc = true
+	}
+	client.statCounter.RequestStarted()
 	client.HandleRpcRequest(&rq)
 }
 
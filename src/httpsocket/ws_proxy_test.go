@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Подключиться к вебсокету прокси p; query - параметры адреса (например "jsonrpc=2.0")
+func dialTestProxy(t *testing.T, p *WsProxy, query string) *websocket.Conn {
+	return dialTestProxyWithHeader(t, p, query, nil)
+}
+
+// Подключиться к вебсокету прокси p с заголовками header в запросе на открытие соединения
+func dialTestProxyWithHeader(t *testing.T, p *WsProxy, query string, header http.Header) *websocket.Conn {
+	server := httptest.NewServer(http.HandlerFunc(p.ServeWebsocket))
+	t.Cleanup(server.Close)
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?" + query
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// Отправить сообщение в вебсокет
+func wsSend(t *testing.T, conn *websocket.Conn, message string) {
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Прочитать из вебсокета очередной ответ
+func wsReceive(t *testing.T, conn *websocket.Conn) map[string]interface{} {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, bs, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := map[string]interface{}{}
+	if err := json.Unmarshal(bs, &resp); err != nil {
+		t.Fatalf("malformed response %q: %s", bs, err)
+	}
+	return resp
+}
+
+// Прочитать n ответов и разложить их по id
+func wsReceiveById(t *testing.T, conn *websocket.Conn, n int) map[interface{}]map[string]interface{} {
+	result := map[interface{}]map[string]interface{}{}
+	for i := 0; i < n; i++ {
+		resp := wsReceive(t, conn)
+		result[resp["id"]] = resp
+	}
+	return result
+}
+
+func TestWebsocketMalformedMessages(t *testing.T) {
+	upstream := newTestUpstream(t)
+	defer upstream.Close()
+	p := newTestProxy(t, nil)
+	conn := dialTestProxy(t, p, "")
+
+	wsSend(t, conn, `{"id": 1, "method": `)
+	if resp := wsReceive(t, conn); strictErrorCode(resp) != ErrCodeParseError || resp["id"] != nil {
+		t.Errorf("invalid JSON: got %v", resp)
+	}
+	wsSend(t, conn, `{"id": 7, "method": 5}`)
+	if resp := wsReceive(t, conn); strictErrorCode(resp) != ErrCodeInvalidRequest || resp["id"] != 7.0 {
+		t.Errorf("invalid request: got %v", resp)
+	}
+	// соединение остается открытым
+	wsSend(t, conn, `{"id": 8, "method": "GET `+upstream.URL+`/a"}`)
+	if resp := wsReceive(t, conn); resp["id"] != 8.0 || resp["http_status"] != 200.0 {
+		t.Errorf("request after malformed ones: got %v", resp)
+	}
+
+	strict := dialTestProxy(t, p, "jsonrpc=2.0")
+	wsSend(t, strict, `[{"jsonrpc": "2.0", "id": 1, "method": "GET `+upstream.URL+`/a"}, {"jsonrpc": "2.0", "id": 2`)
+	if resp := wsReceive(t, strict); strictErrorCode(resp) != ErrCodeParseError || resp["jsonrpc"] != JsonRpcVersion {
+		t.Errorf("malformed batch: got %v", resp)
+	}
+}